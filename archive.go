@@ -0,0 +1,560 @@
+package snapshotter
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("object-archive", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewObjectArchiveSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// ObjectArchiveSnapshotter archives a mounted directory as a zstd compressed
+// tar in an object store, so snapshots can leave the cloud they were taken
+// in. Each snapshot is stored as `<url>/<name>/part-NNNNN.tar.zst` objects,
+// uploaded in parallel, and a `<url>/<name>/manifest.json` written last.
+type ObjectArchiveSnapshotter struct {
+	tag         string
+	namespace   string
+	source      string
+	url         string
+	partSize    int
+	concurrency int
+	level       zstd.EncoderLevel
+	timeout     time.Duration
+
+	store objectStore
+}
+
+// objectArchiveExampleConfigString lists the required keys, `url` is a
+// gs://, s3:// or file:// URL. `part-size-mb=64`, `upload-concurrency=4`,
+// `compression=default` (fastest, default, better or best) and
+// `timeout=6h` are optional.
+var objectArchiveExampleConfigString = "type=object-archive tag=v1 namespace=default source=/data url=gs://mybucket/snapshots"
+
+func NewObjectArchiveSnapshotter(conf map[string]string) (*ObjectArchiveSnapshotter, error) {
+	for _, label := range []string{"tag", "namespace", "source", "url"} {
+		if conf[label] == "" {
+			return nil, fmt.Errorf("backup module object-archive missing value for %s. Example: %s", label, objectArchiveExampleConfigString)
+		}
+	}
+
+	s := &ObjectArchiveSnapshotter{
+		tag:         conf["tag"],
+		namespace:   conf["namespace"],
+		source:      filepath.Clean(conf["source"]),
+		url:         conf["url"],
+		partSize:    64 << 20,
+		concurrency: 4,
+		level:       zstd.SpeedDefault,
+		timeout:     6 * time.Hour,
+	}
+
+	if conf["part-size-mb"] != "" {
+		size, err := strconv.Atoi(conf["part-size-mb"])
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("backup module object-archive invalid value %q for part-size-mb", conf["part-size-mb"])
+		}
+		s.partSize = size << 20
+	}
+
+	if conf["upload-concurrency"] != "" {
+		concurrency, err := strconv.Atoi(conf["upload-concurrency"])
+		if err != nil || concurrency <= 0 {
+			return nil, fmt.Errorf("backup module object-archive invalid value %q for upload-concurrency", conf["upload-concurrency"])
+		}
+		s.concurrency = concurrency
+	}
+
+	if conf["compression"] != "" {
+		found, level := zstd.EncoderLevelFromString(conf["compression"])
+		if !found {
+			return nil, fmt.Errorf("backup module object-archive invalid value %q for compression, valid values are fastest, default, better and best", conf["compression"])
+		}
+		s.level = level
+	}
+
+	if conf["timeout"] != "" {
+		var err error
+		if s.timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module object-archive invalid value for timeout: %w", err)
+		}
+	}
+
+	store, err := newObjectStore(context.Background(), s.url)
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+
+	return s, nil
+}
+
+func (s *ObjectArchiveSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// Backup streams the source directory through tar and zstd, cutting the
+// compressed stream in parts uploaded concurrently. The manifest is written
+// once every part is uploaded, a snapshot without manifest is incomplete.
+// On failure, the parts already uploaded are deleted.
+func (s *ObjectArchiveSnapshotter) Backup(lastSeenBlockNum uint32) (snapshotName string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	manifest := &Manifest{
+		Name:      GenerateName(s.namespace, s.tag, lastSeenBlockNum),
+		Namespace: s.namespace,
+		Tag:       s.tag,
+		BlockNum:  lastSeenBlockNum,
+		CreatedAt: time.Now().UTC(),
+		Version:   Version,
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, part := range manifest.Parts {
+			if deleteErr := s.store.DeleteObject(context.Background(), part.Name); deleteErr != nil {
+				zlog.Warn("unable to delete part of failed archive", zap.String("part", part.Name), zap.Error(deleteErr))
+			}
+		}
+	}()
+
+	reader, writer := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		err := writeArchive(s.source, writer, s.level, manifest)
+		writer.CloseWithError(err)
+		archived <- err
+	}()
+
+	zlog.Info("archiving data directory", zap.String("source", s.source), zap.String("snapshot", manifest.Name), zap.String("url", s.url))
+	err = s.uploadParts(ctx, reader, manifest)
+	reader.CloseWithError(fmt.Errorf("upload stopped"))
+	if archiveErr := <-archived; archiveErr != nil && err == nil {
+		err = archiveErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("archiving %s: %w", s.source, err)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = s.store.WriteObject(ctx, manifest.Name+"/"+ManifestFileName, content); err != nil {
+		return "", fmt.Errorf("writing manifest: %w", err)
+	}
+
+	zlog.Info("archive uploaded", zap.String("snapshot", manifest.Name), zap.Int64("size", manifest.Size), zap.Int64("archive_size", manifest.ArchiveSize), zap.Int("parts", len(manifest.Parts)))
+	return manifest.Name, nil
+}
+
+// uploadParts cuts the archive in parts of partSize bytes, uploading up to
+// `concurrency` of them at the same time, and records them in the manifest
+// along with the checksum of the whole archive.
+func (s *ObjectArchiveSnapshotter) uploadParts(ctx context.Context, archive io.Reader, manifest *Manifest) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var failOnce sync.Once
+	var uploadErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			uploadErr = err
+			cancel()
+		})
+	}
+
+	slots := make(chan struct{}, s.concurrency)
+	total := sha256.New()
+
+	for i := 0; ctx.Err() == nil; i++ {
+		buf := make([]byte, s.partSize)
+		n, err := io.ReadFull(archive, buf)
+		if n > 0 {
+			checksum := sha256.Sum256(buf[:n])
+			total.Write(buf[:n])
+
+			part := &ManifestPart{
+				Name:   fmt.Sprintf("%s/part-%05d.tar.zst", manifest.Name, i),
+				Size:   int64(n),
+				SHA256: hex.EncodeToString(checksum[:]),
+			}
+			manifest.Parts = append(manifest.Parts, part)
+			manifest.ArchiveSize += part.Size
+
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				continue
+			}
+
+			wg.Add(1)
+			go func(content []byte) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				if err := s.store.WriteObject(ctx, part.Name, content); err != nil {
+					fail(fmt.Errorf("uploading part %s: %w", part.Name, err))
+				}
+			}(buf[:n])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	wg.Wait()
+	if uploadErr != nil {
+		return uploadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	manifest.SHA256 = hex.EncodeToString(total.Sum(nil))
+	return nil
+}
+
+// Restore streams the parts of the archive back into the source directory,
+// which must be empty. The checksum of each part is verified as it is read
+// and the checksum of the whole archive at the end, a mismatch fails the
+// restore, leaving a partially restored directory.
+func (s *ObjectArchiveSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	manifest, err := s.readManifest(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.source, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.source)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("cannot restore snapshot %s, directory %s is not empty", snapshotName, s.source)
+	}
+
+	parts := &partsReader{ctx: ctx, store: s.store, parts: manifest.Parts, total: sha256.New()}
+	defer parts.Close()
+
+	zlog.Info("restoring archive to data directory", zap.String("snapshot", snapshotName), zap.String("source", s.source), zap.Int("parts", len(manifest.Parts)))
+	if err := readArchive(parts, s.source); err != nil {
+		return fmt.Errorf("restoring snapshot %s: %w", snapshotName, err)
+	}
+
+	// Drain what zstd did not need, to verify the whole archive
+	if _, err := io.Copy(io.Discard, parts); err != nil {
+		return fmt.Errorf("restoring snapshot %s: %w", snapshotName, err)
+	}
+	if checksum := hex.EncodeToString(parts.total.Sum(nil)); checksum != manifest.SHA256 {
+		return fmt.Errorf("checksum mismatch for snapshot %s, got %s, expected %s", snapshotName, checksum, manifest.SHA256)
+	}
+	return nil
+}
+
+// List returns the complete snapshots of the store matching the namespace
+// and tag.
+func (s *ObjectArchiveSnapshotter) List() (out []*Snapshot, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	objects, err := s.store.ListObjects(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", s.url, err)
+	}
+
+	for _, object := range objects {
+		snapshotName := strings.TrimSuffix(object.Name, "/"+ManifestFileName)
+		if snapshotName == object.Name || strings.Contains(snapshotName, "/") {
+			continue
+		}
+
+		manifest, err := s.readManifest(ctx, snapshotName)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Namespace != s.namespace || manifest.Tag != s.tag {
+			continue
+		}
+		out = append(out, manifest.Snapshot())
+	}
+
+	sortSnapshotsByMostRecent(out)
+	return out, nil
+}
+
+// Delete deletes the manifest first, so an interrupted delete leaves an
+// incomplete snapshot rather than a corrupted one, then the parts.
+func (s *ObjectArchiveSnapshotter) Delete(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	if err := s.store.DeleteObject(ctx, snapshotName+"/"+ManifestFileName); err != nil {
+		return fmt.Errorf("deleting manifest of snapshot %s: %w", snapshotName, err)
+	}
+
+	objects, err := s.store.ListObjects(ctx, snapshotName+"/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.store.DeleteObject(ctx, object.Name); err != nil {
+			return fmt.Errorf("deleting %s: %w", object.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *ObjectArchiveSnapshotter) readManifest(ctx context.Context, snapshotName string) (*Manifest, error) {
+	reader, err := s.store.OpenObject(ctx, snapshotName+"/"+ManifestFileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest of snapshot %s: %w", snapshotName, err)
+	}
+	defer reader.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of snapshot %s: %w", snapshotName, err)
+	}
+	return manifest, nil
+}
+
+// partsReader reads the parts of an archive one after the other, verifying
+// the size and checksum of each part.
+type partsReader struct {
+	ctx   context.Context
+	store objectStore
+	parts []*ManifestPart
+	total hash.Hash
+
+	current     io.ReadCloser
+	currentHash hash.Hash
+	currentSize int64
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			current, err := r.store.OpenObject(r.ctx, r.parts[0].Name)
+			if err != nil {
+				return 0, fmt.Errorf("opening part %s: %w", r.parts[0].Name, err)
+			}
+			r.current, r.currentHash, r.currentSize = current, sha256.New(), 0
+		}
+
+		n, err := r.current.Read(p)
+		r.currentHash.Write(p[:n])
+		r.total.Write(p[:n])
+		r.currentSize += int64(n)
+
+		if err == io.EOF {
+			part := r.parts[0]
+			r.current.Close()
+			r.current = nil
+			r.parts = r.parts[1:]
+
+			if checksum := hex.EncodeToString(r.currentHash.Sum(nil)); r.currentSize != part.Size || checksum != part.SHA256 {
+				return n, fmt.Errorf("part %s is corrupted, got %d bytes with checksum %s, expected %d bytes with checksum %s", part.Name, r.currentSize, checksum, part.Size, part.SHA256)
+			}
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// writeArchive writes the regular files, directories and symlinks of
+// `source` as a zstd compressed tar, counting the files and their size in
+// the manifest.
+func writeArchive(source string, w io.Writer, level zstd.EncoderLevel, manifest *Manifest) error {
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return err
+	}
+	archive := tar.NewWriter(encoder)
+
+	err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.IsDir(), info.Mode().IsRegular():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		default:
+			zlog.Warn("skipping file that is not a regular file, directory or symlink", zap.String("path", path))
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(archive, file); err != nil {
+			return fmt.Errorf("archiving %s: %w", path, err)
+		}
+		manifest.Size += info.Size()
+		manifest.FileCount++
+		return nil
+	})
+	if err != nil {
+		encoder.Close()
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// readArchive extracts a zstd compressed tar into `dir`, refusing entries
+// that would end up outside of it.
+func readArchive(r io.Reader, dir string) error {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	// Compared to the resolved parents of the entries below
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(decoder)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q is outside of the directory", header.Name)
+		}
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(target)); err == nil && parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q is outside of the directory through a symlink", header.Name)
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, archive); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("unsupported archive entry %q of type %c", header.Name, header.Typeflag)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package snapshotter
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestArchiveSource writes a directory with a file spanning several
+// parts of 1 MB, a nested file and a symlink.
+func newTestArchiveSource(t *testing.T) string {
+	source := t.TempDir()
+
+	large := make([]byte, 3<<20+100)
+	rand.New(rand.NewSource(1)).Read(large)
+	if err := os.WriteFile(filepath.Join(source, "large.bin"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(source, "state", "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "state", "db", "CURRENT"), []byte("MANIFEST-000001\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("db/CURRENT", filepath.Join(source, "state", "current")); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func newTestArchiveSnapshotter(t *testing.T, source, store string) *ObjectArchiveSnapshotter {
+	s, err := NewObjectArchiveSnapshotter(map[string]string{
+		"tag":          "v1",
+		"namespace":    "default",
+		"source":       source,
+		"url":          "file://" + store,
+		"part-size-mb": "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestObjectArchiveSnapshotterRoundTrip(t *testing.T) {
+	source := newTestArchiveSource(t)
+	store := t.TempDir()
+	s := newTestArchiveSnapshotter(t, source, store)
+
+	snapshotName, err := s.Backup(100)
+	if err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+
+	snapshots, err := s.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != snapshotName || snapshots[0].BlockNum != 100 {
+		t.Fatalf("list %+v, want snapshot %s", snapshots, snapshotName)
+	}
+
+	// Restored through a symlink to the directory, like a mount point
+	target := t.TempDir()
+	link := filepath.Join(t.TempDir(), "data")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestArchiveSnapshotter(t, link, store).Restore(snapshotName); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+
+	for _, name := range []string{"large.bin", "state/db/CURRENT"} {
+		want, err := os.ReadFile(filepath.Join(source, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatalf("reading restored %s: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("restored %s differs from the source", name)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(target, "state", "current")); err != nil || link != "db/CURRENT" {
+		t.Errorf("restored symlink points to %q (%v), want db/CURRENT", link, err)
+	}
+}
+
+func TestObjectArchiveSnapshotterRestoreFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, store, target, snapshotName string)
+		wantErr string
+	}{
+		{
+			name: "corrupted part",
+			prepare: func(t *testing.T, store, target, snapshotName string) {
+				part := filepath.Join(store, snapshotName, "part-00001.tar.zst")
+				content, err := os.ReadFile(part)
+				if err != nil {
+					t.Fatal(err)
+				}
+				content[len(content)/2] ^= 0xff
+				if err := os.WriteFile(part, content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "part default-v1-0000000100/part-00001.tar.zst is corrupted",
+		},
+		{
+			name: "directory not empty",
+			prepare: func(t *testing.T, store, target, snapshotName string) {
+				if err := os.WriteFile(filepath.Join(target, "leftover"), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "is not empty",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := t.TempDir()
+			snapshotName, err := newTestArchiveSnapshotter(t, newTestArchiveSource(t), store).Backup(100)
+			if err != nil {
+				t.Fatalf("backup: %s", err)
+			}
+
+			target := t.TempDir()
+			test.prepare(t, store, target, snapshotName)
+
+			err = newTestArchiveSnapshotter(t, target, store).Restore(snapshotName)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("restore error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,572 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v4"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("azure-disk-snapshot", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewAzureDiskSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// AzureDiskCSIDriver is the name of the Azure Disk CSI driver.
+const AzureDiskCSIDriver = "disk.csi.azure.com"
+
+const azurePollFrequency = 5 * time.Second
+
+// AzureDiskSnapshotter snapshots the managed disks of the pod's PVCs, for pods
+// running on AKS (or any cluster) with `disk.csi.azure.com` or in-tree
+// `azureDisk` volumes.
+type AzureDiskSnapshotter struct {
+	tag           string
+	namespace     string
+	pod           string
+	resourceGroup string
+	volumes       volumeSelector
+	mounts        []string
+	freeze        string
+	timeout       time.Duration
+
+	disks     *armcompute.DisksClient
+	snapshots *armcompute.SnapshotsClient
+	clientset kubernetes.Interface
+}
+
+// azureExampleConfigString lists the required keys, snapshots are created in
+// `resource-group`. `pvcs`, `mounts`, `freeze` are accepted like for
+// gke-pvc-snapshot and `timeout` defaults to 30m. `endpoint` overrides the
+// Azure Resource Manager endpoint, to use a fake ARM server.
+var azureExampleConfigString = "type=azure-disk-snapshot tag=v1 namespace=default subscription=00000000-0000-0000-0000-000000000000 resource-group=snapshots prefix=datadir"
+
+// NewAzureDiskSnapshotter creates the backend with the default Azure
+// credential (environment, workload identity or managed identity) and the in
+// cluster Kubernetes config, or the default kubeconfig outside of a cluster.
+func NewAzureDiskSnapshotter(conf map[string]string) (*AzureDiskSnapshotter, error) {
+	if err := azureCheckMissing(conf, "subscription"); err != nil {
+		return nil, err
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("azure credential: %w", err)
+	}
+
+	options := &arm.ClientOptions{}
+	if conf["endpoint"] != "" {
+		options.Cloud = cloud.Configuration{
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: conf["endpoint"], Audience: cloud.AzurePublic.Services[cloud.ResourceManager].Audience},
+			},
+		}
+	}
+
+	clientset, err := newKubernetesClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAzureDiskSnapshotterWithClients(conf, conf["subscription"], credential, options, clientset)
+}
+
+// NewAzureDiskSnapshotterWithClients creates the backend with the given
+// credential and ARM client options, which can point to a fake ARM server.
+func NewAzureDiskSnapshotterWithClients(conf map[string]string, subscription string, credential azcore.TokenCredential, options *arm.ClientOptions, clientset kubernetes.Interface) (*AzureDiskSnapshotter, error) {
+	required := []string{"tag", "namespace", "resource-group", "prefix"}
+	if conf["pvcs"] != "" {
+		required = []string{"tag", "namespace", "resource-group"}
+	}
+
+	for _, label := range required {
+		if err := azureCheckMissing(conf, label); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := 30 * time.Minute
+	if conf["timeout"] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module azure-disk-snapshot invalid value for timeout: %w", err)
+		}
+	}
+
+	mounts, freeze, err := parseFreezeConfig("azure-disk-snapshot", conf)
+	if err != nil {
+		return nil, err
+	}
+
+	disks, err := armcompute.NewDisksClient(subscription, credential, options)
+	if err != nil {
+		return nil, fmt.Errorf("disks client: %w", err)
+	}
+
+	snapshots, err := armcompute.NewSnapshotsClient(subscription, credential, options)
+	if err != nil {
+		return nil, fmt.Errorf("snapshots client: %w", err)
+	}
+
+	return &AzureDiskSnapshotter{
+		tag:           conf["tag"],
+		namespace:     conf["namespace"],
+		pod:           os.Getenv("HOSTNAME"),
+		resourceGroup: conf["resource-group"],
+		volumes:       parseVolumeSelector(conf),
+		mounts:        mounts,
+		freeze:        freeze,
+		timeout:       timeout,
+		disks:         disks,
+		snapshots:     snapshots,
+		clientset:     clientset,
+	}, nil
+}
+
+func (s *AzureDiskSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// azureDisk is the managed disk behind a PVC of the pod.
+type azureDisk struct {
+	id            string
+	resourceGroup string
+	name          string
+	claimName     string
+	volume        string
+}
+
+// azureDiskFromPV resolves the managed disk resource ID of a
+// `disk.csi.azure.com` PV, the volume handle, or of an in-tree `azureDisk` PV,
+// its disk URI.
+func azureDiskFromPV(pv *corev1.PersistentVolume, claimName string) (*azureDisk, error) {
+	var id string
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == AzureDiskCSIDriver:
+		id = pv.Spec.CSI.VolumeHandle
+	case pv.Spec.AzureDisk != nil:
+		id = pv.Spec.AzureDisk.DataDiskURI
+	default:
+		return nil, fmt.Errorf("pv %s is not an azure managed disk", pv.Name)
+	}
+
+	resourceID, err := arm.ParseResourceID(id)
+	if err != nil || !strings.EqualFold(resourceID.ResourceType.String(), "Microsoft.Compute/disks") {
+		return nil, fmt.Errorf("invalid managed disk resource id %q in pv %s", id, pv.Name)
+	}
+
+	return &azureDisk{
+		id:            id,
+		resourceGroup: resourceID.ResourceGroupName,
+		name:          resourceID.Name,
+		claimName:     claimName,
+	}, nil
+}
+
+func (s *AzureDiskSnapshotter) getDisks(ctx context.Context) (out []*azureDisk, err error) {
+	claims, err := getPodClaims(ctx, s.clientset, s.pod, s.namespace, s.volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, claimName := range claims {
+		pv, err := getClaimPersistentVolume(ctx, s.clientset, s.namespace, claimName)
+		if err != nil {
+			return nil, err
+		}
+
+		disk, err := azureDiskFromPV(pv, claimName)
+		if err != nil {
+			return nil, err
+		}
+		disk.volume = volumeName(claimName, s.pod)
+		out = append(out, disk)
+	}
+	return out, nil
+}
+
+// Backup creates an incremental snapshot of the managed disk of every
+// selected PVC of the pod, as one group, in the configured resource group.
+// Azure captures the disk when it accepts the request, the mounts are thawed
+// right after. The group succeeds or fails as a whole, on failure the
+// snapshots already created are deleted.
+func (s *AzureDiskSnapshotter) Backup(lastSeenBlockNum uint32) (snapshotName string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	disks, err := s.getDisks(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error getting managed disks: %w", err)
+	}
+
+	req := &snapshotRequest{
+		name:      GenerateName(s.namespace, s.tag, lastSeenBlockNum),
+		namespace: s.namespace,
+		pod:       s.pod,
+		tag:       s.tag,
+		blockNum:  lastSeenBlockNum,
+	}
+
+	locations := make([]*string, len(disks))
+	for i, disk := range disks {
+		resp, err := s.disks.Get(ctx, disk.resourceGroup, disk.name, nil)
+		if err != nil {
+			return "", fmt.Errorf("getting disk %s: %w", disk.id, err)
+		}
+		locations[i] = resp.Location
+	}
+
+	thaw, err := quiesce(ctx, s.mounts, s.freeze)
+	if err != nil {
+		return "", fmt.Errorf("quiescing filesystems: %w", err)
+	}
+	defer thaw()
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		thaw()
+		for _, name := range created {
+			zlog.Info("deleting azure snapshot of failed group", zap.String("snapshot", name), zap.String("group", req.name))
+			if deleteErr := s.deleteSnapshot(context.Background(), name); deleteErr != nil {
+				zlog.Error("unable to delete azure snapshot of failed group", zap.String("snapshot", name), zap.Error(deleteErr))
+			}
+		}
+	}()
+
+	var pollers []*runtime.Poller[armcompute.SnapshotsClientCreateOrUpdateResponse]
+	for i, disk := range disks {
+		name := GroupMemberName(req.name, disk.volume, len(disks))
+
+		zlog.Info("creating azure snapshot", zap.String("snapshot", name), zap.String("disk", disk.id))
+		var poller *runtime.Poller[armcompute.SnapshotsClientCreateOrUpdateResponse]
+		poller, err = s.snapshots.BeginCreateOrUpdate(ctx, s.resourceGroup, name, armcompute.Snapshot{
+			Location: locations[i],
+			Tags:     azureTags(snapshotLabels(req, &pdDef{claimName: disk.claimName, volume: disk.volume})),
+			Properties: &armcompute.SnapshotProperties{
+				CreationData: &armcompute.CreationData{
+					CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+					SourceResourceID: to.Ptr(disk.id),
+				},
+				Incremental: to.Ptr(true),
+			},
+		}, nil)
+		if err != nil {
+			return "", fmt.Errorf("creating snapshot %s of disk %s: %w", name, disk.id, err)
+		}
+		created = append(created, name)
+		pollers = append(pollers, poller)
+	}
+	thaw()
+
+	for i, poller := range pollers {
+		if _, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: azurePollFrequency}); err != nil {
+			return "", &SnapshotFailedError{Snapshot: created[i], Reason: err.Error()}
+		}
+	}
+
+	return req.name, nil
+}
+
+// Restore swaps the managed disk of each volume of the pod with a disk
+// created from the snapshot of the same volume. The disk is deleted and
+// created again under the same name, from the snapshot and with the same
+// location, zones, SKU, size and performance settings, so the PV keeps
+// pointing to the same resource ID. The disks must not be attached: the pod
+// must be stopped and Restore run from elsewhere, with HOSTNAME set to the
+// name of the pod. Every disk is checked before any is deleted.
+//
+// Each disk is first snapshotted as `<disk>-pre-restore-<time>` in the
+// configured resource group. When the disk cannot be created from the
+// snapshot to restore, it is created again from that snapshot, which is kept.
+// It is deleted once the disk is restored.
+func (s *AzureDiskSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	disks, err := s.getDisks(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting managed disks: %w", err)
+	}
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	type swap struct {
+		snapshot *armcompute.Snapshot
+		disk     *azureDisk
+		current  *armcompute.Disk
+	}
+
+	var swaps []*swap
+	for _, member := range members {
+		disk := disks[0]
+		if volume := azureString(member.Tags[LabelVolume]); volume != "" {
+			if disk = findAzureDisk(disks, volume); disk == nil {
+				return fmt.Errorf("snapshot %s is of volume %q which the pod does not have", azureString(member.Name), volume)
+			}
+		}
+
+		resp, err := s.disks.Get(ctx, disk.resourceGroup, disk.name, nil)
+		if err != nil {
+			return fmt.Errorf("getting disk %s: %w", disk.id, err)
+		}
+		if resp.ManagedBy != nil {
+			return fmt.Errorf("disk %s is attached to %s, the pod must be stopped to restore it", disk.id, *resp.ManagedBy)
+		}
+
+		swaps = append(swaps, &swap{snapshot: member, disk: disk, current: &resp.Disk})
+	}
+
+	for _, swap := range swaps {
+		disk, current := swap.disk, swap.current
+
+		backupName := fmt.Sprintf("%s-pre-restore-%d", disk.name, time.Now().Unix())
+		zlog.Info("snapshotting azure disk before restoring it", zap.String("disk", disk.id), zap.String("snapshot", backupName))
+		backup, err := s.createSnapshot(ctx, backupName, current.Location, disk.id)
+		if err != nil {
+			return fmt.Errorf("snapshotting disk %s before restoring it: %w", disk.id, err)
+		}
+
+		zlog.Info("deleting azure disk", zap.String("disk", disk.id))
+		deletePoller, err := s.disks.BeginDelete(ctx, disk.resourceGroup, disk.name, nil)
+		if err == nil {
+			_, err = deletePoller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: azurePollFrequency})
+		}
+		if err != nil {
+			return fmt.Errorf("deleting disk %s, its snapshot %s is kept: %w", disk.id, backupName, err)
+		}
+
+		zlog.Info("creating azure disk from snapshot", zap.String("disk", disk.id), zap.String("snapshot", azureString(swap.snapshot.ID)))
+		if err := s.createDisk(ctx, disk, current, swap.snapshot.ID); err != nil {
+			zlog.Warn("unable to restore azure disk, creating it again from its snapshot", zap.String("disk", disk.id), zap.String("snapshot", backupName), zap.Error(err))
+			if recreateErr := s.createDisk(ctx, disk, current, backup.ID); recreateErr != nil {
+				return fmt.Errorf("creating disk %s from snapshot %s: %w, creating it again from its snapshot %s failed too: %s", disk.id, azureString(swap.snapshot.Name), err, backupName, recreateErr)
+			}
+			return fmt.Errorf("creating disk %s from snapshot %s, it was created again from its snapshot %s: %w", disk.id, azureString(swap.snapshot.Name), backupName, err)
+		}
+
+		if err := s.deleteSnapshot(ctx, backupName); err != nil {
+			zlog.Warn("unable to delete azure snapshot taken before restore", zap.String("snapshot", backupName), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// createSnapshot creates an incremental snapshot of the disk and waits for it.
+func (s *AzureDiskSnapshotter) createSnapshot(ctx context.Context, name string, location *string, diskID string) (*armcompute.Snapshot, error) {
+	poller, err := s.snapshots.BeginCreateOrUpdate(ctx, s.resourceGroup, name, armcompute.Snapshot{
+		Location: location,
+		Properties: &armcompute.SnapshotProperties{
+			CreationData: &armcompute.CreationData{
+				CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+				SourceResourceID: to.Ptr(diskID),
+			},
+			Incremental: to.Ptr(true),
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: azurePollFrequency})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Snapshot, nil
+}
+
+// createDisk creates the disk from the snapshot `snapshotID` with the
+// settings of `current`, the disk it replaces.
+func (s *AzureDiskSnapshotter) createDisk(ctx context.Context, disk *azureDisk, current *armcompute.Disk, snapshotID *string) error {
+	properties := &armcompute.DiskProperties{
+		CreationData: &armcompute.CreationData{
+			CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+			SourceResourceID: snapshotID,
+		},
+	}
+	if current.Properties != nil {
+		properties.DiskSizeGB = current.Properties.DiskSizeGB
+		properties.DiskIOPSReadWrite = current.Properties.DiskIOPSReadWrite
+		properties.DiskMBpsReadWrite = current.Properties.DiskMBpsReadWrite
+		properties.Tier = current.Properties.Tier
+	}
+
+	poller, err := s.disks.BeginCreateOrUpdate(ctx, disk.resourceGroup, disk.name, armcompute.Disk{
+		Location:   current.Location,
+		Zones:      current.Zones,
+		SKU:        current.SKU,
+		Tags:       current.Tags,
+		Properties: properties,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: azurePollFrequency})
+	return err
+}
+
+// List returns one Snapshot per group, listing the volumes it captured.
+func (s *AzureDiskSnapshotter) List() ([]*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	snapshots, err := s.listSnapshots(ctx, map[string]string{
+		LabelNamespace: s.namespace,
+		LabelTag:       s.tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups snapshotGroups
+	for _, snapshot := range snapshots {
+		var createdAt time.Time
+		if snapshot.Properties != nil && snapshot.Properties.TimeCreated != nil {
+			createdAt = *snapshot.Properties.TimeCreated
+		}
+
+		tags := azureTagMap(snapshot.Tags)
+		snap, err := NewSnapshotFromLabels(azureString(snapshot.Name), createdAt, tags)
+		if err != nil {
+			return nil, err
+		}
+		groups.add(tags[LabelGroup], snap)
+	}
+
+	sortSnapshotsByMostRecent(groups.list)
+	return groups.list, nil
+}
+
+// Delete deletes every snapshot of the group.
+func (s *AzureDiskSnapshotter) Delete(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if err := s.deleteSnapshot(ctx, azureString(member.Name)); err != nil {
+			return fmt.Errorf("deleting snapshot %s: %w", azureString(member.Name), err)
+		}
+	}
+	return nil
+}
+
+func (s *AzureDiskSnapshotter) deleteSnapshot(ctx context.Context, name string) error {
+	poller, err := s.snapshots.BeginDelete(ctx, s.resourceGroup, name, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: azurePollFrequency})
+	return err
+}
+
+// listSnapshots returns the snapshots of the resource group having all the
+// given tags, ARM does not filter snapshots on tags server side.
+func (s *AzureDiskSnapshotter) listSnapshots(ctx context.Context, tags map[string]string) (out []*armcompute.Snapshot, err error) {
+	pager := s.snapshots.NewListByResourceGroupPager(s.resourceGroup, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing snapshots of resource group %s: %w", s.resourceGroup, err)
+		}
+
+	snapshots:
+		for _, snapshot := range page.Value {
+			for key, value := range tags {
+				if azureString(snapshot.Tags[key]) != sanitizeLabelValue(value) {
+					continue snapshots
+				}
+			}
+			out = append(out, snapshot)
+		}
+	}
+	return out, nil
+}
+
+// groupMembers returns the snapshots of the group, or the snapshot of that
+// name.
+func (s *AzureDiskSnapshotter) groupMembers(ctx context.Context, groupName string) ([]*armcompute.Snapshot, error) {
+	members, err := s.listSnapshots(ctx, map[string]string{LabelGroup: groupName})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) > 0 {
+		return members, nil
+	}
+
+	resp, err := s.snapshots.Get(ctx, s.resourceGroup, groupName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getting snapshot %q: %w", groupName, err)
+	}
+	return []*armcompute.Snapshot{&resp.Snapshot}, nil
+}
+
+func findAzureDisk(disks []*azureDisk, volume string) *azureDisk {
+	for _, disk := range disks {
+		if disk.volume == volume {
+			return disk
+		}
+	}
+	return nil
+}
+
+func azureTags(labels map[string]string) map[string]*string {
+	out := make(map[string]*string, len(labels))
+	for key, value := range labels {
+		out[key] = to.Ptr(value)
+	}
+	return out
+}
+
+func azureTagMap(tags map[string]*string) map[string]string {
+	out := make(map[string]string, len(tags))
+	for key, value := range tags {
+		out[key] = azureString(value)
+	}
+	return out
+}
+
+func azureCheckMissing(conf map[string]string, param string) error {
+	if conf[param] == "" {
+		return fmt.Errorf("backup module azure-disk-snapshot missing value for %s. Example: %s", param, azureExampleConfigString)
+	}
+	return nil
+}
+
+func azureString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
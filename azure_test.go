@@ -0,0 +1,277 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const azureTestDiskID = "/subscriptions/sub/resourceGroups/disks/providers/Microsoft.Compute/disks/disk-0"
+
+// fakeARM serves the managed disk and snapshot resources the backend uses,
+// keeping them in memory and recording every mutating request.
+type fakeARM struct {
+	lock      sync.Mutex
+	resources map[string]map[string]interface{}
+	requests  []string
+
+	// failDiskFrom fails the creation of the disks from that source
+	failDiskFrom string
+}
+
+func newFakeARM(t *testing.T) (*fakeARM, *httptest.Server) {
+	api := &fakeARM{resources: map[string]map[string]interface{}{}}
+	srv := httptest.NewTLSServer(api)
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func (f *fakeARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	id := r.URL.Path
+	if r.Method != http.MethodGet {
+		f.requests = append(f.requests, r.Method+" "+id[strings.LastIndex(id, "/")+1:])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if strings.HasSuffix(id, "/snapshots") {
+			var values []interface{}
+			for resourceID, resource := range f.resources {
+				if strings.HasPrefix(resourceID, id+"/") {
+					values = append(values, resource)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": values})
+			return
+		}
+
+		resource, found := f.resources[id]
+		if !found {
+			f.writeError(w, http.StatusNotFound, "ResourceNotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(resource)
+
+	case http.MethodPut:
+		resource := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+			f.writeError(w, http.StatusBadRequest, "InvalidRequestContent")
+			return
+		}
+
+		properties, _ := resource["properties"].(map[string]interface{})
+		creationData, _ := properties["creationData"].(map[string]interface{})
+		if f.failDiskFrom != "" && strings.Contains(id, "/disks/") && creationData["sourceResourceId"] == f.failDiskFrom {
+			f.writeError(w, http.StatusBadRequest, "OperationNotAllowed")
+			return
+		}
+
+		resource["id"] = id
+		resource["name"] = id[strings.LastIndex(id, "/")+1:]
+		properties["provisioningState"] = "Succeeded"
+		properties["timeCreated"] = time.Now().UTC().Format(time.RFC3339)
+		f.resources[id] = resource
+		json.NewEncoder(w).Encode(resource)
+
+	case http.MethodDelete:
+		delete(f.resources, id)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (f *fakeARM) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%q,"message":"fake error"}}`, code)
+}
+
+func (f *fakeARM) source(id string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	resource, found := f.resources[id]
+	if !found {
+		return ""
+	}
+	properties, _ := resource["properties"].(map[string]interface{})
+	creationData, _ := properties["creationData"].(map[string]interface{})
+	source, _ := creationData["sourceResourceId"].(string)
+	return source
+}
+
+type fakeCredential struct{}
+
+func (fakeCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// newTestAzureDiskSnapshotter returns the backend of pod `node-0`, whose
+// `datadir` PVC is bound to the managed disk azureTestDiskID.
+func newTestAzureDiskSnapshotter(t *testing.T, api *fakeARM, srv *httptest.Server, managedBy string) *AzureDiskSnapshotter {
+	t.Setenv("HOSTNAME", "node-0")
+
+	disk := map[string]interface{}{
+		"id":         azureTestDiskID,
+		"name":       "disk-0",
+		"location":   "eastus",
+		"zones":      []string{"1"},
+		"sku":        map[string]interface{}{"name": "Premium_LRS"},
+		"properties": map[string]interface{}{"diskSizeGB": 100},
+	}
+	if managedBy != "" {
+		disk["managedBy"] = managedBy
+	}
+	api.resources[azureTestDiskID] = disk
+
+	clientset := newAzureTestClientset()
+	options := &arm.ClientOptions{ClientOptions: azcore.ClientOptions{
+		Cloud: cloud.Configuration{
+			Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+				cloud.ResourceManager: {Endpoint: srv.URL, Audience: "https://management.azure.com"},
+			},
+		},
+		Transport: srv.Client(),
+		Retry:     policy.RetryOptions{MaxRetries: -1},
+	}}
+
+	s, err := NewAzureDiskSnapshotterWithClients(map[string]string{
+		"tag":            "v1",
+		"namespace":      "default",
+		"resource-group": "snapshots",
+		"prefix":         "datadir",
+	}, "sub", fakeCredential{}, options, clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newAzureTestClientset() *fake.Clientset {
+	return fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-0", Namespace: "default"},
+			Spec: corev1.PodSpec{Volumes: []corev1.Volume{{
+				Name:         "datadir",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "datadir-node-0"}},
+			}}},
+		},
+		&corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "datadir-node-0", Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv-0"},
+		},
+		&corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-0"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: AzureDiskCSIDriver, VolumeHandle: azureTestDiskID},
+			}},
+		},
+	)
+}
+
+func TestAzureDiskSnapshotterRestore(t *testing.T) {
+	tests := []struct {
+		name         string
+		failRestore  bool
+		wantErr      string
+		wantRequests []string
+		wantSource   string
+	}{
+		{
+			name:         "restored",
+			wantRequests: []string{"PUT pre-restore", "DELETE disk-0", "PUT disk-0", "DELETE pre-restore"},
+			wantSource:   "snapshot",
+		},
+		{
+			name:         "created again from the pre-restore snapshot",
+			failRestore:  true,
+			wantErr:      "it was created again from its snapshot disk-0-pre-restore-",
+			wantRequests: []string{"PUT pre-restore", "DELETE disk-0", "PUT disk-0", "PUT disk-0"},
+			wantSource:   "pre-restore",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, srv := newFakeARM(t)
+			s := newTestAzureDiskSnapshotter(t, api, srv, "")
+
+			snapshotName, err := s.Backup(100)
+			if err != nil {
+				t.Fatalf("backup: %s", err)
+			}
+			snapshotID := "/subscriptions/sub/resourceGroups/snapshots/providers/Microsoft.Compute/snapshots/" + snapshotName
+			if test.failRestore {
+				api.failDiskFrom = snapshotID
+			}
+			api.requests = nil
+
+			err = s.Restore(snapshotName)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("restore: %s", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("restore error %v, want %q", err, test.wantErr)
+			}
+
+			if len(api.requests) != len(test.wantRequests) {
+				t.Fatalf("requests %v, want %v", api.requests, test.wantRequests)
+			}
+			for i, request := range api.requests {
+				want := strings.Replace(test.wantRequests[i], "pre-restore", "disk-0-pre-restore-", 1)
+				if !strings.HasPrefix(request, want) {
+					t.Errorf("request %d is %q, want %q", i, request, want)
+				}
+			}
+
+			source := api.source(azureTestDiskID)
+			switch test.wantSource {
+			case "snapshot":
+				if source != snapshotID {
+					t.Errorf("disk created from %q, want %q", source, snapshotID)
+				}
+			case "pre-restore":
+				if !strings.Contains(source, "/snapshots/disk-0-pre-restore-") {
+					t.Errorf("disk created from %q, want the pre-restore snapshot", source)
+				}
+				if _, found := api.resources[source]; !found {
+					t.Errorf("pre-restore snapshot %s was deleted", source)
+				}
+			}
+		})
+	}
+}
+
+func TestAzureDiskSnapshotterRestoreAttached(t *testing.T) {
+	api, srv := newFakeARM(t)
+	s := newTestAzureDiskSnapshotter(t, api, srv, "/subscriptions/sub/resourceGroups/nodes/providers/Microsoft.Compute/virtualMachines/vm-0")
+
+	snapshotName, err := s.Backup(100)
+	if err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+	api.requests = nil
+
+	if err := s.Restore(snapshotName); err == nil || !strings.Contains(err.Error(), "the pod must be stopped") {
+		t.Fatalf("restore error %v, want the disk to be refused", err)
+	}
+	if len(api.requests) != 0 {
+		t.Errorf("requests %v, want none", api.requests)
+	}
+}
@@ -0,0 +1,87 @@
+package snapshotter
+
+import (
+	"io"
+	"math/bits"
+)
+
+// gearTable maps each byte to a random value for the rolling gear hash. It
+// is derived from a fixed seed, changing it would change every chunk
+// boundary and defeat deduplication with existing chunks.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	state := uint64(0x736e617073686f74)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker cuts a stream in content defined chunks: a boundary is placed
+// where the gear hash of the last bytes matches the mask, so inserting or
+// removing bytes only changes the chunks around the change. The mask covers
+// the high bits of the hash, which depend on the last 64 bytes. Chunks are at
+// least minSize and at most maxSize bytes, averageSize on average.
+type chunker struct {
+	reader  io.Reader
+	minSize int
+	maxSize int
+	mask    uint64
+	buf     []byte
+
+	// in holds the bytes read from reader, in[start:end] not yet chunked
+	in         []byte
+	start, end int
+	err        error
+}
+
+// newChunker returns a chunker of average chunk size `averageSize`, which
+// must be a power of two, with chunks between a quarter and four times that.
+func newChunker(r io.Reader, averageSize int) *chunker {
+	return &chunker{
+		reader:  r,
+		minSize: averageSize / 4,
+		maxSize: averageSize * 4,
+		mask:    ^uint64(0) << (64 - bits.TrailingZeros(uint(averageSize))),
+		buf:     make([]byte, 0, averageSize),
+		in:      make([]byte, 1<<16),
+	}
+}
+
+// Next returns the next chunk, valid until the following call, or io.EOF
+// at the end of the stream.
+func (c *chunker) Next() ([]byte, error) {
+	c.buf = c.buf[:0]
+
+	var hash uint64
+	for {
+		if c.start == c.end {
+			if c.err != nil {
+				if c.err == io.EOF && len(c.buf) > 0 {
+					return c.buf, nil
+				}
+				return nil, c.err
+			}
+
+			c.start = 0
+			c.end, c.err = c.reader.Read(c.in)
+			continue
+		}
+
+		for i, b := range c.in[c.start:c.end] {
+			hash = (hash << 1) + gearTable[b]
+
+			if size := len(c.buf) + i + 1; size >= c.maxSize || (size >= c.minSize && hash&c.mask == 0) {
+				c.buf = append(c.buf, c.in[c.start:c.start+i+1]...)
+				c.start += i + 1
+				return c.buf, nil
+			}
+		}
+		c.buf = append(c.buf, c.in[c.start:c.end]...)
+		c.start = c.end
+	}
+}
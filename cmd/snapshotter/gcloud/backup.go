@@ -0,0 +1,65 @@
+package gcloud
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/snapshotter"
+)
+
+// Methods to keep the disk replaced by a restore.
+const (
+	BackupNone     = "none"
+	BackupSnapshot = "snapshot"
+	BackupClone    = "clone"
+)
+
+// DiskBackup is a snapshot or a disk clone keeping a disk replaced by a
+// restore, Of is the name of that disk.
+type DiskBackup struct {
+	Name    string    `json:"name"`
+	Method  string    `json:"method"`
+	Of      string    `json:"of"`
+	Created time.Time `json:"created,omitempty"`
+	SizeGB  int64     `json:"size_gb,omitempty"`
+}
+
+// BackupName returns the name of the backup of the disk taken at `now`.
+func BackupName(diskName string, now time.Time) string {
+	return suffixedName(diskName, "-backup-", now)
+}
+
+// RestoredDiskName returns the name of the disk replacing `diskName` in a
+// restore at `now`, replacing the suffix of a previous restore.
+func RestoredDiskName(diskName string, now time.Time) string {
+	return suffixedName(restoredSuffix.ReplaceAllString(diskName, ""), "-restore-", now)
+}
+
+var restoredSuffix = regexp.MustCompile(`-restore-[0-9]{14}$`)
+
+// suffixedName appends the kind and time to the name, truncating the name to
+// keep it within the 63 characters GCE accepts.
+func suffixedName(name, kind string, now time.Time) string {
+	suffix := kind + now.UTC().Format("20060102150405")
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+func newDiskBackup(method, name, creationTimestamp string, sizeGB int64, labels map[string]string) (*DiskBackup, error) {
+	created, err := time.Parse(time.RFC3339, creationTimestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid creation timestamp %q of backup %s: %w", creationTimestamp, name, err)
+	}
+
+	return &DiskBackup{
+		Name:    name,
+		Method:  method,
+		Of:      labels[snapshotter.LabelBackupOf],
+		Created: created,
+		SizeGB:  sizeGB,
+	}, nil
+}
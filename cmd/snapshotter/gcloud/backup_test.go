@@ -0,0 +1,56 @@
+package gcloud
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuffixedName(t *testing.T) {
+	now := time.Date(2022, 5, 18, 12, 30, 45, 0, time.FixedZone("EDT", -4*3600))
+	long := "pvc-" + strings.Repeat("0123456789", 6)
+
+	tests := []struct {
+		name     string
+		diskName string
+		kind     string
+		want     string
+	}{
+		{name: "short", diskName: "pvc-1234", kind: "-backup-", want: "pvc-1234-backup-20220518163045"},
+		{name: "truncated", diskName: long, kind: "-backup-", want: "pvc-0123456789012345678901234567890123456-backup-20220518163045"},
+		{name: "truncated on a dash", diskName: "pvc-" + strings.Repeat("a", 35) + "-bcd", kind: "-restore-", want: "pvc-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-restore-20220518163045"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := suffixedName(test.diskName, test.kind, now)
+			if got != test.want {
+				t.Errorf("suffixedName %q, want %q", got, test.want)
+			}
+			if len(got) > 63 {
+				t.Errorf("suffixedName %q is %d characters long", got, len(got))
+			}
+		})
+	}
+}
+
+func TestRestoredDiskName(t *testing.T) {
+	now := time.Date(2022, 5, 18, 12, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		diskName string
+		want     string
+	}{
+		{diskName: "pvc-1234", want: "pvc-1234-restore-20220518123045"},
+		{diskName: "pvc-1234-restore-20220501000000", want: "pvc-1234-restore-20220518123045"},
+		{diskName: "pvc-1234-restore-2022", want: "pvc-1234-restore-2022-restore-20220518123045"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.diskName, func(t *testing.T) {
+			if got := RestoredDiskName(test.diskName, now); got != test.want {
+				t.Errorf("RestoredDiskName %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package gcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/snapshotter"
+	"go.uber.org/zap"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Client runs the Compute Engine calls of the CLI against a project. Calls
+// that start an operation wait for it to complete.
+type Client struct {
+	service   *compute.Service
+	resources *cloudresourcemanager.Service
+	project   string
+}
+
+// NewClient returns a client using the application default credentials,
+// `opts` can point it to another endpoint, like an HTTP fake with
+// `option.WithEndpoint` and `option.WithoutAuthentication`.
+func NewClient(ctx context.Context, project string, opts ...option.ClientOption) (*Client, error) {
+	service, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating compute client: %w", err)
+	}
+	resources, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating resource manager client: %w", err)
+	}
+	return &Client{service: service, resources: resources, project: project}, nil
+}
+
+// GetSnapshots returns every snapshot of the project.
+func (c *Client) GetSnapshots(ctx context.Context) ([]Snapshot, error) {
+	zlog.Info("get snapshots", zap.String("project", c.project))
+
+	var out []Snapshot
+	err := c.service.Snapshots.List(c.project).Pages(ctx, func(page *compute.SnapshotList) error {
+		for _, item := range page.Items {
+			snap, err := newSnapshot(item)
+			if err != nil {
+				return err
+			}
+			out = append(out, snap)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots of project %s: %w", c.project, err)
+	}
+	return out, nil
+}
+
+// DeleteDisk deletes the disk, see IsDiskInUse for the error returned while
+// the disk is still attached.
+func (c *Client) DeleteDisk(ctx context.Context, location *DiskLocation, diskName string) error {
+	zlog.Info("delete disk", zap.String("disk", diskName), zap.Stringer("location", location), zap.String("project", c.project))
+
+	var op *compute.Operation
+	var err error
+	if location.IsRegional() {
+		op, err = c.service.RegionDisks.Delete(c.project, location.Region, diskName).Context(ctx).Do()
+	} else {
+		op, err = c.service.Disks.Delete(c.project, location.Zone, diskName).Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+	return snapshotter.WaitForOperation(ctx, c.service, c.project, op)
+}
+
+// GetDiskType returns the type of the disk, like pd-ssd.
+func (c *Client) GetDiskType(ctx context.Context, location *DiskLocation, diskName string) (string, error) {
+	var disk *compute.Disk
+	var err error
+	if location.IsRegional() {
+		disk, err = c.service.RegionDisks.Get(c.project, location.Region, diskName).Context(ctx).Do()
+	} else {
+		disk, err = c.service.Disks.Get(c.project, location.Zone, diskName).Context(ctx).Do()
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting disk %s: %w", diskName, err)
+	}
+	return path.Base(disk.Type), nil
+}
+
+// DeleteSnapshot deletes the snapshot.
+func (c *Client) DeleteSnapshot(ctx context.Context, snapshotName string) error {
+	zlog.Info("delete snapshot", zap.String("snapshot", snapshotName), zap.String("project", c.project))
+
+	op, err := c.service.Snapshots.Delete(c.project, snapshotName).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	return snapshotter.WaitForOperation(ctx, c.service, c.project, op)
+}
+
+// CreateDiskFromSnapshot creates a disk of type `diskType`, like pd-ssd, and
+// `sizeGB` from the snapshot, in the zone of `location` or, when it is
+// regional, in its region replicated in its replica zones. `snapshot` is the
+// name of a snapshot of the project or the self link of a snapshot of any
+// project.
+func (c *Client) CreateDiskFromSnapshot(ctx context.Context, location *DiskLocation, diskName, diskType string, sizeGB int64, snapshot string) error {
+	zlog.Info("create disk from snapshot", zap.String("disk", diskName), zap.Stringer("location", location), zap.String("type", diskType), zap.Int64("size_gb", sizeGB), zap.String("snapshot", snapshot))
+
+	if !strings.Contains(snapshot, "/") {
+		snapshot = "projects/" + c.project + "/global/snapshots/" + snapshot
+	}
+
+	return c.insertDisk(ctx, location, &compute.Disk{
+		Name:           diskName,
+		SizeGb:         sizeGB,
+		SourceSnapshot: snapshot,
+		Type:           location.diskType(c.project, diskType),
+	})
+}
+
+// CloneDisk creates a disk like CreateDiskFromSnapshot, from the disk
+// `sourceDisk` of the same location. A zero `sizeGB` keeps the size of the
+// source disk.
+func (c *Client) CloneDisk(ctx context.Context, location *DiskLocation, diskName, diskType string, sizeGB int64, sourceDisk string, labels map[string]string) error {
+	zlog.Info("clone disk", zap.String("disk", diskName), zap.Stringer("location", location), zap.String("type", diskType), zap.Int64("size_gb", sizeGB), zap.String("source_disk", sourceDisk))
+
+	return c.insertDisk(ctx, location, &compute.Disk{
+		Name:       diskName,
+		SizeGb:     sizeGB,
+		SourceDisk: location.disk(c.project, sourceDisk),
+		Type:       location.diskType(c.project, diskType),
+		Labels:     labels,
+	})
+}
+
+func (c *Client) insertDisk(ctx context.Context, location *DiskLocation, disk *compute.Disk) error {
+	var op *compute.Operation
+	var err error
+	if location.IsRegional() {
+		disk.ReplicaZones = location.replicaZones(c.project)
+		op, err = c.service.RegionDisks.Insert(c.project, location.Region, disk).Context(ctx).Do()
+	} else {
+		op, err = c.service.Disks.Insert(c.project, location.Zone, disk).Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+	return snapshotter.WaitForOperation(ctx, c.service, c.project, op)
+}
+
+// SnapshotDisk snapshots the disk and waits for the snapshot to be READY, so
+// the disk can be deleted.
+func (c *Client) SnapshotDisk(ctx context.Context, location *DiskLocation, diskName, snapshotName string, labels map[string]string) error {
+	zlog.Info("snapshot disk", zap.String("disk", diskName), zap.Stringer("location", location), zap.String("snapshot", snapshotName))
+
+	snapshot := &compute.Snapshot{Name: snapshotName, Labels: labels}
+
+	var op *compute.Operation
+	var err error
+	if location.IsRegional() {
+		op, err = c.service.RegionDisks.CreateSnapshot(c.project, location.Region, diskName, snapshot).Context(ctx).Do()
+	} else {
+		op, err = c.service.Disks.CreateSnapshot(c.project, location.Zone, diskName, snapshot).Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+	if err := snapshotter.WaitForOperation(ctx, c.service, c.project, op); err != nil {
+		return err
+	}
+	return snapshotter.WaitForSnapshotReady(ctx, c.service, c.project, snapshotName)
+}
+
+// GetDiskBackups returns the snapshots and disks kept by restores of the
+// disk, most recent first.
+func (c *Client) GetDiskBackups(ctx context.Context, location *DiskLocation, diskName string) ([]*DiskBackup, error) {
+	filter := snapshotter.LabelFilter(map[string]string{snapshotter.LabelBackupOf: diskName})
+
+	var out []*DiskBackup
+	err := c.service.Snapshots.List(c.project).Filter(filter).Pages(ctx, func(page *compute.SnapshotList) error {
+		for _, item := range page.Items {
+			backup, err := newDiskBackup(BackupSnapshot, item.Name, item.CreationTimestamp, item.DiskSizeGb, item.Labels)
+			if err != nil {
+				return err
+			}
+			out = append(out, backup)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing backup snapshots of disk %s: %w", diskName, err)
+	}
+
+	addDisks := func(items []*compute.Disk) error {
+		for _, item := range items {
+			backup, err := newDiskBackup(BackupClone, item.Name, item.CreationTimestamp, item.SizeGb, item.Labels)
+			if err != nil {
+				return err
+			}
+			out = append(out, backup)
+		}
+		return nil
+	}
+	if location.IsRegional() {
+		err = c.service.RegionDisks.List(c.project, location.Region).Filter(filter).Pages(ctx, func(page *compute.DiskList) error {
+			return addDisks(page.Items)
+		})
+	} else {
+		err = c.service.Disks.List(c.project, location.Zone).Filter(filter).Pages(ctx, func(page *compute.DiskList) error {
+			return addDisks(page.Items)
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing backup disks of disk %s: %w", diskName, err)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Created.After(out[j].Created)
+	})
+	return out, nil
+}
+
+// MissingPermissions returns the IAM permissions of `permissions` the caller
+// is not granted on the project.
+func (c *Client) MissingPermissions(ctx context.Context, permissions []string) ([]string, error) {
+	resp, err := c.resources.Projects.TestIamPermissions(c.project, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: permissions,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("testing permissions on project %s: %w", c.project, err)
+	}
+	return missingPermissions(permissions, resp.Permissions), nil
+}
+
+// MissingSnapshotPermissions returns the IAM permissions of `permissions`
+// the caller is not granted on the snapshot of the project.
+func (c *Client) MissingSnapshotPermissions(ctx context.Context, snapshotName string, permissions []string) ([]string, error) {
+	resp, err := c.service.Snapshots.TestIamPermissions(c.project, snapshotName, &compute.TestPermissionsRequest{
+		Permissions: permissions,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("testing permissions on snapshot %s of project %s: %w", snapshotName, c.project, err)
+	}
+	return missingPermissions(permissions, resp.Permissions), nil
+}
+
+func missingPermissions(wanted, granted []string) (out []string) {
+	isGranted := map[string]bool{}
+	for _, permission := range granted {
+		isGranted[permission] = true
+	}
+	for _, permission := range wanted {
+		if !isGranted[permission] {
+			out = append(out, permission)
+		}
+	}
+	return
+}
+
+// Project returns the project of the client.
+func (c *Client) Project() string {
+	return c.project
+}
+
+// IsDiskInUse returns true if the error is the refusal to delete a disk
+// still attached to an instance, which happens until the pod using it is
+// gone.
+func IsDiskInUse(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code != http.StatusBadRequest {
+			return false
+		}
+		for _, item := range apiErr.Errors {
+			if item.Reason == "resourceInUseByAnotherResource" {
+				return true
+			}
+		}
+		return false
+	}
+
+	var opErr *snapshotter.OperationError
+	return errors.As(err, &opErr) && opErr.HasCode("RESOURCE_IN_USE_BY_ANOTHER_RESOURCE")
+}
+
+func newSnapshot(item *compute.Snapshot) (Snapshot, error) {
+	created, err := time.Parse(time.RFC3339, item.CreationTimestamp)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("invalid creation timestamp %q of snapshot %s: %w", item.CreationTimestamp, item.Name, err)
+	}
+
+	return Snapshot{
+		Created:  created,
+		Name:     item.Name,
+		SelfLink: item.SelfLink,
+		Size:     item.DiskSizeGb,
+		Status:   item.Status,
+		Labels:   item.Labels,
+	}, nil
+}
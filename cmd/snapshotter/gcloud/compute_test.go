@@ -0,0 +1,309 @@
+package gcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/snapshotter"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeCompute answers disk insertions with a RUNNING operation, DONE with
+// `opErrors` the next time it is polled, and serves `disks` by path.
+type fakeCompute struct {
+	lock     sync.Mutex
+	opErrors []*compute.OperationErrorErrors
+	inserts  map[string]*compute.Disk
+	disks    map[string]*compute.Disk
+	polls    int
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/")
+	parts := strings.Split(path, "/")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/disks"):
+		disk := &compute.Disk{}
+		if err := json.NewDecoder(r.Body).Decode(disk); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.inserts[path] = disk
+
+		// projects/<project>/<zones|regions>/<location>/disks
+		op := &compute.Operation{Name: "op-1", Status: "RUNNING", TargetLink: disk.Name}
+		if parts[2] == "zones" {
+			op.Zone = "projects/" + parts[1] + "/zones/" + parts[3]
+		} else {
+			op.Region = "projects/" + parts[1] + "/regions/" + parts[3]
+		}
+		json.NewEncoder(w).Encode(op)
+
+	case r.Method == http.MethodGet && len(parts) == 6 && parts[4] == "disks":
+		disk, found := f.disks[path]
+		if !found {
+			http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(disk)
+
+	case r.Method == http.MethodGet && len(parts) == 6 && parts[4] == "operations":
+		f.polls++
+		op := &compute.Operation{Name: parts[5], Status: "DONE"}
+		if len(f.opErrors) > 0 {
+			op.Error = &compute.OperationError{Errors: f.opErrors}
+		}
+		json.NewEncoder(w).Encode(op)
+
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+path, http.StatusNotFound)
+	}
+}
+
+func newTestClient(t *testing.T, api *fakeCompute) *Client {
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	client, err := NewClient(context.Background(), "disks", option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClientInsertDisk(t *testing.T) {
+	zonal := &DiskLocation{Zone: "us-central1-a"}
+	regional := &DiskLocation{Region: "us-central1", ReplicaZones: []string{"us-central1-a", "us-central1-b"}}
+
+	tests := []struct {
+		name     string
+		call     func(c *Client) error
+		opErrors []*compute.OperationErrorErrors
+		wantPath string
+		wantDisk *compute.Disk
+		wantCode string
+	}{
+		{
+			name: "from snapshot name",
+			call: func(c *Client) error {
+				return c.CreateDiskFromSnapshot(context.Background(), zonal, "data-0", "pd-ssd", 500, "eth-v1-0000000100")
+			},
+			wantPath: "projects/disks/zones/us-central1-a/disks",
+			wantDisk: &compute.Disk{
+				Name:           "data-0",
+				SizeGb:         500,
+				SourceSnapshot: "projects/disks/global/snapshots/eth-v1-0000000100",
+				Type:           "projects/disks/zones/us-central1-a/diskTypes/pd-ssd",
+			},
+		},
+		{
+			name: "from snapshot self link, regional",
+			call: func(c *Client) error {
+				return c.CreateDiskFromSnapshot(context.Background(), regional, "data-0", "pd-balanced", 500, "https://www.googleapis.com/compute/v1/projects/chain-data/global/snapshots/eth-v1-0000000100")
+			},
+			wantPath: "projects/disks/regions/us-central1/disks",
+			wantDisk: &compute.Disk{
+				Name:           "data-0",
+				SizeGb:         500,
+				SourceSnapshot: "https://www.googleapis.com/compute/v1/projects/chain-data/global/snapshots/eth-v1-0000000100",
+				Type:           "projects/disks/regions/us-central1/diskTypes/pd-balanced",
+				ReplicaZones:   []string{"projects/disks/zones/us-central1-a", "projects/disks/zones/us-central1-b"},
+			},
+		},
+		{
+			name: "clone",
+			call: func(c *Client) error {
+				return c.CloneDisk(context.Background(), zonal, "data-0-backup-1", "pd-ssd", 0, "data-0", map[string]string{snapshotter.LabelBackupOf: "data-0"})
+			},
+			wantPath: "projects/disks/zones/us-central1-a/disks",
+			wantDisk: &compute.Disk{
+				Name:       "data-0-backup-1",
+				SourceDisk: "projects/disks/zones/us-central1-a/disks/data-0",
+				Type:       "projects/disks/zones/us-central1-a/diskTypes/pd-ssd",
+				Labels:     map[string]string{snapshotter.LabelBackupOf: "data-0"},
+			},
+		},
+		{
+			name: "operation failed",
+			call: func(c *Client) error {
+				return c.CreateDiskFromSnapshot(context.Background(), zonal, "data-0", "pd-ssd", 500, "eth-v1-0000000100")
+			},
+			opErrors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED", Message: "Quota 'SSD_TOTAL_GB' exceeded"}},
+			wantPath: "projects/disks/zones/us-central1-a/disks",
+			wantDisk: &compute.Disk{
+				Name:           "data-0",
+				SizeGb:         500,
+				SourceSnapshot: "projects/disks/global/snapshots/eth-v1-0000000100",
+				Type:           "projects/disks/zones/us-central1-a/diskTypes/pd-ssd",
+			},
+			wantCode: "QUOTA_EXCEEDED",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakeCompute{opErrors: test.opErrors, inserts: map[string]*compute.Disk{}}
+			err := test.call(newTestClient(t, api))
+
+			var opErr *snapshotter.OperationError
+			switch {
+			case test.wantCode == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case test.wantCode != "" && (!errors.As(err, &opErr) || !opErr.HasCode(test.wantCode)):
+				t.Fatalf("error %v, want an operation error %s", err, test.wantCode)
+			}
+
+			if api.polls != 1 {
+				t.Errorf("operation polled %d times, want 1", api.polls)
+			}
+			if got := api.inserts[test.wantPath]; !reflect.DeepEqual(got, test.wantDisk) {
+				t.Errorf("inserted %+v at %v, want %+v at %s", got, api.inserts, test.wantDisk, test.wantPath)
+			}
+		})
+	}
+}
+
+func TestClientGetDiskType(t *testing.T) {
+	api := &fakeCompute{disks: map[string]*compute.Disk{
+		"projects/disks/zones/us-central1-a/disks/data-0": {
+			Name: "data-0",
+			Type: "https://www.googleapis.com/compute/v1/projects/disks/zones/us-central1-a/diskTypes/pd-ssd",
+		},
+		"projects/disks/regions/us-central1/disks/data-0": {
+			Name: "data-0",
+			Type: "https://www.googleapis.com/compute/v1/projects/disks/regions/us-central1/diskTypes/pd-balanced",
+		},
+	}}
+	client := newTestClient(t, api)
+
+	tests := []struct {
+		name     string
+		location *DiskLocation
+		disk     string
+		want     string
+		wantErr  bool
+	}{
+		{name: "zonal", location: &DiskLocation{Zone: "us-central1-a"}, disk: "data-0", want: "pd-ssd"},
+		{name: "regional", location: &DiskLocation{Region: "us-central1", ReplicaZones: []string{"us-central1-a", "us-central1-b"}}, disk: "data-0", want: "pd-balanced"},
+		{name: "not found", location: &DiskLocation{Zone: "us-central1-b"}, disk: "data-0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := client.GetDiskType(context.Background(), test.location, test.disk)
+			switch {
+			case test.wantErr && err == nil:
+				t.Fatalf("disk type %q, want an error", got)
+			case !test.wantErr && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("disk type %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientMissingPermissions(t *testing.T) {
+	// Grants the same permissions on every resource, or fails every test
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, `{"error":{"code":403,"message":"caller does not have permission"}}`, http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"permissions":["compute.disks.create","compute.snapshots.useReadOnly"]}`))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(context.Background(), "disks", option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := client.MissingPermissions(context.Background(), []string{"compute.disks.create", "compute.disks.delete"})
+	if err != nil || !reflect.DeepEqual(missing, []string{"compute.disks.delete"}) {
+		t.Errorf("missing %v (%v), want compute.disks.delete", missing, err)
+	}
+	missing, err = client.MissingSnapshotPermissions(context.Background(), "eth-v1-0000000100", []string{"compute.snapshots.useReadOnly"})
+	if err != nil || len(missing) != 0 {
+		t.Errorf("missing %v (%v), want none", missing, err)
+	}
+
+	fail = true
+	if _, err := client.MissingPermissions(context.Background(), []string{"compute.disks.create"}); err == nil || !strings.Contains(err.Error(), "testing permissions on project disks") {
+		t.Errorf("error %v, want the project test failure", err)
+	}
+	if _, err := client.MissingSnapshotPermissions(context.Background(), "eth-v1-0000000100", []string{"compute.snapshots.useReadOnly"}); err == nil || !strings.Contains(err.Error(), "testing permissions on snapshot eth-v1-0000000100 of project disks") {
+		t.Errorf("error %v, want the snapshot test failure", err)
+	}
+}
+
+func TestIsDiskInUse(t *testing.T) {
+	// Answers the deletion of a disk with the response of its name
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"attached":           {http.StatusBadRequest, `{"error":{"code":400,"message":"The disk resource is already being used","errors":[{"reason":"resourceInUseByAnotherResource","message":"The disk resource is already being used"}]}}`},
+		"invalid":            {http.StatusBadRequest, `{"error":{"code":400,"message":"Invalid value","errors":[{"reason":"invalid","message":"Invalid value"}]}}`},
+		"missing":            {http.StatusNotFound, `{"error":{"code":404,"message":"not found","errors":[{"reason":"notFound","message":"not found"}]}}`},
+		"attached-operation": {http.StatusOK, `{"name":"op-1","status":"DONE","error":{"errors":[{"code":"RESOURCE_IN_USE_BY_ANOTHER_RESOURCE","message":"The disk resource is already being used"}]}}`},
+		"quota-operation":    {http.StatusOK, `{"name":"op-1","status":"DONE","error":{"errors":[{"code":"QUOTA_EXCEEDED","message":"Quota exceeded"}]}}`},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := responses[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(context.Background(), "disks", option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		disk string
+		want bool
+	}{
+		{disk: "attached", want: true},
+		{disk: "invalid", want: false},
+		{disk: "missing", want: false},
+		{disk: "attached-operation", want: true},
+		{disk: "quota-operation", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.disk, func(t *testing.T) {
+			err := client.DeleteDisk(context.Background(), &DiskLocation{Zone: "us-central1-a"}, test.disk)
+			if err == nil {
+				t.Fatal("deleted, want an error")
+			}
+			if got := IsDiskInUse(fmt.Errorf("step 3 delete-disk: %w", err)); got != test.want {
+				t.Errorf("IsDiskInUse(%q) %t, want %t", err, got, test.want)
+			}
+		})
+	}
+
+	if IsDiskInUse(errors.New("resourceInUseByAnotherResource")) {
+		t.Errorf("IsDiskInUse of a plain error, want false")
+	}
+}
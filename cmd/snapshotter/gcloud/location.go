@@ -0,0 +1,49 @@
+package gcloud
+
+import (
+	"strings"
+)
+
+// DiskLocation is where a disk lives: a zone or, for regional disks, a region
+// and the zones the disk is replicated in.
+type DiskLocation struct {
+	Zone         string   `json:"zone,omitempty"`
+	Region       string   `json:"region,omitempty"`
+	ReplicaZones []string `json:"replica_zones,omitempty"`
+}
+
+func (l *DiskLocation) IsRegional() bool {
+	return l.Zone == "" && l.Region != ""
+}
+
+func (l *DiskLocation) String() string {
+	if l.IsRegional() {
+		return l.Region + " (" + strings.Join(l.ReplicaZones, ",") + ")"
+	}
+	return l.Zone
+}
+
+// diskType returns the partial URL of the disk type in the location.
+func (l *DiskLocation) diskType(project, diskType string) string {
+	if l.IsRegional() {
+		return "projects/" + project + "/regions/" + l.Region + "/diskTypes/" + diskType
+	}
+	return "projects/" + project + "/zones/" + l.Zone + "/diskTypes/" + diskType
+}
+
+// disk returns the partial URL of the disk in the location.
+func (l *DiskLocation) disk(project, diskName string) string {
+	if l.IsRegional() {
+		return "projects/" + project + "/regions/" + l.Region + "/disks/" + diskName
+	}
+	return "projects/" + project + "/zones/" + l.Zone + "/disks/" + diskName
+}
+
+// replicaZones returns the partial URLs of the replica zones of a regional
+// disk.
+func (l *DiskLocation) replicaZones(project string) (out []string) {
+	for _, zone := range l.ReplicaZones {
+		out = append(out, "projects/"+project+"/zones/"+zone)
+	}
+	return
+}
@@ -5,38 +5,172 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/streamingfast/snapshotter"
 )
 
+// Snapshot is a Compute Engine snapshot, Size is the size in GB of the disk it
+// was taken of. SelfLink is its fully qualified URL, which identifies it
+// from any project.
 type Snapshot struct {
-	Created time.Time `json:"creationTimestamp"`
-	Name    string    `json:"name"`
-	Size    string    `json:"diskSizeGb"`
+	Created  time.Time
+	Name     string
+	SelfLink string
+	Size     int64
+	Status   string
+	Labels   map[string]string
 }
 
 func (snap *Snapshot) GetSize() string {
-	return fmt.Sprintf("%sG", snap.Size)
+	return fmt.Sprintf("%dG", snap.Size)
 }
 
 func (snap *Snapshot) GetName() string {
 	return snap.Name
 }
 
-func (snap *Snapshot) Matches(namespace string) bool {
-	if !strings.HasPrefix(snap.Name, namespace) {
+// ToSnapshot converts to the library's view of the snapshot, decoding its labels.
+// Unlabeled snapshots are decoded from their name, `namespace` being required
+// to extract the tag.
+func (snap *Snapshot) ToSnapshot(namespace string) (*snapshotter.Snapshot, error) {
+	if snap.IsLabeled() {
+		return snapshotter.NewSnapshotFromLabels(snap.Name, snap.Created, snap.Labels)
+	}
+
+	out := &snapshotter.Snapshot{Name: snap.Name, CreatedAt: snap.Created}
+	if namespace != "" && !snap.Matches(namespace, "") {
+		namespace = ""
+	}
+
+	tag, blockNum, volume, err := snapshotter.ParseName(namespace, snap.Name)
+	if err != nil {
+		// Not generated by GenerateName, only the name is known
+		return out, nil
+	}
+
+	out.Namespace = namespace
+	out.Tag = tag
+	out.BlockNum = blockNum
+	if volume != "" {
+		out.Volumes = []string{volume}
+	}
+	return out, nil
+}
+
+// Group returns the name of the group the snapshot was taken in, which is its
+// own name for snapshots taken before groups existed.
+func (snap *Snapshot) Group() string {
+	if group := snap.Labels[snapshotter.LabelGroup]; group != "" {
+		return group
+	}
+	return snap.Name
+}
+
+// Volume returns the volume claim template name the snapshot was taken of,
+// empty for snapshots taken before groups existed.
+func (snap *Snapshot) Volume() string {
+	return snap.Labels[snapshotter.LabelVolume]
+}
+
+// GroupMembers returns the snapshots of the group `snap` belongs to, `snap`
+// included.
+func GroupMembers(snapshots []Snapshot, snap *Snapshot) (out []Snapshot) {
+	group := snap.Group()
+	for _, candidate := range snapshots {
+		if candidate.Group() == group {
+			out = append(out, candidate)
+		}
+	}
+	return
+}
+
+// IsLabeled returns true if the snapshot carries the labels set by the
+// snapshotter, snapshots taken by older versions only have their name.
+func (snap *Snapshot) IsLabeled() bool {
+	return snap.Labels[snapshotter.LabelNamespace] != ""
+}
+
+// Matches checks the snapshot labels against the namespace and, when non-empty,
+// the tag. Unlabeled snapshots are matched on their name prefix.
+func (snap *Snapshot) Matches(namespace, tag string) bool {
+	if !snap.IsLabeled() {
+		return strings.HasPrefix(snap.Name, namespace+"-") && (tag == "" || strings.HasPrefix(snap.Name, namespace+"-"+tag+"-"))
+	}
+
+	if snap.Labels[snapshotter.LabelNamespace] != namespace {
+		return false
+	}
+
+	if tag != "" && snap.Labels[snapshotter.LabelTag] != tag {
 		return false
 	}
 
 	return true
 }
 
-func FindSnapshot(snapshots []Snapshot, snapshotName, namespace string) (*Snapshot, error) {
+// Strategy picks a snapshot among the candidates matching a namespace and tag.
+type Strategy interface {
+	Select(candidates []Snapshot, namespace string) (*Snapshot, error)
+}
+
+// StrategyFunc adapts a function to the Strategy interface.
+type StrategyFunc func(candidates []Snapshot, namespace string) (*Snapshot, error)
+
+func (f StrategyFunc) Select(candidates []Snapshot, namespace string) (*Snapshot, error) {
+	return f(candidates, namespace)
+}
+
+// SelectMostRecent picks the snapshot with the most recent creation timestamp.
+var SelectMostRecent Strategy = StrategyFunc(func(candidates []Snapshot, _ string) (*Snapshot, error) {
+	// Reverse sort
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Created.After(candidates[j].Created)
+	})
+
+	return &candidates[0], nil
+})
+
+// SelectAtBlock picks the snapshot with the highest block number at or below
+// `blockNum`, the most recent one winning on equal block numbers.
+func SelectAtBlock(blockNum uint32) Strategy {
+	return StrategyFunc(func(candidates []Snapshot, namespace string) (*Snapshot, error) {
+		var selected *Snapshot
+		var selectedBlock uint32
+		for i, snap := range candidates {
+			decoded, err := snap.ToSnapshot(namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			if decoded.BlockNum == 0 || decoded.BlockNum > blockNum {
+				continue
+			}
+
+			if selected == nil || decoded.BlockNum > selectedBlock || (decoded.BlockNum == selectedBlock && snap.Created.After(selected.Created)) {
+				selected = &candidates[i]
+				selectedBlock = decoded.BlockNum
+			}
+		}
+
+		if selected == nil {
+			return nil, fmt.Errorf("no snapshot at or below block %d among %d candidates", blockNum, len(candidates))
+		}
+		return selected, nil
+	})
+}
+
+// FindSnapshot returns the snapshot named `snapshotName` (or a member of the
+// group of that name) or, when it is `latest`,
+// the snapshot picked by the strategy among the ones matching namespace and
+// tag. Unlabeled snapshots are only considered when no labeled snapshot matches.
+func FindSnapshot(snapshots []Snapshot, snapshotName, namespace, tag string, strategy Strategy) (*Snapshot, error) {
 	if len(snapshots) == 0 {
 		return nil, fmt.Errorf("no snapshots received, unable to find anything in this")
 	}
 
 	if snapshotName != "latest" {
 		for _, snap := range snapshots {
-			if snap.Name == snapshotName {
+			if snap.Name == snapshotName || snap.Group() == snapshotName {
 				return &snap, nil
 			}
 		}
@@ -44,21 +178,26 @@ func FindSnapshot(snapshots []Snapshot, snapshotName, namespace string) (*Snapsh
 		return nil, fmt.Errorf("cannot find snapshot named %q among %d snapshots", snapshotName, len(snapshots))
 	}
 
-	found := make([]Snapshot, 0, len(snapshots))
+	var found, legacy []Snapshot
 	for _, snap := range snapshots {
-		if snap.Matches(namespace) {
+		if !snap.Matches(namespace, tag) {
+			continue
+		}
+
+		if snap.IsLabeled() {
 			found = append(found, snap)
+		} else {
+			legacy = append(legacy, snap)
 		}
 	}
 
 	if len(found) == 0 {
-		return nil, fmt.Errorf("cannot find snapshot prefixed with namespace %q among %d snapshots", namespace, len(snapshots))
+		found = legacy
 	}
 
-	// Reverse sort
-	sort.Slice(found, func(i, j int) bool {
-		return found[i].Created.After(found[j].Created)
-	})
+	if len(found) == 0 {
+		return nil, fmt.Errorf("cannot find snapshot for namespace %q and tag %q among %d snapshots", namespace, tag, len(snapshots))
+	}
 
-	return &found[0], nil
+	return strategy.Select(found, namespace)
 }
@@ -0,0 +1,96 @@
+package gcloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streamingfast/snapshotter"
+)
+
+func TestSelectAtBlock(t *testing.T) {
+	created := func(day int) time.Time {
+		return time.Date(2022, 5, day, 12, 0, 0, 0, time.UTC)
+	}
+	labeled := func(name string, blockNum string, day int) Snapshot {
+		return Snapshot{Name: name, Created: created(day), Labels: map[string]string{
+			snapshotter.LabelNamespace: "default",
+			snapshotter.LabelTag:       "v1",
+			snapshotter.LabelBlockNum:  blockNum,
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		candidates []Snapshot
+		blockNum   uint32
+		want       string
+		wantErr    bool
+	}{
+		{
+			name: "highest at or below",
+			candidates: []Snapshot{
+				labeled("a", "100", 1),
+				labeled("b", "300", 3),
+				labeled("c", "200", 2),
+			},
+			blockNum: 250,
+			want:     "c",
+		},
+		{
+			name: "exact block",
+			candidates: []Snapshot{
+				labeled("a", "100", 1),
+				labeled("b", "200", 2),
+			},
+			blockNum: 200,
+			want:     "b",
+		},
+		{
+			name: "most recent on equal blocks",
+			candidates: []Snapshot{
+				labeled("a", "200", 1),
+				labeled("b", "200", 3),
+				labeled("c", "200", 2),
+			},
+			blockNum: 200,
+			want:     "b",
+		},
+		{
+			name: "unlabeled, decoded from the name",
+			candidates: []Snapshot{
+				{Name: "default-v1-0000000100", Created: created(1)},
+				{Name: "default-v1-0000000200-datadir", Created: created(2)},
+				{Name: "manual-backup", Created: created(3)},
+			},
+			blockNum: 250,
+			want:     "default-v1-0000000200-datadir",
+		},
+		{
+			name: "none at or below",
+			candidates: []Snapshot{
+				labeled("a", "300", 1),
+				{Name: "manual-backup", Created: created(2)},
+			},
+			blockNum: 250,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SelectAtBlock(test.blockNum).Select(test.candidates, "default")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("selected %s, want an error", got.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.Name != test.want {
+				t.Errorf("selected %s, want %s", got.Name, test.want)
+			}
+		})
+	}
+}
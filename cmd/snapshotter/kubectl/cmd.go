@@ -1,156 +1,169 @@
 package kubectl
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
-	"strings"
-	"time"
 
+	"github.com/streamingfast/snapshotter"
 	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
-func GetPVs() ([]PersistentVolume, error) {
-	cmd := exec.Command("kubectl", "get", "pv", "-o", "json")
-	zlog.Info("get pv", zap.Stringer("command", cmd))
+// Client runs the Kubernetes calls of the CLI through client-go.
+type Client struct {
+	clientset kubernetes.Interface
+}
 
-	stdout, err := cmd.StdoutPipe()
+// NewClient returns a client for the cluster selected by the options, see
+// snapshotter.KubernetesConfig.
+func NewClient(options snapshotter.KubernetesOptions) (*Client, error) {
+	clientset, err := snapshotter.NewKubernetesClientset(options)
 	if err != nil {
 		return nil, err
 	}
-	defer stdout.Close()
+	return NewClientWithClientset(clientset), nil
+}
 
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
-	}
+// NewClientWithClientset returns a client using `clientset`, like a fake one.
+func NewClientWithClientset(clientset kubernetes.Interface) *Client {
+	return &Client{clientset: clientset}
+}
+
+// GetPVs returns the PVs bound to the PVCs of the namespace, see BoundPVs.
+func (c *Client) GetPVs(ctx context.Context, namespace string) ([]PersistentVolume, error) {
+	zlog.Info("get pv", zap.String("namespace", namespace))
 
-	var output PVOutput
-	if err := json.NewDecoder(stdout).Decode(&output); err != nil {
-		if err != io.EOF {
-			return nil, err
-		}
+	list, err := c.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pvs: %w", err)
 	}
 
-	err = cmd.Wait()
+	claims, err := c.clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("make sure you are logged in: %w", err)
+		return nil, fmt.Errorf("listing pvcs: %w", err)
 	}
 
-	return output.Items, nil
+	return BoundPVs(list.Items, claims.Items), nil
 }
 
-func GetStatefulSetFromPod(podName string) (string, error) {
-	podNameParts := strings.Split(podName, "-")
-	stsName := strings.Join(podNameParts[:len(podNameParts)-1], "-")
-
-	return stsName, nil
+func (c *Client) GetStatefulSetFromPod(ctx context.Context, namespace, podName string) (string, error) {
+	return snapshotter.StatefulSetOfPod(ctx, c.clientset, namespace, podName)
 }
 
-func GetStatefulSetDefinitionFile(stsName string, namespace string) (string, func(), error) {
-	cmd := exec.Command("kubectl", "-n", namespace, "get", "sts", stsName, "-o", "json")
-	zlog.Info("get sts definition", zap.Stringer("command", cmd))
+// GetStatefulSet returns the StatefulSet, to know its replicas.
+func (c *Client) GetStatefulSet(ctx context.Context, namespace, stsName string) (*appsv1.StatefulSet, error) {
+	zlog.Info("get sts", zap.String("statefulset", stsName), zap.String("namespace", namespace))
 
-	stdout, err := cmd.StdoutPipe()
+	sts, err := c.clientset.AppsV1().StatefulSets(namespace).Get(ctx, stsName, metav1.GetOptions{})
 	if err != nil {
-		return "", func() {}, err
+		return nil, fmt.Errorf("getting statefulset %s: %w", stsName, err)
 	}
-	defer stdout.Close()
+	return sts, nil
+}
 
-	err = cmd.Start()
+// DeleteStatefulSet deletes the StatefulSet without deleting its pods and
+// returns its definition, for CreateStatefulSet. The definition is first
+// written to a file, returned too, so the StatefulSet can be recreated with
+// `kubectl create -f` when the restore stops before recreating it.
+func (c *Client) DeleteStatefulSet(ctx context.Context, namespace, stsName string) (*appsv1.StatefulSet, string, error) {
+	sts, err := c.GetStatefulSet(ctx, namespace, stsName)
 	if err != nil {
-		return "", func() {}, err
+		return nil, "", err
 	}
 
-	content, err := ioutil.ReadAll(stdout)
+	definitionFile, err := saveStatefulSet(sts)
 	if err != nil {
-		return "", func() {}, err
+		return nil, "", fmt.Errorf("saving statefulset %s definition: %w", stsName, err)
 	}
+	zlog.Info("saved sts definition", zap.String("statefulset", stsName), zap.String("file", definitionFile))
 
-	err = cmd.Wait()
+	zlog.Info("delete sts", zap.String("statefulset", stsName), zap.String("namespace", namespace))
+	deleted, err := snapshotter.DeleteStatefulSetOrphan(ctx, c.clientset, namespace, stsName)
 	if err != nil {
-		return "", func() {}, fmt.Errorf("make sure you are logged in: %w", err)
+		return nil, "", err
 	}
+	return deleted, definitionFile, nil
+}
 
-	filepath, err := func() (string, error) {
-		f, err := ioutil.TempFile("", stsName)
-		if err != nil {
-			return "", err
-		}
-		defer f.Close()
-		zlog.Debug("created tmp file", zap.String("file", f.Name()))
-
-		_, err = f.Write(content)
-		if err != nil {
-			return "", err
-		}
-		return f.Name(), nil
-	}()
+func saveStatefulSet(sts *appsv1.StatefulSet) (string, error) {
+	content, err := json.MarshalIndent(snapshotter.StatefulSetDefinition(sts), "", "  ")
 	if err != nil {
-		return "", func() {}, err
+		return "", err
 	}
 
-	cleanupFunc := func() {
-		err := os.Remove(filepath)
-		if err != nil {
-			zlog.Error("could not remove file", zap.Error(err))
-		}
+	f, err := os.CreateTemp("", sts.Name+"-*.json")
+	if err != nil {
+		return "", err
 	}
-
-	return filepath, cleanupFunc, nil
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
 }
 
-func DeleteStatefulSet(stsName string, namespace string) error {
-	cmd := exec.Command("kubectl", "-n", namespace, "delete", "sts", stsName, "--cascade=false")
-	zlog.Info("delete sts", zap.Stringer("command", cmd))
+// DeletePod deletes the pod and waits for it to be gone.
+func (c *Client) DeletePod(ctx context.Context, namespace, podName string) error {
+	zlog.Info("delete pod", zap.String("pod", podName), zap.String("namespace", namespace))
+	return snapshotter.DeletePod(ctx, c.clientset, namespace, podName)
+}
 
-	err := cmd.Start()
-	if err != nil {
+// CreateStatefulSet recreates the StatefulSet deleted by DeleteStatefulSet,
+// removing the file its definition was saved to.
+func (c *Client) CreateStatefulSet(ctx context.Context, sts *appsv1.StatefulSet, definitionFile string) error {
+	zlog.Info("create sts", zap.String("statefulset", sts.Name), zap.String("namespace", sts.Namespace))
+	if err := snapshotter.RecreateStatefulSet(ctx, c.clientset, sts); err != nil {
 		return err
 	}
 
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("make sure you are logged in: %w", err)
+	if err := os.Remove(definitionFile); err != nil {
+		zlog.Warn("could not remove sts definition file", zap.String("file", definitionFile), zap.Error(err))
 	}
-
 	return nil
 }
 
-func DeletePod(podName string, namespace string) error {
-	cmd := exec.Command("kubectl", "-n", namespace, "delete", "pod", podName)
-	zlog.Info("delete pod", zap.Stringer("command", cmd))
-
-	err := cmd.Start()
-	if err != nil {
-		return err
+func (c *Client) CreatePV(ctx context.Context, pv *corev1.PersistentVolume) error {
+	zlog.Info("create pv", zap.String("pv", pv.Name))
+	if _, err := c.clientset.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating pv %s: %w", pv.Name, err)
 	}
-
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("make sure you are logged in: %w", err)
-	}
-
-	<-time.After(15 * time.Second)
 	return nil
 }
 
-func CreateStatefulSetFromFile(filename string) error {
-	cmd := exec.Command("kubectl", "apply", "-f", filename)
-	zlog.Info("create sts", zap.Stringer("command", cmd))
+// RetainPV makes sure the PV and its disk are kept when its claim is deleted.
+func (c *Client) RetainPV(ctx context.Context, pvName string) error {
+	zlog.Info("retain pv", zap.String("pv", pvName))
+	return snapshotter.RetainPersistentVolume(ctx, c.clientset, pvName)
+}
 
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
+// DeletePVC deletes the PVC, waits for it to be gone and returns its
+// definition, for CreatePVC.
+func (c *Client) DeletePVC(ctx context.Context, namespace, claimName string) (*corev1.PersistentVolumeClaim, error) {
+	zlog.Info("delete pvc", zap.String("pvc", claimName), zap.String("namespace", namespace))
+	return snapshotter.DeletePersistentVolumeClaim(ctx, c.clientset, namespace, claimName)
+}
 
-	err = cmd.Wait()
-	if err != nil {
-		return fmt.Errorf("make sure you are logged in: %w", err)
-	}
+// CreatePVC recreates the PVC bound to the PV `pvName`.
+func (c *Client) CreatePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim, pvName string) error {
+	zlog.Info("create pvc", zap.String("pvc", pvc.Name), zap.String("namespace", pvc.Namespace), zap.String("pv", pvName))
+	return snapshotter.RecreatePersistentVolumeClaim(ctx, c.clientset, pvc, pvName)
+}
 
-	return nil
+// GetStorageClassDiskType returns the GCE disk type provisioned by the
+// storage class, empty when the class is not known.
+func (c *Client) GetStorageClassDiskType(ctx context.Context, className string) (string, error) {
+	return snapshotter.StorageClassDiskType(ctx, c.clientset, className)
+}
+
+// ExpandPVC grows the PVC to `sizeGB` once it is bound, for the filesystem
+// to be expanded when the pod mounts it.
+func (c *Client) ExpandPVC(ctx context.Context, namespace, claimName string, sizeGB int64) error {
+	zlog.Info("expand pvc", zap.String("pvc", claimName), zap.String("namespace", namespace), zap.Int64("size_gb", sizeGB))
+	return snapshotter.ExpandPersistentVolumeClaim(ctx, c.clientset, namespace, claimName, *resource.NewQuantity(sizeGB<<30, resource.BinarySI))
 }
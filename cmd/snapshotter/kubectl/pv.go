@@ -3,46 +3,26 @@ package kubectl
 import (
 	"fmt"
 	"strings"
-)
 
-type PVOutput struct {
-	Items []PersistentVolume `json:"items"`
-}
+	"github.com/streamingfast/snapshotter"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
 
+// PersistentVolume is a PV as returned by the Kubernetes API.
 type PersistentVolume struct {
-	Metadata Metadata `json:"metadata"`
-	Spec     Spec     `json:"spec"`
-}
-
-type Metadata struct {
-	Name   string                 `json:"name"`
-	Labels map[string]interface{} `json:"labels"`
-}
-
-type Spec struct {
-	ClaimRef ClaimRef          `json:"claimRef,omitempty"`
-	Csi      Csi               `json:"csi"`
-	Disk     GCEPersistentDisk `json:"gcePersistentDisk,omitempty"`
-}
-
-type Csi struct {
-	VolumeHandle string `json:"volumeHandle"`
-}
-type GCEPersistentDisk struct {
-	PDName string `json:"pdName"`
-}
-
-type ClaimRef struct {
-	Name      string `json:"name"`
-	Namespace string `json:"namespace"`
+	corev1.PersistentVolume
 }
 
+// MatchesApp returns true if the PV is claimed by the pod `appName`, through
+// the volume claim template `mountName` when non-nil.
 func (pv *PersistentVolume) MatchesApp(namespace string, appName string, mountName *string) bool {
-	claim := pv.Spec.ClaimRef.Name
-
-	if pv.Spec.ClaimRef.Namespace != namespace {
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
 		return false
 	}
+	claim := pv.Spec.ClaimRef.Name
 
 	if !strings.HasSuffix(claim, "-"+appName) {
 		return false
@@ -52,56 +32,105 @@ func (pv *PersistentVolume) MatchesApp(namespace string, appName string, mountNa
 		return true
 	}
 
-	if !strings.HasPrefix(claim, *mountName) {
+	if claim != *mountName+"-"+appName {
 		return false
 	}
 
 	return true
 }
 
-func (pv *PersistentVolume) GetName() (string, error) {
-	return pv.Metadata.Name, nil
-}
-
-func (pv *PersistentVolume) GetZone() (string, error) {
-	zone, ok := pv.Metadata.Labels["failure-domain.beta.kubernetes.io/zone"]
-	if !ok {
-		zone, ok = pv.Metadata.Labels["topology.kubernetes.io/zone"]
-	}
-	if !ok {
-		if pv.Spec.Csi.VolumeHandle != "" { // PVs that support VolumeSnapshots use new spec model
-			fields := strings.Split(pv.Spec.Csi.VolumeHandle, "/")
-			prevField := ""
-			for _, f := range fields {
-				if prevField == "zones" {
-					return f, nil
-				}
-				prevField = f
-			}
-		}
+// GetDiskLocation returns the zone of the disk or, for regional disks, its
+// region and replica zones, see snapshotter.PersistentDiskOfPV.
+func (pv *PersistentVolume) GetDiskLocation() (*gcloud.DiskLocation, error) {
+	disk, err := snapshotter.PersistentDiskOfPV(&pv.PersistentVolume)
+	if err != nil {
+		return nil, err
+	}
 
-		return "", fmt.Errorf("zone not found")
+	if disk.IsRegional() {
+		return &gcloud.DiskLocation{Region: disk.Region, ReplicaZones: disk.ReplicaZones}, nil
 	}
-	return zone.(string), nil
+	return &gcloud.DiskLocation{Zone: disk.Zone}, nil
 }
 
+// GetGCEDisk returns the name of the disk, see snapshotter.PersistentDiskOfPV.
 func (pv *PersistentVolume) GetGCEDisk() (string, error) {
-	if pv.Spec.Disk.PDName != "" {
-		return pv.Spec.Disk.PDName, nil
-	}
-	if pv.Spec.Csi.VolumeHandle != "" { // PVs that support VolumeSnapshots use new spec model
-		fields := strings.Split(pv.Spec.Csi.VolumeHandle, "/")
-		prevField := ""
-		for _, f := range fields {
-			if prevField == "disks" {
-				return f, nil
-			}
-			prevField = f
+	disk, err := snapshotter.PersistentDiskOfPV(&pv.PersistentVolume)
+	if err != nil {
+		return "", err
+	}
+	return disk.Name, nil
+}
+
+// CapacityGB returns the capacity of the PV in GB, as GCE counts them which
+// are GiB.
+func (pv *PersistentVolume) CapacityGB() int64 {
+	capacity := pv.Spec.Capacity[corev1.ResourceStorage]
+	return capacity.Value() >> 30
+}
+
+// WithDisk returns a copy of the PV named `name`, backed by the GCE disk
+// `diskName` and pre-bound to the same claim. The disk is in the same
+// location or, when `zone` is set, in that zone.
+func (pv *PersistentVolume) WithDisk(name, diskName, zone string) (*corev1.PersistentVolume, error) {
+	if pv.Spec.ClaimRef == nil {
+		return nil, fmt.Errorf("pv %s is not bound to a claim", pv.Name)
+	}
+
+	out := pv.PersistentVolume.DeepCopy()
+	out.ObjectMeta = metav1.ObjectMeta{
+		Name:        name,
+		Labels:      out.Labels,
+		Annotations: out.Annotations,
+	}
+	// Bound by us, not by the controller
+	delete(out.Annotations, "pv.kubernetes.io/bound-by-controller")
+	out.Spec.ClaimRef = &corev1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  pv.Spec.ClaimRef.Namespace,
+		Name:       pv.Spec.ClaimRef.Name,
+	}
+	out.Status = corev1.PersistentVolumeStatus{}
+	// The PV replaced by a later restore must keep its disk, whatever the
+	// policy of the PV it was copied from
+	out.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+
+	switch {
+	case out.Spec.GCEPersistentDisk != nil:
+		out.Spec.GCEPersistentDisk.PDName = diskName
+	case out.Spec.CSI != nil && strings.Contains(out.Spec.CSI.VolumeHandle, "/disks/"):
+		fields := strings.Split(out.Spec.CSI.VolumeHandle, "/")
+		fields[len(fields)-1] = diskName
+		out.Spec.CSI.VolumeHandle = strings.Join(fields, "/")
+	default:
+		return nil, fmt.Errorf("pv %s is not backed by a GCE disk", pv.Name)
+	}
+
+	if zone != "" {
+		if err := moveToZone(out, zone); err != nil {
+			return nil, fmt.Errorf("moving pv %s to zone %s: %w", pv.Name, zone, err)
 		}
 	}
+	return out, nil
+}
 
-	return "", fmt.Errorf("cannot find GCE disk name")
+// BoundPVs returns the PVs bound to one of the claims: in the Bound phase and
+// referencing the UID of the claim. The PVs replaced by a rebind restore are
+// Released but keep a reference to the name of the claim, they are left out.
+func BoundPVs(pvs []corev1.PersistentVolume, claims []corev1.PersistentVolumeClaim) (out []PersistentVolume) {
+	uids := map[types.UID]bool{}
+	for _, claim := range claims {
+		uids[claim.UID] = true
+	}
 
+	for _, pv := range pvs {
+		if pv.Status.Phase != corev1.VolumeBound || pv.Spec.ClaimRef == nil || !uids[pv.Spec.ClaimRef.UID] {
+			continue
+		}
+		out = append(out, PersistentVolume{pv})
+	}
+	return
 }
 
 func Find(pvs []PersistentVolume, namespace string, appName string, mountName *string) (*PersistentVolume, error) {
@@ -113,3 +142,13 @@ func Find(pvs []PersistentVolume, namespace string, appName string, mountName *s
 
 	return nil, fmt.Errorf("not found")
 }
+
+// FindAll returns every PV claimed by the pod `appName`.
+func FindAll(pvs []PersistentVolume, namespace string, appName string) (out []*PersistentVolume) {
+	for i := range pvs {
+		if pvs[i].MatchesApp(namespace, appName, nil) {
+			out = append(out, &pvs[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package kubectl
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPV(name, claimName string, claimUID types.UID, phase corev1.PersistentVolumePhase) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("100Gi")},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{
+				Driver:       "pd.csi.storage.gke.io",
+				VolumeHandle: "projects/chain-data/zones/us-central1-a/disks/" + name,
+			}},
+			ClaimRef: &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: claimName, UID: claimUID},
+		},
+		Status: corev1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func TestClientGetPVs(t *testing.T) {
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "datadir-geth-0", Namespace: "default", UID: "claim-2"}}
+
+	// pvc-1 was replaced by a rebind restore, it is still listed first and
+	// references the claim by name
+	clientset := fake.NewSimpleClientset(
+		claim,
+		newTestPV("pvc-1", "datadir-geth-0", "claim-1", corev1.VolumeReleased),
+		newTestPV("pvc-1-restore-20220518123045", "datadir-geth-0", "claim-2", corev1.VolumeBound),
+		newTestPV("pvc-2", "datadir-geth-1", "claim-3", corev1.VolumeBound),
+		newTestPV("pvc-3", "datadir-geth-0", "claim-1", corev1.VolumeBound),
+	)
+
+	pvs, err := NewClientWithClientset(clientset).GetPVs(context.Background(), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pvs) != 1 || pvs[0].Name != "pvc-1-restore-20220518123045" {
+		t.Fatalf("pvs %v, want only the one bound to the live claim", pvs)
+	}
+
+	mountName := "datadir"
+	pv, err := Find(pvs, "default", "geth-0", &mountName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pv.Name != "pvc-1-restore-20220518123045" {
+		t.Errorf("found pv %s, want the restored one", pv.Name)
+	}
+}
+
+func TestPersistentVolumeWithDisk(t *testing.T) {
+	pv := &PersistentVolume{*newTestPV("pvc-1", "datadir-geth-0", "claim-1", corev1.VolumeBound)}
+	pv.Annotations = map[string]string{"pv.kubernetes.io/bound-by-controller": "yes", "pv.kubernetes.io/provisioned-by": "pd.csi.storage.gke.io"}
+
+	tests := []struct {
+		name       string
+		zone       string
+		wantHandle string
+	}{
+		{name: "same zone", wantHandle: "projects/chain-data/zones/us-central1-a/disks/pvc-1-restore-20220518123045"},
+		{name: "other zone", zone: "us-east1-b", wantHandle: "projects/chain-data/zones/us-east1-b/disks/pvc-1-restore-20220518123045"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := pv.WithDisk("pvc-1-restore-20220518123045", "pvc-1-restore-20220518123045", test.zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if out.Spec.CSI.VolumeHandle != test.wantHandle {
+				t.Errorf("volume handle %q, want %q", out.Spec.CSI.VolumeHandle, test.wantHandle)
+			}
+			if out.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+				t.Errorf("reclaim policy %s, want %s", out.Spec.PersistentVolumeReclaimPolicy, corev1.PersistentVolumeReclaimRetain)
+			}
+			if ref := out.Spec.ClaimRef; ref.Name != "datadir-geth-0" || ref.Namespace != "default" || ref.UID != "" {
+				t.Errorf("claim ref %+v, want pre-bound to default/datadir-geth-0", ref)
+			}
+			if _, found := out.Annotations["pv.kubernetes.io/bound-by-controller"]; found {
+				t.Errorf("annotations %v, want bound-by-controller removed", out.Annotations)
+			}
+			if out.Status.Phase != "" {
+				t.Errorf("status %+v, want empty", out.Status)
+			}
+		})
+	}
+
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimDelete || pv.Annotations["pv.kubernetes.io/bound-by-controller"] != "yes" {
+		t.Errorf("source pv modified: %+v", pv)
+	}
+}
+
+func TestPersistentVolumeGetDiskLocation(t *testing.T) {
+	regional := newTestPV("pvc-2", "datadir-geth-0", "claim-1", corev1.VolumeBound)
+	regional.Spec.CSI.VolumeHandle = "projects/chain-data/regions/us-central1/disks/pvc-2"
+	regional.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{
+		NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: "topology.gke.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"us-central1-a", "us-central1-b"}},
+		}}},
+	}}
+
+	tests := []struct {
+		name         string
+		pv           *corev1.PersistentVolume
+		wantDisk     string
+		wantLocation *gcloud.DiskLocation
+	}{
+		{
+			name:         "zonal",
+			pv:           newTestPV("pvc-1", "datadir-geth-0", "claim-1", corev1.VolumeBound),
+			wantDisk:     "pvc-1",
+			wantLocation: &gcloud.DiskLocation{Zone: "us-central1-a"},
+		},
+		{
+			name:         "regional",
+			pv:           regional,
+			wantDisk:     "pvc-2",
+			wantLocation: &gcloud.DiskLocation{Region: "us-central1", ReplicaZones: []string{"us-central1-a", "us-central1-b"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pv := &PersistentVolume{*test.pv}
+
+			location, err := pv.GetDiskLocation()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(location, test.wantLocation) {
+				t.Errorf("location %+v, want %+v", location, test.wantLocation)
+			}
+
+			disk, err := pv.GetGCEDisk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disk != test.wantDisk {
+				t.Errorf("disk %q, want %q", disk, test.wantDisk)
+			}
+		})
+	}
+}
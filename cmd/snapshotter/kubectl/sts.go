@@ -1,22 +0,0 @@
-package kubectl
-
-//type StatefulSet struct {
-//	Status Status `json:"status"`
-//}
-//
-//type Status struct {
-//	Replicas int `json:"replicas"`
-//}
-//
-//type Pod struct {
-//	Metadata PodMetadata `json:"metadata"`
-//}
-//
-//type PodMetadata struct {
-//	Owners []Owner `json:"ownerReferences"`
-//}
-//
-//type Owner struct {
-//	Kind string `json:"kind"`
-//	Name string `json:"name"`
-//}
@@ -0,0 +1,130 @@
+package kubectl
+
+import (
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	zoneLabels   = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+	regionLabels = []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}
+)
+
+// moveToZone rewrites the topology of a PV copy for its disk to be in
+// `zone`: the zone and region labels, the zone terms of its node affinity
+// and the zone of its CSI volume handle.
+func moveToZone(pv *corev1.PersistentVolume, zone string) error {
+	if pv.Spec.CSI != nil && strings.Contains(pv.Spec.CSI.VolumeHandle, "/regions/") {
+		return fmt.Errorf("regional disks cannot be moved to a zone")
+	}
+	if strings.Contains(zoneLabel(pv.Labels), "__") {
+		return fmt.Errorf("regional disks cannot be moved to a zone")
+	}
+
+	for _, key := range zoneLabels {
+		if _, found := pv.Labels[key]; found {
+			pv.Labels[key] = zone
+		}
+	}
+	for _, key := range regionLabels {
+		if _, found := pv.Labels[key]; found {
+			pv.Labels[key] = zoneRegion(zone)
+		}
+	}
+
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			for i, expr := range term.MatchExpressions {
+				if isZoneKey(expr.Key) && expr.Operator == corev1.NodeSelectorOpIn {
+					term.MatchExpressions[i].Values = []string{zone}
+				}
+			}
+		}
+	}
+
+	if pv.Spec.CSI != nil {
+		fields := strings.Split(pv.Spec.CSI.VolumeHandle, "/")
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] == "zones" {
+				fields[i+1] = zone
+			}
+		}
+		pv.Spec.CSI.VolumeHandle = strings.Join(fields, "/")
+	}
+	return nil
+}
+
+// CheckStatefulSetZone returns an error when the node selector or the
+// required node affinity of the statefulset pods keep them out of `zone`.
+func CheckStatefulSetZone(sts *appsv1.StatefulSet, zone string) error {
+	spec := sts.Spec.Template.Spec
+
+	for key, value := range spec.NodeSelector {
+		if isZoneKey(key) && value != zone {
+			return fmt.Errorf("statefulset %s pods are restricted to zone %s by their node selector %s", sts.Name, value, key)
+		}
+	}
+
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+
+	// The terms are ORed, the expressions of a term ANDed
+	terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for _, term := range terms {
+		if termAllowsZone(term, zone) {
+			return nil
+		}
+	}
+	return fmt.Errorf("statefulset %s pods cannot be scheduled in zone %s, no term of their required node affinity allows it", sts.Name, zone)
+}
+
+func termAllowsZone(term corev1.NodeSelectorTerm, zone string) bool {
+	for _, expr := range term.MatchExpressions {
+		if !isZoneKey(expr.Key) {
+			continue
+		}
+
+		listed := false
+		for _, value := range expr.Values {
+			listed = listed || value == zone
+		}
+
+		switch expr.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !listed {
+				return false
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if listed {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// zoneRegion returns the region of a zone, like us-central1 for
+// us-central1-a.
+func zoneRegion(zone string) string {
+	if idx := strings.LastIndex(zone, "-"); idx > 0 {
+		return zone[:idx]
+	}
+	return ""
+}
+
+func zoneLabel(labels map[string]string) string {
+	for _, key := range zoneLabels {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func isZoneKey(key string) bool {
+	return strings.HasSuffix(key, "/zone")
+}
@@ -0,0 +1,160 @@
+package kubectl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMoveToZone(t *testing.T) {
+	affinity := func(key string, zones ...string) *corev1.VolumeNodeAffinity {
+		return &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: key, Operator: corev1.NodeSelectorOpIn, Values: zones},
+				{Key: "kubernetes.io/os", Operator: corev1.NodeSelectorOpIn, Values: []string{"linux"}},
+			}}},
+		}}
+	}
+	csiSource := func(handle string) corev1.PersistentVolumeSource {
+		return corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: handle}}
+	}
+
+	tests := []struct {
+		name    string
+		pv      *corev1.PersistentVolume
+		want    *corev1.PersistentVolume
+		wantErr bool
+	}{
+		{
+			name: "csi",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "geth"}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: csiSource("projects/chain-data/zones/us-central1-a/disks/disk-0"),
+					NodeAffinity:           affinity("topology.gke.io/zone", "us-central1-a"),
+				},
+			},
+			want: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "geth"}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: csiSource("projects/chain-data/zones/us-east1-b/disks/disk-0"),
+					NodeAffinity:           affinity("topology.gke.io/zone", "us-east1-b"),
+				},
+			},
+		},
+		{
+			name: "in-tree",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+					"failure-domain.beta.kubernetes.io/zone":   "us-central1-a",
+					"failure-domain.beta.kubernetes.io/region": "us-central1",
+				}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-0"}},
+					NodeAffinity:           affinity("failure-domain.beta.kubernetes.io/zone", "us-central1-a"),
+				},
+			},
+			want: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+					"failure-domain.beta.kubernetes.io/zone":   "us-east1-b",
+					"failure-domain.beta.kubernetes.io/region": "us-east1",
+				}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-0"}},
+					NodeAffinity:           affinity("failure-domain.beta.kubernetes.io/zone", "us-east1-b"),
+				},
+			},
+		},
+		{
+			name: "regional csi",
+			pv: &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: csiSource("projects/chain-data/regions/us-central1/disks/disk-0"),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "regional in-tree",
+			pv: &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"topology.kubernetes.io/zone": "us-central1-a__us-central1-b"}},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-0"}},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := moveToZone(test.pv, "us-east1-b")
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "regional disks cannot be moved") {
+					t.Fatalf("error %v, want regional disks rejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(test.pv, test.want) {
+				t.Errorf("pv %+v, want %+v", test.pv, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckStatefulSetZone(t *testing.T) {
+	statefulSet := func(nodeSelector map[string]string, terms ...corev1.NodeSelectorTerm) *appsv1.StatefulSet {
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "geth"}}
+		sts.Spec.Template.Spec.NodeSelector = nodeSelector
+		if len(terms) > 0 {
+			sts.Spec.Template.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+			}}
+		}
+		return sts
+	}
+	term := func(exprs ...corev1.NodeSelectorRequirement) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: exprs}
+	}
+	zoneExpr := func(operator corev1.NodeSelectorOperator, zones ...string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: operator, Values: zones}
+	}
+	poolExpr := corev1.NodeSelectorRequirement{Key: "cloud.google.com/gke-nodepool", Operator: corev1.NodeSelectorOpIn, Values: []string{"ssd"}}
+
+	tests := []struct {
+		name    string
+		sts     *appsv1.StatefulSet
+		wantErr bool
+	}{
+		{name: "unrestricted", sts: statefulSet(nil)},
+		{name: "node selector of other keys", sts: statefulSet(map[string]string{"cloud.google.com/gke-nodepool": "ssd"})},
+		{name: "node selector of the zone", sts: statefulSet(map[string]string{"topology.kubernetes.io/zone": "us-east1-b"})},
+		{name: "node selector of another zone", sts: statefulSet(map[string]string{"topology.kubernetes.io/zone": "us-central1-a"}), wantErr: true},
+		{name: "affinity in the zone", sts: statefulSet(nil, term(zoneExpr(corev1.NodeSelectorOpIn, "us-central1-a", "us-east1-b"), poolExpr))},
+		{name: "affinity in other zones", sts: statefulSet(nil, term(zoneExpr(corev1.NodeSelectorOpIn, "us-central1-a"), poolExpr)), wantErr: true},
+		{name: "affinity not in the zone", sts: statefulSet(nil, term(zoneExpr(corev1.NodeSelectorOpNotIn, "us-east1-b"))), wantErr: true},
+		{name: "affinity not in other zones", sts: statefulSet(nil, term(zoneExpr(corev1.NodeSelectorOpNotIn, "us-central1-a")))},
+		{name: "affinity of other keys", sts: statefulSet(nil, term(poolExpr))},
+		{
+			name: "one of the terms allows the zone",
+			sts:  statefulSet(nil, term(zoneExpr(corev1.NodeSelectorOpIn, "us-central1-a")), term(zoneExpr(corev1.NodeSelectorOpIn, "us-east1-b"))),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckStatefulSetZone(test.sts, "us-east1-b")
+			switch {
+			case test.wantErr && err == nil:
+				t.Errorf("statefulset allowed in zone us-east1-b, want an error")
+			case !test.wantErr && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
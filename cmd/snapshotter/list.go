@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"sigs.k8s.io/yaml"
+)
+
+type listedSnapshot struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	BlockNum  uint32    `json:"block_num,omitempty"`
+	Group     string    `json:"group"`
+	Volume    string    `json:"volume,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	SizeGB    string    `json:"size_gb"`
+	Labeled   bool      `json:"labeled"`
+}
+
+func listE(cmd *cobra.Command, args []string) error {
+	project := viper.GetString("global-project")
+	if project == "" {
+		return fmt.Errorf("--project (-p) flag must be defined")
+	}
+
+	var namespace string
+	if len(args) > 0 {
+		namespace = args[0]
+	}
+
+	tag := viper.GetString("list-tag")
+	status := strings.ToUpper(viper.GetString("list-status"))
+	minBlock := viper.GetUint32("list-min-block")
+	maxBlock := viper.GetUint32("list-max-block")
+	sortBy := viper.GetString("list-sort")
+	output := viper.GetString("list-output")
+	limit := viper.GetInt("list-limit")
+
+	if sortBy != "time" && sortBy != "block" {
+		return fmt.Errorf("invalid --sort %q, valid values are time and block", sortBy)
+	}
+
+	if output != "table" && output != "json" && output != "yaml" {
+		return fmt.Errorf("invalid --output %q, valid values are table, json and yaml", output)
+	}
+
+	createdAfter, err := parseTimeFlag("list-created-after")
+	if err != nil {
+		return err
+	}
+	createdBefore, err := parseTimeFlag("list-created-before")
+	if err != nil {
+		return err
+	}
+
+	client, err := gcloud.NewClient(cmd.Context(), project)
+	if err != nil {
+		return err
+	}
+
+	snaps, err := client.GetSnapshots(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("could not get snapshots list: %w", err)
+	}
+
+	var listed []*listedSnapshot
+	for _, snap := range snaps {
+		if namespace != "" && !snap.Matches(namespace, tag) {
+			continue
+		}
+
+		snapshot, err := snap.ToSnapshot(namespace)
+		if err != nil {
+			return err
+		}
+
+		if tag != "" && snapshot.Tag != tag {
+			continue
+		}
+		if status != "" && snap.Status != status {
+			continue
+		}
+		if snapshot.BlockNum < minBlock || (maxBlock != 0 && snapshot.BlockNum > maxBlock) {
+			continue
+		}
+		if !createdAfter.IsZero() && snapshot.CreatedAt.Before(createdAfter) {
+			continue
+		}
+		if !createdBefore.IsZero() && snapshot.CreatedAt.After(createdBefore) {
+			continue
+		}
+
+		listed = append(listed, &listedSnapshot{
+			Name:      snapshot.Name,
+			Namespace: snapshot.Namespace,
+			Tag:       snapshot.Tag,
+			BlockNum:  snapshot.BlockNum,
+			Group:     snap.Group(),
+			Volume:    strings.Join(snapshot.Volumes, ","),
+			CreatedAt: snapshot.CreatedAt,
+			Status:    snap.Status,
+			SizeGB:    strconv.FormatInt(snap.Size, 10),
+			Labeled:   snap.IsLabeled(),
+		})
+	}
+
+	// Most recent or highest block first
+	sort.SliceStable(listed, func(i, j int) bool {
+		if sortBy == "block" {
+			return listed[i].BlockNum > listed[j].BlockNum
+		}
+		return listed[i].CreatedAt.After(listed[j].CreatedAt)
+	})
+
+	if limit > 0 && len(listed) > limit {
+		listed = listed[:limit]
+	}
+
+	return printListedSnapshots(listed, output)
+}
+
+func printListedSnapshots(listed []*listedSnapshot, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listed)
+
+	case "yaml":
+		out, err := yaml.Marshal(listed)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tNAMESPACE\tTAG\tBLOCK\tVOLUME\tCREATED\tSTATUS\tSIZE")
+	for _, snap := range listed {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%sG\n", snap.Name, snap.Namespace, snap.Tag, snap.BlockNum, snap.Volume, snap.CreatedAt.Format(time.RFC3339), snap.Status, snap.SizeGB)
+	}
+	return w.Flush()
+}
+
+func parseTimeFlag(key string) (time.Time, error) {
+	value := viper.GetString(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expecting RFC3339 format like 2022-05-30T15:04:05Z: %w", value, err)
+	}
+	return t, nil
+}
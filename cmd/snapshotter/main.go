@@ -2,8 +2,11 @@ package main
 
 import (
 	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 	. "github.com/streamingfast/cli"
 	"github.com/streamingfast/logging"
+	"github.com/streamingfast/snapshotter"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
 )
 
 var zlog, _ = logging.RootLogger("snapshotter", "github.com/streamingfast/snapshotter/cmd/snapshotter")
@@ -18,16 +21,27 @@ func main() {
 
 		PersistentFlags(func(flags *pflag.FlagSet) {
 			flags.StringP("project", "p", "", "gcloud project name")
+			flags.String("kubeconfig", "", "Path to the kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config outside of a cluster")
+			flags.String("context", "", "Kubeconfig context to use, defaults to the current context")
 		}),
 
 		Command(restoreSnapshotE,
-			"restore <namespace> <pod> <snapshot>",
+			"restore <namespace> (<pod> | --statefulset <name>) [<snapshot>]",
 			"Restore a disk to specific snapshot, use latest to restore from the latest snapshot",
 			Description(`
 				Find the snapshot from within the GCP project (via flag '--project') passed
 				via the <snapshot> argument. If the received argument is named latest, in this
-				case we find the most recent snapshot for the given <namespace> (the snapshot's
-				name must start with the namespace for this to work properly.).
+				case we find the most recent snapshot labeled with the given <namespace> (and
+				the tag given via '--tag' if set). Snapshots taken before labels were added are
+				matched on their name prefix, only when no labeled snapshot is found.
+
+				When the selected snapshot is part of a multi-volume group, every snapshot of the
+				group is restored over the pod's disk of the same volume. <snapshot> can be the
+				group name or the name of any of its snapshots.
+
+				Instead of <snapshot>, '--at-block' picks the snapshot with the highest block at or
+				below the given block. '--min-block' and '--max-age' refuse the selected snapshot
+				if it is below that block or older than that duration, before anything is deleted.
 
 				It then deletes existing pod and its disk, create a new disk from the snapshot
 				given and then start back the pod with it attaching it the newly created disk.
@@ -35,22 +49,180 @@ func main() {
 				The disk creation happens through GCP APIs and is then attached to the pod via
 				the PVC using Kubernetes APIs.
 
+				Everything is resolved before anything is touched and the ordered plan of the
+				restore is printed, as text or JSON with '--output json', then run step by step.
+				'--dry-run' only prints the plan.
+
+				'--keep-old-disk snapshot' snapshots each disk before deleting it and
+				'--keep-old-disk clone' copies it to a new disk, named after the disk with a
+				'-backup-<time>' suffix, so 'snapshotter rollback' can swap it back in.
+
+				'--strategy rebind' creates a new disk, named after the disk with a
+				'-restore-<time>' suffix, and a PV for it while the pod still runs. Once the
+				statefulset and pod are deleted, the old PV is switched to the Retain reclaim
+				policy and the PVC is recreated bound to the new PV, so the downtime is only
+				the pod restart and the old disk is left untouched with its PV.
+
+				Disks are created with the type the storage class of their PV provisions, from its
+				'type' parameter, and the size of the snapshot. '--disk-type' and '--size' (in GB,
+				at least the snapshot size) override them. When the disk is bigger than its PV,
+				the PVC is grown so its filesystem is expanded when the pod mounts it, which
+				requires a storage class allowing volume expansion.
+
+				'--zone' creates the disks in another zone, when the zone of the disk has a stockout
+				or an outage. It uses the rebind strategy, the new PV gets the zone in its labels,
+				node affinity and CSI volume handle. The node selector and required node affinity
+				of the statefulset pods must allow the zone. Regional disks cannot be moved.
+
+				Snapshots are listed in '--snapshot-project' and disks are created in '--disk-project',
+				both default to '--project'. Disks are created from the self link of the snapshot,
+				so the snapshots can live in a central project. The IAM permissions the restore
+				needs on the disk project and on the snapshots are tested before anything is
+				deleted, missing grants are reported and nothing is changed.
+
+				'--statefulset' restores the pods of the given '--ordinals' of a statefulset, all
+				of them by default, instead of <pod>. Each ordinal is restored from the same
+				snapshot, the statefulset is deleted and recreated once and the ordinals are
+				restored in parallel in between, '--concurrency' at a time. A failing ordinal does
+				not stop the others, the result of each ordinal is printed at the end.
+
 				You can find latest snapshots with
 
-					gcloud compute snapshots list | grep eth-mainnet | tail -n 5
+					snapshotter list eth-mainnet --limit 5
 
-				That will give you the last 5 snapshots that matches 'eth-mainnet'.
+				That will give you the last 5 snapshots of namespace 'eth-mainnet'.
 
-				> Ensure that your 'gcloud' instance is configured with the right GCP project
-				> Don't forget to update 'eth-mainnet' for what you need!
+				> Compute Engine calls use the application default credentials, set
+				> GOOGLE_APPLICATION_CREDENTIALS or run 'gcloud auth application-default login'
 
 				**Note** You can define SNAPSHOTTER_GLOBAL_PROJECT to avoid passing --project each time
 			`),
 			ExamplePrefixed("snapshotter", `
 				restore eth-mainnet mindreader-v3-1 latest
 				restore eth-mainnet mindreader-v3-1 eth-mainnet-v2-0013642743
+				restore eth-mainnet mindreader-v3-1 --tag v2 --at-block 13650000 --max-age 48h
+				restore eth-mainnet mindreader-v3-1 latest --dry-run --output json
+				restore eth-mainnet mindreader-v3-1 latest --keep-old-disk snapshot
+				restore eth-mainnet mindreader-v3-1 latest --strategy rebind
+				restore eth-mainnet --statefulset mindreader-v3 --ordinals 0,2 latest
+				restore eth-mainnet mindreader-v3-1 latest --disk-type pd-balanced --size 4000
+				restore eth-mainnet mindreader-v3-1 latest --zone us-central1-b
+				restore eth-mainnet mindreader-v3-1 latest --snapshot-project chain-data --disk-project team-eth
 			`),
-			ExactArgs(3),
+			RangeArgs(1, 3),
+			Flags(func(flags *pflag.FlagSet) {
+				flags.String("tag", "", "Only consider snapshots with this tag label when looking for the latest snapshot")
+				flags.Uint32("at-block", 0, "Restore the snapshot with the highest block at or below this block, replaces <snapshot>")
+				flags.Uint32("min-block", 0, "Refuse to restore a snapshot below this block")
+				flags.Duration("max-age", 0, "Refuse to restore a snapshot older than this duration, like 48h")
+				flags.Bool("dry-run", false, "Print the restore plan without changing anything")
+				flags.StringP("output", "o", "text", "Plan output format, one of text or json")
+				flags.String("keep-old-disk", "none", "Keep the replaced disk for 'snapshotter rollback', one of none, snapshot or clone")
+				flags.String("strategy", "replace", "Replace the disk once the pod is gone, or rebind the PVC to a new disk created while the pod runs, one of replace or rebind")
+				flags.String("statefulset", "", "Restore the pods of this statefulset instead of <pod>")
+				flags.String("ordinals", "all", "Ordinals of the statefulset to restore with --statefulset, all or a comma separated list like 0,2")
+				flags.Int("concurrency", 4, "Number of ordinals restored at the same time with --statefulset")
+				flags.String("disk-type", "", "Type of the restored disks, like pd-balanced, instead of the one of the storage class of the PV")
+				flags.Int64("size", 0, "Size in GB of the restored disks instead of the snapshot size, growing the PVC when bigger than the PV")
+				flags.String("snapshot-project", "", "Project of the snapshots, defaults to --project")
+				flags.String("disk-project", "", "Project the disks are restored in, defaults to --project")
+				flags.String("zone", "", "Create the restored disks in this zone instead of the zone of the current disks, implies --strategy rebind")
+			}),
+		),
+
+		Command(rollbackE,
+			"rollback <namespace> <pod>",
+			"Swap back the disks a restore replaced, when it kept them with --keep-old-disk",
+			Description(`
+				Find, for each disk of <pod>, the most recent backup kept by 'snapshotter restore
+				--keep-old-disk', a snapshot or a disk clone labeled with the name of the disk.
+				Every disk of the pod must have one.
+
+				Like a restore, the statefulset is deleted leaving its pods running, the pod is
+				deleted, each disk is deleted and recreated from its backup, then the statefulset
+				is recreated. The plan is printed first, '--dry-run' only prints it. Backups are
+				left in place, delete them once they are not needed anymore.
+			`),
+			ExamplePrefixed("snapshotter", `
+				rollback eth-mainnet mindreader-v3-1 --dry-run
+			`),
+			ExactArgs(2),
+			Flags(func(flags *pflag.FlagSet) {
+				flags.Bool("dry-run", false, "Print the rollback plan without changing anything")
+				flags.StringP("output", "o", "text", "Plan output format, one of text or json")
+			}),
+		),
+
+		Command(listE,
+			"list [<namespace>]",
+			"List snapshots, optionally restricted to a namespace",
+			Description(`
+				List the snapshots of the GCP project (via flag '--project'), restricted to
+				<namespace> when given. Namespace, tag and block number are read from the
+				snapshot labels, or decoded from the snapshot name for snapshots taken before
+				labels were added (the tag can only be decoded when <namespace> is given).
+
+				Snapshots are sorted most recent first, or highest block first with '--sort block'.
+			`),
+			ExamplePrefixed("snapshotter", `
+				list eth-mainnet --limit 5
+				list eth-mainnet --tag v2 --min-block 13000000 --sort block
+				list --created-after 2022-05-01T00:00:00Z --status READY --output json
+			`),
+			MaximumNArgs(1),
+			Flags(func(flags *pflag.FlagSet) {
+				flags.String("tag", "", "Only list snapshots with this tag")
+				flags.Uint32("min-block", 0, "Only list snapshots at or above this block")
+				flags.Uint32("max-block", 0, "Only list snapshots at or below this block")
+				flags.String("created-after", "", "Only list snapshots created after this RFC3339 time")
+				flags.String("created-before", "", "Only list snapshots created before this RFC3339 time")
+				flags.String("status", "", "Only list snapshots in this status, like READY or CREATING")
+				flags.String("sort", "time", "Sort by creation time or block number, one of time or block")
+				flags.Int("limit", 0, "Only list the first N snapshots after sorting, 0 means no limit")
+				flags.StringP("output", "o", "table", "Output format, one of table, json or yaml")
+			}),
+		),
+
+		Command(pruneE,
+			"prune <namespace>",
+			"Delete the snapshots of a namespace that are not kept by the retention rules",
+			Description(`
+				List the snapshots labeled with <namespace> (and the tag given via '--tag' if set)
+				and apply the retention rules to each namespace and tag group. A snapshot is kept as
+				soon as one rule keeps it, the most recent snapshot of a group is always kept.
+
+				Daily, weekly and monthly rules keep the most recent snapshot of each of the last N
+				days, ISO weeks and months that have a snapshot.
+
+				The plan is printed before anything is deleted, use '--dry-run' to only print it.
+				Snapshots without the snapshotter labels are never pruned.
+			`),
+			ExamplePrefixed("snapshotter", `
+				prune eth-mainnet --keep-last 3 --keep-daily 7 --keep-weekly 4 --dry-run
+				prune eth-mainnet --tag v2 --keep-within 72h --output json --yes
+			`),
+			ExactArgs(1),
+			Flags(func(flags *pflag.FlagSet) {
+				flags.String("tag", "", "Only prune snapshots with this tag label")
+				flags.Int("keep-last", 0, "Keep the N most recent snapshots")
+				flags.Duration("keep-within", 0, "Keep snapshots created within this duration, like 72h")
+				flags.Int("keep-daily", 0, "Keep the most recent snapshot of each of the last N days")
+				flags.Int("keep-weekly", 0, "Keep the most recent snapshot of each of the last N weeks")
+				flags.Int("keep-monthly", 0, "Keep the most recent snapshot of each of the last N months")
+				flags.Bool("dry-run", false, "Print the plan without deleting anything")
+				flags.StringP("output", "o", "text", "Plan output format, one of text or json")
+				flags.BoolP("yes", "y", false, "Delete without asking for confirmation")
+			}),
 		),
 	)
 }
+
+// newKubeClient returns the Kubernetes client of the cluster selected by the
+// `--kubeconfig` and `--context` flags, the in cluster config is used when
+// running in a pod without them.
+func newKubeClient() (*kubectl.Client, error) {
+	return kubectl.NewClient(snapshotter.KubernetesOptions{
+		Kubeconfig: viper.GetString("global-kubeconfig"),
+		Context:    viper.GetString("global-context"),
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+)
+
+// checkPermissions tests the IAM permissions the Compute Engine steps need,
+// on the disk project and on each snapshot the disks are created from, so
+// missing grants are reported before anything is deleted. Snapshots with a
+// self link are in the project of `snapshotClient`, the others in the disk
+// project.
+func checkPermissions(ctx context.Context, diskClient, snapshotClient *gcloud.Client, steps []*restoreStep) error {
+	projectPermissions := map[string]bool{}
+	need := func(permissions ...string) {
+		for _, permission := range permissions {
+			projectPermissions[permission] = true
+		}
+	}
+
+	type snapshotRef struct {
+		client *gcloud.Client
+		name   string
+	}
+	var snapshots []snapshotRef
+	seenSnapshots := map[snapshotRef]bool{}
+
+	for _, step := range steps {
+		switch step.Action {
+		case stepBackupDisk:
+			if step.Disk.Backup.Method == gcloud.BackupClone {
+				need("compute.disks.create", "compute.disks.useReadOnly")
+			} else {
+				need("compute.disks.createSnapshot", "compute.snapshots.create")
+			}
+		case stepDeleteDisk:
+			need("compute.disks.delete")
+		case stepCreateDisk:
+			need("compute.disks.create")
+			if step.Disk.SourceDisk != "" {
+				need("compute.disks.useReadOnly")
+				break
+			}
+
+			ref := snapshotRef{client: diskClient, name: step.Disk.Snapshot}
+			if step.Disk.SnapshotLink != "" {
+				ref.client = snapshotClient
+			}
+			if !seenSnapshots[ref] {
+				seenSnapshots[ref] = true
+				snapshots = append(snapshots, ref)
+			}
+		}
+	}
+
+	var problems []string
+	if len(projectPermissions) > 0 {
+		permissions := make([]string, 0, len(projectPermissions))
+		for permission := range projectPermissions {
+			permissions = append(permissions, permission)
+		}
+		sort.Strings(permissions)
+
+		missing, err := diskClient.MissingPermissions(ctx, permissions)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("project %s: %s", diskClient.Project(), strings.Join(missing, ", ")))
+		}
+	}
+
+	for _, ref := range snapshots {
+		missing, err := ref.client.MissingSnapshotPermissions(ctx, ref.name, []string{"compute.snapshots.useReadOnly"})
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("snapshot %s of project %s: %s", ref.name, ref.client.Project(), strings.Join(missing, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("missing IAM permissions, nothing was changed:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
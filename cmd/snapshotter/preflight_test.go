@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"google.golang.org/api/option"
+)
+
+// fakeIAM answers the permission tests of the resource manager projects and
+// of the compute snapshots with the permissions granted on the resource,
+// like `projects/disks` or `projects/disks/global/snapshots/eth-v1`.
+type fakeIAM struct {
+	lock    sync.Mutex
+	granted map[string][]string
+	tested  map[string][]string
+}
+
+func (f *fakeIAM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/")
+	var resource string
+	switch {
+	case strings.HasSuffix(path, ":testIamPermissions"):
+		resource = strings.TrimPrefix(strings.TrimSuffix(path, ":testIamPermissions"), "v1/")
+	case strings.HasSuffix(path, "/testIamPermissions"):
+		resource = strings.TrimSuffix(path, "/testIamPermissions")
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+path, http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.tested[resource] = req.Permissions
+
+	granted := map[string]bool{}
+	for _, permission := range f.granted[resource] {
+		granted[permission] = true
+	}
+	resp := struct {
+		Permissions []string `json:"permissions"`
+	}{}
+	for _, permission := range req.Permissions {
+		if granted[permission] {
+			resp.Permissions = append(resp.Permissions, permission)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestCheckPermissions(t *testing.T) {
+	ctx := context.Background()
+	diskPermissions := []string{"compute.disks.create", "compute.disks.createSnapshot", "compute.disks.delete", "compute.snapshots.create"}
+
+	disk := func(snapshotLink string) *diskRestore {
+		return &diskRestore{
+			Snapshot:     "eth-v1-0000000100",
+			SnapshotLink: snapshotLink,
+			Claim:        "datadir-geth-0",
+			PV:           "pvc-1",
+			Disk:         "disk-1",
+			Location:     &gcloud.DiskLocation{Zone: "us-central1-a"},
+			Backup:       &gcloud.DiskBackup{Name: "disk-1-backup", Method: gcloud.BackupSnapshot},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		disk       *diskRestore
+		granted    map[string][]string
+		wantTested map[string][]string
+		wantErr    string
+	}{
+		{
+			name: "granted",
+			disk: disk(""),
+			granted: map[string][]string{
+				"projects/disks": diskPermissions,
+				"projects/disks/global/snapshots/eth-v1-0000000100": {"compute.snapshots.useReadOnly"},
+			},
+			wantTested: map[string][]string{
+				"projects/disks": diskPermissions,
+				"projects/disks/global/snapshots/eth-v1-0000000100": {"compute.snapshots.useReadOnly"},
+			},
+		},
+		{
+			name: "snapshot of another project",
+			disk: disk("https://www.googleapis.com/compute/v1/projects/snaps/global/snapshots/eth-v1-0000000100"),
+			granted: map[string][]string{
+				"projects/disks": diskPermissions,
+				"projects/snaps/global/snapshots/eth-v1-0000000100": {"compute.snapshots.useReadOnly"},
+			},
+			wantTested: map[string][]string{
+				"projects/disks": diskPermissions,
+				"projects/snaps/global/snapshots/eth-v1-0000000100": {"compute.snapshots.useReadOnly"},
+			},
+		},
+		{
+			name: "missing project permission",
+			disk: disk(""),
+			granted: map[string][]string{
+				"projects/disks": {"compute.disks.create", "compute.disks.createSnapshot", "compute.snapshots.create"},
+				"projects/disks/global/snapshots/eth-v1-0000000100": {"compute.snapshots.useReadOnly"},
+			},
+			wantErr: "missing IAM permissions, nothing was changed:\n  project disks: compute.disks.delete",
+		},
+		{
+			name: "missing snapshot permission",
+			disk: disk("https://www.googleapis.com/compute/v1/projects/snaps/global/snapshots/eth-v1-0000000100"),
+			granted: map[string][]string{
+				"projects/disks": diskPermissions,
+			},
+			wantErr: "missing IAM permissions, nothing was changed:\n  snapshot eth-v1-0000000100 of project snaps: compute.snapshots.useReadOnly",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakeIAM{granted: test.granted, tested: map[string][]string{}}
+			srv := httptest.NewServer(api)
+			defer srv.Close()
+
+			newClient := func(project string) *gcloud.Client {
+				client, err := gcloud.NewClient(ctx, project, option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return client
+			}
+
+			plan := &restorePlan{Namespace: "default", Pod: "geth-0", StatefulSet: "geth", Strategy: restoreStrategyReplace, Disks: []*diskRestore{test.disk}}
+			plan.addSteps()
+
+			err := checkPermissions(ctx, newClient("disks"), newClient("snaps"), plan.Steps)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for _, permissions := range api.tested {
+				sort.Strings(permissions)
+			}
+			if !reflect.DeepEqual(api.tested, test.wantTested) {
+				t.Errorf("tested %v, want %v", api.tested, test.wantTested)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/streamingfast/cli"
+	"github.com/streamingfast/snapshotter"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"go.uber.org/zap"
+)
+
+func pruneE(cmd *cobra.Command, args []string) error {
+	project := viper.GetString("global-project")
+	if project == "" {
+		return fmt.Errorf("--project (-p) flag must be defined")
+	}
+
+	namespace := args[0]
+	tag := viper.GetString("prune-tag")
+	dryRun := viper.GetBool("prune-dry-run")
+	output := viper.GetString("prune-output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid --output %q, valid values are text and json", output)
+	}
+
+	policy := &snapshotter.RetentionPolicy{
+		KeepLast:    viper.GetInt("prune-keep-last"),
+		KeepWithin:  viper.GetDuration("prune-keep-within"),
+		KeepDaily:   viper.GetInt("prune-keep-daily"),
+		KeepWeekly:  viper.GetInt("prune-keep-weekly"),
+		KeepMonthly: viper.GetInt("prune-keep-monthly"),
+	}
+	if policy.IsEmpty() {
+		return fmt.Errorf("at least one of --keep-last, --keep-within, --keep-daily, --keep-weekly or --keep-monthly must be set")
+	}
+
+	client, err := gcloud.NewClient(cmd.Context(), project)
+	if err != nil {
+		return err
+	}
+
+	snaps, err := client.GetSnapshots(cmd.Context())
+	if err != nil {
+		return fmt.Errorf("could not get snapshots list: %w", err)
+	}
+
+	// Only labeled snapshots are considered, the namespace and tag of older
+	// snapshots cannot be told apart reliably from their name. The snapshots
+	// of a group are kept or deleted together.
+	var snapshots []*snapshotter.Snapshot
+	groups := map[string][]string{}
+	for _, snap := range snaps {
+		if !snap.IsLabeled() || !snap.Matches(namespace, tag) {
+			continue
+		}
+
+		group := snap.Group()
+		if members, found := groups[group]; found {
+			groups[group] = append(members, snap.Name)
+			continue
+		}
+		groups[group] = []string{snap.Name}
+
+		snapshot, err := snap.ToSnapshot(namespace)
+		if err != nil {
+			return err
+		}
+		snapshot.Name = group
+		snapshots = append(snapshots, snapshot)
+	}
+
+	plan := policy.Plan(snapshots, time.Now())
+	if err := printRetentionPlan(plan, output); err != nil {
+		return err
+	}
+
+	if dryRun || len(plan.Delete) == 0 {
+		return nil
+	}
+
+	if !viper.GetBool("prune-yes") {
+		confirmed, _ := cli.AskConfirmation("Delete %d snapshot(s)", len(plan.Delete))
+		if !confirmed {
+			return fmt.Errorf("aborted, use --yes to delete without confirmation")
+		}
+	}
+
+	for _, decision := range plan.Delete {
+		for _, snapshotName := range groups[decision.Snapshot.Name] {
+			zlog.Info("deleting snapshot", zap.String("snapshot", snapshotName), zap.String("group", decision.Snapshot.Name))
+			if err := client.DeleteSnapshot(cmd.Context(), snapshotName); err != nil {
+				return fmt.Errorf("could not delete snapshot %s: %w", snapshotName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func printRetentionPlan(plan *snapshotter.RetentionPlan, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tSNAPSHOT\tBLOCK\tCREATED\tREASONS")
+	printDecisions := func(action string, decisions []*snapshotter.RetentionDecision) {
+		for _, decision := range decisions {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", action, decision.Snapshot.Name, decision.Snapshot.BlockNum, decision.Snapshot.CreatedAt.Format(time.RFC3339), strings.Join(decision.Reasons, ", "))
+		}
+	}
+	printDecisions("keep", plan.Keep)
+	printDecisions("delete", plan.Delete)
+
+	return w.Flush()
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/streamingfast/snapshotter"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Restore strategies: replace deletes the disk and recreates it under the
+// same name once the pod is gone, rebind creates a new disk and PV while the
+// pod runs and only swaps the PVC once the pod is gone.
+const (
+	restoreStrategyReplace = "replace"
+	restoreStrategyRebind  = "rebind"
+)
+
+// Restore plan step actions.
+const (
+	stepDeleteStatefulSet   = "delete-statefulset"
+	stepDeletePod           = "delete-pod"
+	stepBackupDisk          = "backup-disk"
+	stepDeleteDisk          = "delete-disk"
+	stepCreateDisk          = "create-disk"
+	stepCreatePV            = "create-pv"
+	stepRetainPV            = "retain-pv"
+	stepDeletePVC           = "delete-pvc"
+	stepCreatePVC           = "create-pvc"
+	stepExpandPVC           = "expand-pvc"
+	stepRecreateStatefulSet = "recreate-statefulset"
+)
+
+// restorePlan is everything a restore, or a rollback, resolved before
+// touching anything, the steps are run in order by execute exactly as
+// printed. Ordinal is set for the pods of a statefulset restore, their plan
+// leaves the statefulset to the statefulSetRestorePlan.
+type restorePlan struct {
+	Namespace       string         `json:"namespace"`
+	Pod             string         `json:"pod"`
+	Ordinal         *int           `json:"ordinal,omitempty"`
+	StatefulSet     string         `json:"statefulset"`
+	Strategy        string         `json:"strategy"`
+	Rollback        bool           `json:"rollback,omitempty"`
+	Snapshot        string         `json:"snapshot,omitempty"`
+	SnapshotProject string         `json:"snapshot_project,omitempty"`
+	DiskProject     string         `json:"disk_project,omitempty"`
+	Group           string         `json:"group,omitempty"`
+	BlockNum        uint32         `json:"block_num,omitempty"`
+	CreatedAt       time.Time      `json:"snapshot_created_at,omitempty"`
+	Disks           []*diskRestore `json:"disks"`
+	Steps           []*restoreStep `json:"steps"`
+
+	definition     *appsv1.StatefulSet
+	definitionFile string
+	claims         map[string]*corev1.PersistentVolumeClaim
+}
+
+// diskRestore is the restoration of one snapshot of a group, or of a backup
+// for a rollback, over the disk of the matching volume. The disk is created
+// from Snapshot, through SnapshotLink when set to use a snapshot of another
+// project, or, to roll back to a disk clone, from SourceDisk. Backup is
+// set when the disk is kept before being replaced. NewDisk and NewPV are set
+// by the rebind strategy, which leaves Disk and PV as they are, along with
+// NewLocation when the new disk is created in another zone. Expand is set
+// when the disk is bigger than the PV, for the PVC to be expanded.
+type diskRestore struct {
+	Snapshot     string               `json:"snapshot,omitempty"`
+	SnapshotLink string               `json:"snapshot_link,omitempty"`
+	SourceDisk   string               `json:"source_disk,omitempty"`
+	Volume       string               `json:"volume,omitempty"`
+	Claim        string               `json:"claim"`
+	PV           string               `json:"pv"`
+	Disk         string               `json:"disk"`
+	Location     *gcloud.DiskLocation `json:"location"`
+	SizeGB       int64                `json:"size_gb"`
+	DiskType     string               `json:"disk_type"`
+	Backup       *gcloud.DiskBackup   `json:"backup,omitempty"`
+	NewDisk      string               `json:"new_disk,omitempty"`
+	NewPV        string               `json:"new_pv,omitempty"`
+	NewLocation  *gcloud.DiskLocation `json:"new_location,omitempty"`
+	Expand       bool                 `json:"expand,omitempty"`
+
+	pv *kubectl.PersistentVolume
+}
+
+// createdDisk returns the name of the disk created from the snapshot.
+func (r *diskRestore) createdDisk() string {
+	if r.NewDisk != "" {
+		return r.NewDisk
+	}
+	return r.Disk
+}
+
+// createdLocation returns the location of the disk created from the snapshot.
+func (r *diskRestore) createdLocation() *gcloud.DiskLocation {
+	if r.NewLocation != nil {
+		return r.NewLocation
+	}
+	return r.Location
+}
+
+// restoreStep is one action of the plan, Disk is set for the disk actions.
+type restoreStep struct {
+	Action string       `json:"action"`
+	Target string       `json:"target"`
+	Disk   *diskRestore `json:"disk,omitempty"`
+}
+
+func newRestorePlan(namespace, pod string, ordinal *int, sts, strategy string, snap *gcloud.Snapshot, blockNum uint32, disks []*diskRestore) *restorePlan {
+	plan := &restorePlan{
+		Namespace:   namespace,
+		Pod:         pod,
+		Ordinal:     ordinal,
+		StatefulSet: sts,
+		Strategy:    strategy,
+		Snapshot:    snap.Name,
+		Group:       snap.Group(),
+		BlockNum:    blockNum,
+		CreatedAt:   snap.Created,
+		Disks:       disks,
+	}
+	plan.addSteps()
+	return plan
+}
+
+// newRollbackPlan returns the plan swapping back the disks kept by the last
+// restore, each disk being recreated from its backup.
+func newRollbackPlan(namespace, pod, sts string, disks []*diskRestore) *restorePlan {
+	plan := &restorePlan{
+		Namespace:   namespace,
+		Pod:         pod,
+		StatefulSet: sts,
+		Strategy:    restoreStrategyReplace,
+		Rollback:    true,
+		Disks:       disks,
+	}
+	plan.addSteps()
+	return plan
+}
+
+func (p *restorePlan) addSteps() {
+	namespace, pod, sts, disks := p.Namespace, p.Pod, p.StatefulSet, p.Disks
+	add := func(action, target string, disk *diskRestore) {
+		p.Steps = append(p.Steps, &restoreStep{Action: action, Target: target, Disk: disk})
+	}
+	addStatefulSet := func(action string) {
+		if p.Ordinal == nil {
+			add(action, namespace+"/"+sts, nil)
+		}
+	}
+
+	if p.Strategy == restoreStrategyRebind {
+		// The new disks and PVs are ready before the pod is stopped
+		for _, disk := range disks {
+			add(stepCreateDisk, disk.NewDisk, disk)
+			add(stepCreatePV, disk.NewPV, disk)
+		}
+		addStatefulSet(stepDeleteStatefulSet)
+		add(stepDeletePod, namespace+"/"+pod, nil)
+		for _, disk := range disks {
+			add(stepRetainPV, disk.PV, disk)
+			add(stepDeletePVC, namespace+"/"+disk.Claim, disk)
+			add(stepCreatePVC, namespace+"/"+disk.Claim, disk)
+			if disk.Expand {
+				add(stepExpandPVC, namespace+"/"+disk.Claim, disk)
+			}
+		}
+		addStatefulSet(stepRecreateStatefulSet)
+		return
+	}
+
+	addStatefulSet(stepDeleteStatefulSet)
+	add(stepDeletePod, namespace+"/"+pod, nil)
+	for _, disk := range disks {
+		if disk.Backup != nil {
+			add(stepBackupDisk, disk.Disk, disk)
+		}
+		add(stepDeleteDisk, disk.Disk, disk)
+		add(stepCreateDisk, disk.Disk, disk)
+		if disk.Expand {
+			add(stepExpandPVC, namespace+"/"+disk.Claim, disk)
+		}
+	}
+	addStatefulSet(stepRecreateStatefulSet)
+}
+
+// podSteps splits the steps of an ordinal's plan into the ones run while the
+// pod still runs and the ones run once the statefulset is deleted, starting
+// with the pod deletion.
+func (p *restorePlan) podSteps() (before, after []*restoreStep) {
+	for i, step := range p.Steps {
+		if step.Action == stepDeletePod {
+			return p.Steps[:i], p.Steps[i:]
+		}
+	}
+	return p.Steps, nil
+}
+
+// Description explains what the step does, for the text plan.
+func (s *restoreStep) Description() string {
+	switch s.Action {
+	case stepDeleteStatefulSet:
+		return "delete the statefulset, leaving its pods running"
+	case stepDeletePod:
+		return "delete the pod and wait for it to be gone"
+	case stepBackupDisk:
+		if s.Disk.Backup.Method == gcloud.BackupClone {
+			return fmt.Sprintf("keep disk of pv %s as disk clone %s", s.Disk.PV, s.Disk.Backup.Name)
+		}
+		return fmt.Sprintf("keep disk of pv %s as snapshot %s", s.Disk.PV, s.Disk.Backup.Name)
+	case stepDeleteDisk:
+		return fmt.Sprintf("delete disk of pv %s in %s", s.Disk.PV, s.Disk.Location)
+	case stepCreateDisk:
+		if s.Disk.SourceDisk != "" {
+			return fmt.Sprintf("create %dG %s disk in %s from disk %s", s.Disk.SizeGB, s.Disk.DiskType, s.Disk.createdLocation(), s.Disk.SourceDisk)
+		}
+		return fmt.Sprintf("create %dG %s disk in %s from snapshot %s", s.Disk.SizeGB, s.Disk.DiskType, s.Disk.createdLocation(), s.Disk.Snapshot)
+	case stepCreatePV:
+		if s.Disk.NewLocation != nil {
+			return fmt.Sprintf("create pv for disk %s, pre-bound to pvc %s, with its topology moved to %s", s.Disk.NewDisk, s.Disk.Claim, s.Disk.NewLocation)
+		}
+		return fmt.Sprintf("create pv for disk %s, pre-bound to pvc %s", s.Disk.NewDisk, s.Disk.Claim)
+	case stepRetainPV:
+		return "keep the pv and its disk once its pvc is deleted"
+	case stepDeletePVC:
+		return fmt.Sprintf("delete the pvc bound to pv %s", s.Disk.PV)
+	case stepCreatePVC:
+		return fmt.Sprintf("recreate the pvc bound to pv %s", s.Disk.NewPV)
+	case stepExpandPVC:
+		return fmt.Sprintf("grow the pvc to %dG, its filesystem is expanded when the pod mounts it", s.Disk.SizeGB)
+	case stepRecreateStatefulSet:
+		return "recreate the statefulset from its definition, adopting the pod back"
+	}
+	return ""
+}
+
+func (p *restorePlan) print(w io.Writer, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	}
+
+	if p.Rollback {
+		fmt.Fprintf(w, "Rollback of pod %s/%s (statefulset %s) to the disks kept by the last restore\n\n", p.Namespace, p.Pod, p.StatefulSet)
+	} else {
+		fmt.Fprintf(w, "Restore of pod %s/%s (statefulset %s) from snapshot %s, block %d, created %s, %s strategy\n\n", p.Namespace, p.Pod, p.StatefulSet, p.Group, p.BlockNum, p.CreatedAt.Format(time.RFC3339), p.Strategy)
+	}
+	if p.SnapshotProject != p.DiskProject {
+		fmt.Fprintf(w, "Snapshots of project %s, disks in project %s\n\n", p.SnapshotProject, p.DiskProject)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tACTION\tTARGET\tDESCRIPTION")
+	for i, step := range p.Steps {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i+1, step.Action, step.Target, step.Description())
+	}
+	return tw.Flush()
+}
+
+// execute runs the steps of the plan in order, stopping at the first failure.
+// The statefulset is not recreated when a step fails once it is deleted, the
+// error tells the file its definition was saved to.
+func (p *restorePlan) execute(ctx context.Context, kube *kubectl.Client, client *gcloud.Client) error {
+	for i, step := range p.Steps {
+		zlog.Info("running restore step", zap.Int("step", i+1), zap.String("action", step.Action), zap.String("target", step.Target))
+
+		if err := p.executeStep(ctx, kube, client, step); err != nil {
+			err = fmt.Errorf("step %d %s %s: %w", i+1, step.Action, step.Target, err)
+			if p.definition != nil {
+				err = fmt.Errorf("%w, statefulset %s is deleted, its definition is saved in %s for `kubectl create -f`", err, p.StatefulSet, p.definitionFile)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *restorePlan) executeStep(ctx context.Context, kube *kubectl.Client, client *gcloud.Client, step *restoreStep) (err error) {
+	switch step.Action {
+	case stepDeleteStatefulSet:
+		p.definition, p.definitionFile, err = kube.DeleteStatefulSet(ctx, p.Namespace, p.StatefulSet)
+	case stepDeletePod:
+		err = kube.DeletePod(ctx, p.Namespace, p.Pod)
+	case stepBackupDisk:
+		err = backupDisk(ctx, client, p.Pod, step.Disk)
+	case stepDeleteDisk:
+		err = deleteDisk(ctx, client, step.Disk)
+	case stepCreateDisk:
+		if step.Disk.SourceDisk != "" {
+			return client.CloneDisk(ctx, step.Disk.createdLocation(), step.Disk.createdDisk(), step.Disk.DiskType, step.Disk.SizeGB, step.Disk.SourceDisk, nil)
+		}
+		snapshot := step.Disk.Snapshot
+		if step.Disk.SnapshotLink != "" {
+			snapshot = step.Disk.SnapshotLink
+		}
+		err = client.CreateDiskFromSnapshot(ctx, step.Disk.createdLocation(), step.Disk.createdDisk(), step.Disk.DiskType, step.Disk.SizeGB, snapshot)
+	case stepCreatePV:
+		var zone string
+		if step.Disk.NewLocation != nil {
+			zone = step.Disk.NewLocation.Zone
+		}
+
+		var pv *corev1.PersistentVolume
+		if pv, err = step.Disk.pv.WithDisk(step.Disk.NewPV, step.Disk.NewDisk, zone); err == nil {
+			err = kube.CreatePV(ctx, pv)
+		}
+	case stepRetainPV:
+		err = kube.RetainPV(ctx, step.Disk.PV)
+	case stepDeletePVC:
+		if p.claims == nil {
+			p.claims = map[string]*corev1.PersistentVolumeClaim{}
+		}
+		p.claims[step.Disk.Claim], err = kube.DeletePVC(ctx, p.Namespace, step.Disk.Claim)
+	case stepCreatePVC:
+		if p.claims[step.Disk.Claim] == nil {
+			return fmt.Errorf("no pvc definition, it was not deleted by this plan")
+		}
+		err = kube.CreatePVC(ctx, p.claims[step.Disk.Claim], step.Disk.NewPV)
+	case stepExpandPVC:
+		err = kube.ExpandPVC(ctx, p.Namespace, step.Disk.Claim, step.Disk.SizeGB)
+	case stepRecreateStatefulSet:
+		if p.definition == nil {
+			return fmt.Errorf("no statefulset definition, it was not deleted by this plan")
+		}
+		if err = kube.CreateStatefulSet(ctx, p.definition, p.definitionFile); err == nil {
+			p.definition = nil
+		}
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+	return err
+}
+
+// deleteDisk deletes the disk, retrying while it is still attached to the
+// node of the deleted pod.
+func deleteDisk(ctx context.Context, client *gcloud.Client, restore *diskRestore) error {
+	for i := 0; true; i++ { // retries
+		err := client.DeleteDisk(ctx, restore.Location, restore.Disk)
+		if err == nil {
+			break
+		}
+		if !gcloud.IsDiskInUse(err) || i > 20 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second * 5):
+		}
+		zlog.Info("retrying disk deletion", zap.String("disk", restore.Disk), zap.Error(err))
+	}
+	return nil
+}
+
+// backupDisk keeps the disk as a snapshot or a clone before it is deleted,
+// labeled so rollback finds it.
+func backupDisk(ctx context.Context, client *gcloud.Client, pod string, restore *diskRestore) error {
+	labels := snapshotter.BackupLabels(restore.Disk, pod)
+	if restore.Backup.Method == gcloud.BackupClone {
+		// restore.DiskType is the type of the restored disk, which can be
+		// overridden, the clone keeps the type of the disk it backs up
+		diskType, err := client.GetDiskType(ctx, restore.Location, restore.Disk)
+		if err != nil {
+			return err
+		}
+		return client.CloneDisk(ctx, restore.Location, restore.Backup.Name, diskType, 0, restore.Disk, labels)
+	}
+	return client.SnapshotDisk(ctx, restore.Location, restore.Disk, restore.Backup.Name, labels)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRestorePlanSteps(t *testing.T) {
+	ordinal := 1
+	disk := func(name string, backup, expand bool) *diskRestore {
+		d := &diskRestore{Claim: "datadir-" + name, PV: "pvc-" + name, Disk: "disk-" + name, NewDisk: "disk-" + name + "-new", NewPV: "pvc-" + name + "-new", Expand: expand}
+		if backup {
+			d.Backup = &gcloud.DiskBackup{Name: d.Disk + "-backup", Method: gcloud.BackupSnapshot}
+		}
+		return d
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		ordinal  *int
+		disks    []*diskRestore
+		want     []string
+	}{
+		{
+			name:     "replace",
+			strategy: restoreStrategyReplace,
+			disks:    []*diskRestore{disk("a", false, false)},
+			want: []string{
+				"delete-statefulset default/geth",
+				"delete-pod default/geth-0",
+				"delete-disk disk-a",
+				"create-disk disk-a",
+				"recreate-statefulset default/geth",
+			},
+		},
+		{
+			name:     "replace with backup and expand",
+			strategy: restoreStrategyReplace,
+			disks:    []*diskRestore{disk("a", true, true), disk("b", false, false)},
+			want: []string{
+				"delete-statefulset default/geth",
+				"delete-pod default/geth-0",
+				"backup-disk disk-a",
+				"delete-disk disk-a",
+				"create-disk disk-a",
+				"expand-pvc default/datadir-a",
+				"delete-disk disk-b",
+				"create-disk disk-b",
+				"recreate-statefulset default/geth",
+			},
+		},
+		{
+			name:     "replace of an ordinal",
+			strategy: restoreStrategyReplace,
+			ordinal:  &ordinal,
+			disks:    []*diskRestore{disk("a", false, false)},
+			want: []string{
+				"delete-pod default/geth-0",
+				"delete-disk disk-a",
+				"create-disk disk-a",
+			},
+		},
+		{
+			name:     "rebind",
+			strategy: restoreStrategyRebind,
+			disks:    []*diskRestore{disk("a", false, true), disk("b", false, false)},
+			want: []string{
+				"create-disk disk-a-new",
+				"create-pv pvc-a-new",
+				"create-disk disk-b-new",
+				"create-pv pvc-b-new",
+				"delete-statefulset default/geth",
+				"delete-pod default/geth-0",
+				"retain-pv pvc-a",
+				"delete-pvc default/datadir-a",
+				"create-pvc default/datadir-a",
+				"expand-pvc default/datadir-a",
+				"retain-pv pvc-b",
+				"delete-pvc default/datadir-b",
+				"create-pvc default/datadir-b",
+				"recreate-statefulset default/geth",
+			},
+		},
+		{
+			name:     "rebind of an ordinal",
+			strategy: restoreStrategyRebind,
+			ordinal:  &ordinal,
+			disks:    []*diskRestore{disk("a", false, false)},
+			want: []string{
+				"create-disk disk-a-new",
+				"create-pv pvc-a-new",
+				"delete-pod default/geth-0",
+				"retain-pv pvc-a",
+				"delete-pvc default/datadir-a",
+				"create-pvc default/datadir-a",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := &restorePlan{Namespace: "default", Pod: "geth-0", Ordinal: test.ordinal, StatefulSet: "geth", Strategy: test.strategy, Disks: test.disks}
+			plan.addSteps()
+
+			var got []string
+			for _, step := range plan.Steps {
+				got = append(got, step.Action+" "+step.Target)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("steps\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+// fakeDisksAPI deletes disks right away and fails every disk insertion.
+type fakeDisksAPI struct {
+	lock     sync.Mutex
+	requests []string
+}
+
+func (f *fakeDisksAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/")
+	f.requests = append(f.requests, r.Method+" "+path)
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodDelete:
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "op-1", Status: "DONE"})
+	case http.MethodPost:
+		http.Error(w, `{"error":{"code":403,"message":"quota exceeded"}}`, http.StatusForbidden)
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+path, http.StatusNotFound)
+	}
+}
+
+func TestRestorePlanExecuteAbort(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("TMPDIR", t.TempDir())
+
+	api := &fakeDisksAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	client, err := gcloud.NewClient(ctx, "disks", option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "geth", Namespace: "default", UID: "sts-1"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "geth-0", Namespace: "default"}},
+	)
+
+	plan := &restorePlan{
+		Namespace:   "default",
+		Pod:         "geth-0",
+		StatefulSet: "geth",
+		Strategy:    restoreStrategyReplace,
+		Disks: []*diskRestore{{
+			Snapshot: "eth-v1-0000000100-datadir",
+			Claim:    "datadir-geth-0",
+			PV:       "pvc-1",
+			Disk:     "disk-1",
+			Location: &gcloud.DiskLocation{Zone: "us-central1-a"},
+			SizeGB:   500,
+			DiskType: "pd-ssd",
+		}},
+	}
+	plan.addSteps()
+
+	err = plan.execute(ctx, kubectl.NewClientWithClientset(clientset), client)
+	if err == nil || !strings.HasPrefix(err.Error(), "step 4 create-disk disk-1:") {
+		t.Fatalf("error %v, want step 4 create-disk to fail", err)
+	}
+
+	wantRequests := []string{
+		"DELETE projects/disks/zones/us-central1-a/disks/disk-1",
+		"POST projects/disks/zones/us-central1-a/disks",
+	}
+	if !reflect.DeepEqual(api.requests, wantRequests) {
+		t.Errorf("requests %v, want %v", api.requests, wantRequests)
+	}
+
+	// The plan stops there, the statefulset is left deleted and its definition
+	// is kept in the file named by the error
+	if _, err := clientset.AppsV1().StatefulSets("default").Get(ctx, "geth", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("statefulset get error %v, want it left deleted", err)
+	}
+	if plan.definitionFile == "" || !strings.Contains(err.Error(), plan.definitionFile) {
+		t.Fatalf("error %q, want it to name the definition file %q", err, plan.definitionFile)
+	}
+
+	content, err := os.ReadFile(plan.definitionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &appsv1.StatefulSet{}
+	if err := json.Unmarshal(content, saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Kind != "StatefulSet" || saved.Name != "geth" || saved.Namespace != "default" || saved.UID != "" {
+		t.Errorf("saved definition %+v, want statefulset default/geth without its uid", saved)
+	}
+}
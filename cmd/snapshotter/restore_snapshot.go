@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/streamingfast/snapshotter"
 	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
 	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
 
@@ -13,109 +16,365 @@ import (
 )
 
 func restoreSnapshotE(cmd *cobra.Command, args []string) error {
-	project := viper.GetString("global-project")
-	if project == "" {
-		return fmt.Errorf("--project (-p) flag must be defined")
+	snapshotProject := viper.GetString("restore-snapshot-project")
+	diskProject := viper.GetString("restore-disk-project")
+	if project := viper.GetString("global-project"); project != "" {
+		if snapshotProject == "" {
+			snapshotProject = project
+		}
+		if diskProject == "" {
+			diskProject = project
+		}
+	}
+	if snapshotProject == "" || diskProject == "" {
+		return fmt.Errorf("--project (-p) flag must be defined, or both --snapshot-project and --disk-project")
 	}
 
 	namespace := args[0]
-	podName := args[1]
-	snapshotName := args[2]
+	stsName := viper.GetString("restore-statefulset")
+
+	var podName string
+	snapshotArgs := args[1:]
+	if stsName == "" {
+		if len(args) < 2 {
+			return fmt.Errorf("<pod> argument is required unless --statefulset flag is set")
+		}
+		podName = args[1]
+		snapshotArgs = args[2:]
+	}
+	if len(snapshotArgs) > 1 {
+		return fmt.Errorf("too many arguments, <pod> argument and --statefulset flag are mutually exclusive")
+	}
+
+	output := viper.GetString("restore-output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid --output %q, valid values are text and json", output)
+	}
+
+	keepOldDisk := viper.GetString("restore-keep-old-disk")
+	if keepOldDisk != gcloud.BackupNone && keepOldDisk != gcloud.BackupSnapshot && keepOldDisk != gcloud.BackupClone {
+		return fmt.Errorf("invalid --keep-old-disk %q, valid values are none, snapshot and clone", keepOldDisk)
+	}
+
+	restoreStrategy := viper.GetString("restore-strategy")
+	if restoreStrategy != restoreStrategyReplace && restoreStrategy != restoreStrategyRebind {
+		return fmt.Errorf("invalid --strategy %q, valid values are replace and rebind", restoreStrategy)
+	}
+
+	// A disk in another zone needs a new PV, which only the rebind strategy creates
+	zone := viper.GetString("restore-zone")
+	if zone != "" {
+		if cmd.Flags().Changed("strategy") && restoreStrategy != restoreStrategyRebind {
+			return fmt.Errorf("--zone requires --strategy rebind, the disk of another zone needs a new pv")
+		}
+		restoreStrategy = restoreStrategyRebind
+	}
+	if restoreStrategy == restoreStrategyRebind && keepOldDisk != gcloud.BackupNone {
+		return fmt.Errorf("--keep-old-disk cannot be used with --strategy rebind, the old disk is kept with its pv")
+	}
+
+	diskTypeOverride := viper.GetString("restore-disk-type")
+	sizeGB := viper.GetInt64("restore-size")
+	if sizeGB < 0 {
+		return fmt.Errorf("invalid --size %d, it must be a number of GB", sizeGB)
+	}
 
-	sts, err := kubectl.GetStatefulSetFromPod(podName)
+	concurrency := viper.GetInt("restore-concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("invalid --concurrency %d, it must be at least 1", concurrency)
+	}
+
+	snapshotName := "latest"
+	strategy := gcloud.SelectMostRecent
+	if atBlock := viper.GetUint32("restore-at-block"); atBlock != 0 {
+		if len(snapshotArgs) > 0 {
+			return fmt.Errorf("<snapshot> argument and --at-block flag are mutually exclusive")
+		}
+		strategy = gcloud.SelectAtBlock(atBlock)
+	} else if len(snapshotArgs) > 0 {
+		snapshotName = snapshotArgs[0]
+	} else {
+		return fmt.Errorf("<snapshot> argument is required unless --at-block flag is set")
+	}
+
+	kube, err := newKubeClient()
 	if err != nil {
-		return fmt.Errorf("could not get stateful set from pod: %w", err)
+		return err
 	}
 
-	stsDefinitionFile, cleanupFunc, err := kubectl.GetStatefulSetDefinitionFile(sts, namespace)
+	restoreStatefulSet := stsName != ""
+	if !restoreStatefulSet {
+		if stsName, err = kube.GetStatefulSetFromPod(cmd.Context(), namespace, podName); err != nil {
+			return fmt.Errorf("could not get stateful set from pod: %w", err)
+		}
+	}
+
+	sts, err := kube.GetStatefulSet(cmd.Context(), namespace, stsName)
 	if err != nil {
-		return fmt.Errorf("could not get statefulset definition: %w", err)
+		return err
 	}
-	zlog.Info("statefulset definition file created", zap.String("file", stsDefinitionFile))
 
-	snaps, err := gcloud.GetSnapshots(project)
+	if zone != "" {
+		if err := kubectl.CheckStatefulSetZone(sts, zone); err != nil {
+			return err
+		}
+	}
+
+	var ordinals []int
+	if restoreStatefulSet {
+		replicas := 1
+		if sts.Spec.Replicas != nil {
+			replicas = int(*sts.Spec.Replicas)
+		}
+		if ordinals, err = parseOrdinals(viper.GetString("restore-ordinals"), replicas); err != nil {
+			return err
+		}
+	}
+
+	client, err := gcloud.NewClient(cmd.Context(), diskProject)
+	if err != nil {
+		return err
+	}
+
+	snapshotClient := client
+	if snapshotProject != diskProject {
+		if snapshotClient, err = gcloud.NewClient(cmd.Context(), snapshotProject); err != nil {
+			return err
+		}
+	}
+
+	snaps, err := snapshotClient.GetSnapshots(cmd.Context())
 	if err != nil {
 		return fmt.Errorf("could not get snapshots list: %w", err)
 	}
 
-	snap, err := gcloud.FindSnapshot(snaps, snapshotName, namespace)
+	snap, err := gcloud.FindSnapshot(snaps, snapshotName, namespace, viper.GetString("restore-tag"), strategy)
 	if err != nil {
 		return fmt.Errorf("could not get latest snapshot for namespace: %w", err)
 	}
 	zlog.Info("selected a snapshot that will be restored", zap.String("snapshot", snap.Name))
 
-	pvs, err := kubectl.GetPVs()
+	if err := checkSnapshotFreshness(snap, namespace, viper.GetUint32("restore-min-block"), viper.GetDuration("restore-max-age")); err != nil {
+		return err
+	}
+
+	pvs, err := kube.GetPVs(cmd.Context(), namespace)
 	if err != nil {
 		return fmt.Errorf("could not list pvs: %w", err)
 	}
 
-	pv, err := kubectl.Find(pvs, namespace, podName, nil)
+	decoded, err := snap.ToSnapshot(namespace)
 	if err != nil {
-		return fmt.Errorf("could not find pv for pod: %w", err)
+		return err
 	}
 
-	zone, err := pv.GetZone()
-	if err != nil {
+	members := gcloud.GroupMembers(snaps, snap)
+	diskTypes := newDiskTypes(kube)
+	now := time.Now()
+	resolve := func(podName string) ([]*diskRestore, error) {
+		restores, err := resolveDiskRestores(pvs, members, namespace, podName)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, restore := range restores {
+			restore.DiskType = diskTypeOverride
+			if restore.DiskType == "" {
+				if restore.DiskType, err = diskTypes.of(cmd.Context(), restore.pv); err != nil {
+					return nil, err
+				}
+			}
+			if err := restore.resize(sizeGB); err != nil {
+				return nil, err
+			}
+
+			if keepOldDisk != gcloud.BackupNone {
+				restore.Backup = &gcloud.DiskBackup{Name: gcloud.BackupName(restore.Disk, now), Method: keepOldDisk, Of: restore.Disk}
+			}
+			if restoreStrategy == restoreStrategyRebind {
+				// The new PV takes the name of its disk so the pair is easy to find
+				restore.NewDisk = gcloud.RestoredDiskName(restore.Disk, now)
+				restore.NewPV = restore.NewDisk
+			}
+			if zone != "" && zone != restore.Location.Zone {
+				if restore.Location.IsRegional() {
+					return nil, fmt.Errorf("--zone cannot be used with regional disk %s of pv %s", restore.Disk, restore.PV)
+				}
+				restore.NewLocation = &gcloud.DiskLocation{Zone: zone}
+			}
+		}
+		return restores, nil
+	}
+
+	if !restoreStatefulSet {
+		restores, err := resolve(podName)
+		if err != nil {
+			return err
+		}
+
+		plan := newRestorePlan(namespace, podName, nil, stsName, restoreStrategy, snap, decoded.BlockNum, restores)
+		plan.SnapshotProject, plan.DiskProject = snapshotProject, diskProject
+		if err := plan.print(os.Stdout, output); err != nil {
+			return err
+		}
+
+		if err := checkPermissions(cmd.Context(), client, snapshotClient, plan.Steps); err != nil {
+			return err
+		}
+
+		if viper.GetBool("restore-dry-run") {
+			return nil
+		}
+
+		return plan.execute(cmd.Context(), kube, client)
+	}
+
+	var pods []*restorePlan
+	for _, ordinal := range ordinals {
+		ordinal := ordinal
+		podName := fmt.Sprintf("%s-%d", stsName, ordinal)
+
+		restores, err := resolve(podName)
+		if err != nil {
+			return err
+		}
+		pods = append(pods, newRestorePlan(namespace, podName, &ordinal, stsName, restoreStrategy, snap, decoded.BlockNum, restores))
+	}
+
+	plan := newStatefulSetRestorePlan(namespace, stsName, restoreStrategy, snap, decoded.BlockNum, concurrency, pods)
+	plan.SnapshotProject, plan.DiskProject = snapshotProject, diskProject
+	if err := plan.print(os.Stdout, output); err != nil {
 		return err
 	}
-	disk, err := pv.GetGCEDisk()
-	if err != nil {
+
+	var steps []*restoreStep
+	for _, pod := range pods {
+		steps = append(steps, pod.Steps...)
+	}
+	if err := checkPermissions(cmd.Context(), client, snapshotClient, steps); err != nil {
 		return err
 	}
 
-	zlog.Info("deleting statefulset definition", zap.String("statefulset", sts), zap.String("namespace", namespace))
-	err = kubectl.DeleteStatefulSet(sts, namespace)
-	if err != nil {
-		return fmt.Errorf("could not delete statefulset: %w", err)
+	if viper.GetBool("restore-dry-run") {
+		return nil
 	}
 
-	zlog.Info("deleting pod", zap.String("pod", podName), zap.String("namespace", namespace))
-	err = kubectl.DeletePod(podName, namespace)
-	if err != nil {
-		return fmt.Errorf("could not delete pod: %w", err)
+	results, err := plan.execute(cmd.Context(), kube, client)
+	if printErr := printOrdinalResults(os.Stdout, output, results); printErr != nil {
+		zlog.Warn("could not print the restore results", zap.Error(printErr))
 	}
+	return err
+}
+
+// resolveDiskRestores maps each snapshot of the group to the pod's PV of the
+// same volume, snapshots without a volume label map to the pod's first PV.
+func resolveDiskRestores(pvs []kubectl.PersistentVolume, members []gcloud.Snapshot, namespace, podName string) ([]*diskRestore, error) {
+	seenDisks := map[string]bool{}
+
+	var out []*diskRestore
+	for _, member := range members {
+		var mountName *string
+		if volume := member.Volume(); volume != "" {
+			mountName = &volume
+		}
 
-	for i := 0; true; i++ { // retries
-		zlog.Info(
-			"deleting old disk",
-			zap.String("disk", disk),
-			zap.String("zone", zone),
-			zap.String("project", project),
-		)
-		err = gcloud.DeleteDisk(project, zone, disk)
+		pv, err := kubectl.Find(pvs, namespace, podName, mountName)
 		if err != nil {
-			if i > 20 {
-				return fmt.Errorf("could not delete disk %s in zone %s: %w", disk, zone, err)
-			}
+			return nil, fmt.Errorf("could not find pv for pod %s and snapshot %s: %w", podName, member.Name, err)
+		}
+
+		location, err := pv.GetDiskLocation()
+		if err != nil {
+			return nil, err
+		}
+		disk, err := pv.GetGCEDisk()
+		if err != nil {
+			return nil, err
+		}
 
-			time.Sleep(time.Second * 5)
-			zlog.Info("retrying disk deletion", zap.Error(err))
-			continue
+		if seenDisks[disk] {
+			return nil, fmt.Errorf("more than one snapshot of group %s maps to disk %s", member.Group(), disk)
 		}
-		break
+		seenDisks[disk] = true
+
+		out = append(out, &diskRestore{
+			Snapshot:     member.Name,
+			SnapshotLink: member.SelfLink,
+			Volume:       member.Volume(),
+			Claim:        pv.Spec.ClaimRef.Name,
+			PV:           pv.Name,
+			Disk:         disk,
+			Location:     location,
+			SizeGB:       member.Size,
+			pv:           pv,
+		})
 	}
 
-	zlog.Info(
-		"creating new disk from snapshot",
-		zap.String("disk", disk),
-		zap.String("size", snap.GetSize()),
-		zap.String("snapshot", snap.GetName()),
-	)
-	err = gcloud.CreateDiskFromSnapshot(project, zone, disk, snap.GetSize(), snap.GetName())
-	if err != nil {
-		return fmt.Errorf("could not create disk %s in zone %s from snapshot %s: %w", disk, zone, snap.GetName(), err)
+	return out, nil
+}
+
+// resize sets the size of the disk to `sizeGB`, the --size flag, which must
+// not be smaller than the snapshot, zero keeping the size of the snapshot.
+// The PVC is expanded when the disk is bigger than the PV.
+func (r *diskRestore) resize(sizeGB int64) error {
+	if sizeGB != 0 {
+		if sizeGB < r.SizeGB {
+			return fmt.Errorf("--size %d is smaller than the %dG of snapshot %s", sizeGB, r.SizeGB, r.Snapshot)
+		}
+		r.SizeGB = sizeGB
 	}
+	r.Expand = r.SizeGB > r.pv.CapacityGB()
+	return nil
+}
+
+// diskTypes resolves the type of the disks created for PVs, the type the
+// storage class of the PV provisions, looking up each class once.
+type diskTypes struct {
+	kube    *kubectl.Client
+	classes map[string]string
+}
+
+func newDiskTypes(kube *kubectl.Client) *diskTypes {
+	return &diskTypes{kube: kube, classes: map[string]string{}}
+}
 
-	zlog.Info(
-		"recreating statefulset from definition",
-		zap.String("statefulset", sts),
-		zap.String("namespace", namespace),
-	)
-	err = kubectl.CreateStatefulSetFromFile(stsDefinitionFile)
+func (t *diskTypes) of(ctx context.Context, pv *kubectl.PersistentVolume) (string, error) {
+	className := pv.Spec.StorageClassName
+	if diskType, found := t.classes[className]; found {
+		return diskType, nil
+	}
+
+	diskType, err := t.kube.GetStorageClassDiskType(ctx, className)
 	if err != nil {
-		return fmt.Errorf("could not create statefulset: %w", err)
+		return "", err
+	}
+	if diskType == "" {
+		diskType = snapshotter.DefaultDiskType
+	}
+
+	t.classes[className] = diskType
+	return diskType, nil
+}
+
+// checkSnapshotFreshness refuses snapshots below `minBlock` or older than
+// `maxAge`, zero values disable the corresponding check.
+func checkSnapshotFreshness(snap *gcloud.Snapshot, namespace string, minBlock uint32, maxAge time.Duration) error {
+	if minBlock != 0 {
+		decoded, err := snap.ToSnapshot(namespace)
+		if err != nil {
+			return err
+		}
+
+		if decoded.BlockNum < minBlock {
+			return fmt.Errorf("refusing snapshot %s, its block %d is below --min-block %d", snap.Name, decoded.BlockNum, minBlock)
+		}
+	}
+
+	if maxAge != 0 {
+		if age := time.Since(snap.Created); age > maxAge {
+			return fmt.Errorf("refusing snapshot %s, it was created %s ago which is more than --max-age %s", snap.Name, age.Truncate(time.Second), maxAge)
+		}
 	}
 
-	cleanupFunc()
 	return nil
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestPV(className, capacity string) *kubectl.PersistentVolume {
+	return &kubectl.PersistentVolume{PersistentVolume: corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: className,
+			Capacity:         corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)},
+		},
+	}}
+}
+
+func TestDiskTypesOf(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "premium-rwo"}, Provisioner: "pd.csi.storage.gke.io", Parameters: map[string]string{"type": "pd-balanced"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "standard"}, Provisioner: "kubernetes.io/gce-pd"},
+	)
+	diskTypes := newDiskTypes(kubectl.NewClientWithClientset(clientset))
+
+	tests := []struct {
+		className string
+		want      string
+	}{
+		{className: "premium-rwo", want: "pd-balanced"},
+		{className: "standard", want: "pd-standard"},
+		{className: "deleted", want: "pd-ssd"},
+		{className: "", want: "pd-ssd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.className, func(t *testing.T) {
+			got, err := diskTypes.of(context.Background(), newTestPV(test.className, "100Gi"))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("disk type %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// Each class is looked up once
+	if err := clientset.StorageV1().StorageClasses().Delete(context.Background(), "premium-rwo", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := diskTypes.of(context.Background(), newTestPV("premium-rwo", "100Gi")); err != nil || got != "pd-balanced" {
+		t.Errorf("disk type %q (%v), want the cached pd-balanced", got, err)
+	}
+}
+
+func TestDiskRestoreResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		sizeGB     int64
+		capacity   string
+		wantSizeGB int64
+		wantExpand bool
+		wantErr    string
+	}{
+		{name: "size of the snapshot", capacity: "500Gi", wantSizeGB: 500},
+		{name: "snapshot bigger than the pv", capacity: "400Gi", wantSizeGB: 500, wantExpand: true},
+		{name: "size of the pv", sizeGB: 500, capacity: "500Gi", wantSizeGB: 500},
+		{name: "bigger than the pv", sizeGB: 800, capacity: "500Gi", wantSizeGB: 800, wantExpand: true},
+		{name: "smaller than the snapshot", sizeGB: 300, capacity: "500Gi", wantErr: "--size 300 is smaller than the 500G of snapshot eth-v1-0000000100"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restore := &diskRestore{Snapshot: "eth-v1-0000000100", SizeGB: 500, pv: newTestPV("", test.capacity)}
+
+			err := restore.resize(test.sizeGB)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if restore.SizeGB != test.wantSizeGB || restore.Expand != test.wantExpand {
+				t.Errorf("size %dG expand %t, want %dG expand %t", restore.SizeGB, restore.Expand, test.wantSizeGB, test.wantExpand)
+			}
+		})
+	}
+}
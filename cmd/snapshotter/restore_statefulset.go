@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
+	"go.uber.org/zap"
+)
+
+// Results of the restore of an ordinal.
+const (
+	ordinalRestored = "restored"
+	ordinalFailed   = "failed"
+	ordinalSkipped  = "skipped"
+)
+
+// statefulSetRestorePlan restores several ordinals of a statefulset from the
+// same snapshot. The statefulset is deleted and recreated once, the plans of
+// the ordinals run in parallel in between, up to Concurrency at a time.
+type statefulSetRestorePlan struct {
+	Namespace       string         `json:"namespace"`
+	StatefulSet     string         `json:"statefulset"`
+	Strategy        string         `json:"strategy"`
+	Snapshot        string         `json:"snapshot"`
+	SnapshotProject string         `json:"snapshot_project,omitempty"`
+	DiskProject     string         `json:"disk_project,omitempty"`
+	Group           string         `json:"group"`
+	BlockNum        uint32         `json:"block_num"`
+	CreatedAt       time.Time      `json:"snapshot_created_at"`
+	Concurrency     int            `json:"concurrency"`
+	Pods            []*restorePlan `json:"pods"`
+}
+
+// ordinalResult is the outcome of the restore of an ordinal, Error is set
+// when it failed.
+type ordinalResult struct {
+	Ordinal int    `json:"ordinal"`
+	Pod     string `json:"pod"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newStatefulSetRestorePlan(namespace, sts, strategy string, snap *gcloud.Snapshot, blockNum uint32, concurrency int, pods []*restorePlan) *statefulSetRestorePlan {
+	return &statefulSetRestorePlan{
+		Namespace:   namespace,
+		StatefulSet: sts,
+		Strategy:    strategy,
+		Snapshot:    snap.Name,
+		Group:       snap.Group(),
+		BlockNum:    blockNum,
+		CreatedAt:   snap.Created,
+		Concurrency: concurrency,
+		Pods:        pods,
+	}
+}
+
+// parseOrdinals returns the sorted ordinals of `value`, either all or a comma
+// separated list like 0,2, checked against the replicas of the statefulset.
+func parseOrdinals(value string, replicas int) ([]int, error) {
+	if replicas == 0 {
+		return nil, fmt.Errorf("statefulset has no replicas, no ordinals to restore")
+	}
+
+	var out []int
+	if value == "all" {
+		for i := 0; i < replicas; i++ {
+			out = append(out, i)
+		}
+		return out, nil
+	}
+
+	seen := map[int]bool{}
+	for _, field := range strings.Split(value, ",") {
+		ordinal, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ordinal %q, --ordinals is all or a comma separated list like 0,2", field)
+		}
+		if ordinal < 0 || ordinal >= replicas {
+			return nil, fmt.Errorf("ordinal %d is out of the %d replicas of the statefulset", ordinal, replicas)
+		}
+		if !seen[ordinal] {
+			seen[ordinal] = true
+			out = append(out, ordinal)
+		}
+	}
+
+	sort.Ints(out)
+	return out, nil
+}
+
+func (p *statefulSetRestorePlan) print(w io.Writer, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	}
+
+	ordinals := make([]string, len(p.Pods))
+	for i, pod := range p.Pods {
+		ordinals[i] = strconv.Itoa(*pod.Ordinal)
+	}
+	fmt.Fprintf(w, "Restore of ordinals %s of statefulset %s/%s from snapshot %s, block %d, created %s, %s strategy, %d ordinals at a time\n\n",
+		strings.Join(ordinals, ","), p.Namespace, p.StatefulSet, p.Group, p.BlockNum, p.CreatedAt.Format(time.RFC3339), p.Strategy, p.Concurrency)
+	if p.SnapshotProject != p.DiskProject {
+		fmt.Fprintf(w, "Snapshots of project %s, disks in project %s\n\n", p.SnapshotProject, p.DiskProject)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDINAL\tACTION\tTARGET\tDESCRIPTION")
+	printSteps := func(split func(*restorePlan) []*restoreStep) {
+		for _, pod := range p.Pods {
+			for _, step := range split(pod) {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", *pod.Ordinal, step.Action, step.Target, step.Description())
+			}
+		}
+	}
+
+	printSteps(stepsBeforePodDeletion)
+	fmt.Fprintf(tw, "-\t%s\t%s/%s\t%s\n", stepDeleteStatefulSet, p.Namespace, p.StatefulSet, "delete the statefulset, leaving its pods running")
+	printSteps(stepsFromPodDeletion)
+	fmt.Fprintf(tw, "-\t%s\t%s/%s\t%s\n", stepRecreateStatefulSet, p.Namespace, p.StatefulSet, "recreate the statefulset from its definition, adopting the pods back")
+	return tw.Flush()
+}
+
+// execute runs the plans of the ordinals around a single deletion and
+// recreation of the statefulset. A failing ordinal does not stop the others,
+// the ones failing before the statefulset is deleted are left untouched. The
+// statefulset is recreated even when ordinals failed, so the others start.
+func (p *statefulSetRestorePlan) execute(ctx context.Context, kube *kubectl.Client, client *gcloud.Client) ([]*ordinalResult, error) {
+	results := make([]*ordinalResult, len(p.Pods))
+	for i, pod := range p.Pods {
+		results[i] = &ordinalResult{Ordinal: *pod.Ordinal, Pod: pod.Pod, Result: ordinalSkipped}
+	}
+
+	p.executePods(ctx, kube, client, results, stepsBeforePodDeletion)
+
+	definition, definitionFile, err := kube.DeleteStatefulSet(ctx, p.Namespace, p.StatefulSet)
+	if err != nil {
+		return results, fmt.Errorf("%s %s/%s: %w", stepDeleteStatefulSet, p.Namespace, p.StatefulSet, err)
+	}
+
+	p.executePods(ctx, kube, client, results, stepsFromPodDeletion)
+	for _, result := range results {
+		if result.Result == ordinalSkipped {
+			result.Result = ordinalRestored
+		}
+	}
+
+	if err := kube.CreateStatefulSet(ctx, definition, definitionFile); err != nil {
+		return results, fmt.Errorf("%s %s/%s: %w, its definition is saved in %s for `kubectl create -f`", stepRecreateStatefulSet, p.Namespace, p.StatefulSet, err, definitionFile)
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Result == ordinalFailed {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d ordinals failed", failed, len(results))
+	}
+	return results, nil
+}
+
+// executePods runs the steps selected by `split` of the ordinals that did
+// not fail yet, up to Concurrency ordinals at a time.
+func (p *statefulSetRestorePlan) executePods(ctx context.Context, kube *kubectl.Client, client *gcloud.Client, results []*ordinalResult, split func(*restorePlan) []*restoreStep) {
+	slots := make(chan struct{}, p.Concurrency)
+	wg := sync.WaitGroup{}
+
+	for i, pod := range p.Pods {
+		if results[i].Result == ordinalFailed {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(pod *restorePlan, result *ordinalResult) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			for _, step := range split(pod) {
+				zlog.Info("running restore step", zap.Int("ordinal", result.Ordinal), zap.String("action", step.Action), zap.String("target", step.Target))
+
+				if err := pod.executeStep(ctx, kube, client, step); err != nil {
+					zlog.Warn("ordinal restore failed", zap.Int("ordinal", result.Ordinal), zap.Error(err))
+					result.Result = ordinalFailed
+					result.Error = fmt.Sprintf("%s %s: %s", step.Action, step.Target, err)
+					return
+				}
+			}
+		}(pod, results[i])
+	}
+
+	wg.Wait()
+}
+
+func stepsBeforePodDeletion(p *restorePlan) []*restoreStep {
+	before, _ := p.podSteps()
+	return before
+}
+
+func stepsFromPodDeletion(p *restorePlan) []*restoreStep {
+	_, after := p.podSteps()
+	return after
+}
+
+func printOrdinalResults(w io.Writer, output string, results []*ordinalResult) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ORDINAL\tPOD\tRESULT\tERROR")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", result.Ordinal, result.Pod, result.Result, result.Error)
+	}
+	return tw.Flush()
+}
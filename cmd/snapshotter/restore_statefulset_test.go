@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOrdinals(t *testing.T) {
+	tests := []struct {
+		value    string
+		replicas int
+		want     []int
+		wantErr  string
+	}{
+		{value: "all", replicas: 3, want: []int{0, 1, 2}},
+		{value: "all", replicas: 0, wantErr: "statefulset has no replicas"},
+		{value: "0", replicas: 0, wantErr: "statefulset has no replicas"},
+		{value: "1", replicas: 3, want: []int{1}},
+		{value: "2,0", replicas: 3, want: []int{0, 2}},
+		{value: " 0, 2 ", replicas: 3, want: []int{0, 2}},
+		{value: "1,1,0", replicas: 3, want: []int{0, 1}},
+		{value: "3", replicas: 3, wantErr: "ordinal 3 is out of the 3 replicas"},
+		{value: "-1", replicas: 3, wantErr: "ordinal -1 is out of the 3 replicas"},
+		{value: "0,", replicas: 3, wantErr: `invalid ordinal ""`},
+		{value: "first", replicas: 3, wantErr: `invalid ordinal "first"`},
+		{value: "0-2", replicas: 3, wantErr: `invalid ordinal "0-2"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseOrdinals(test.value, test.replicas)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ordinals %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/gcloud"
+	"github.com/streamingfast/snapshotter/cmd/snapshotter/kubectl"
+)
+
+func rollbackE(cmd *cobra.Command, args []string) error {
+	project := viper.GetString("global-project")
+	if project == "" {
+		return fmt.Errorf("--project (-p) flag must be defined")
+	}
+
+	namespace := args[0]
+	podName := args[1]
+
+	output := viper.GetString("rollback-output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid --output %q, valid values are text and json", output)
+	}
+
+	kube, err := newKubeClient()
+	if err != nil {
+		return err
+	}
+
+	sts, err := kube.GetStatefulSetFromPod(cmd.Context(), namespace, podName)
+	if err != nil {
+		return fmt.Errorf("could not get stateful set from pod: %w", err)
+	}
+
+	client, err := gcloud.NewClient(cmd.Context(), project)
+	if err != nil {
+		return err
+	}
+
+	pvs, err := kube.GetPVs(cmd.Context(), namespace)
+	if err != nil {
+		return fmt.Errorf("could not list pvs: %w", err)
+	}
+
+	podPVs := kubectl.FindAll(pvs, namespace, podName)
+	if len(podPVs) == 0 {
+		return fmt.Errorf("could not find any pv for pod %s", podName)
+	}
+
+	diskTypes := newDiskTypes(kube)
+
+	// Every disk of the pod is rolled back, so the volumes of a group stay
+	// consistent with each other
+	var rollbacks []*diskRestore
+	for _, pv := range podPVs {
+		location, err := pv.GetDiskLocation()
+		if err != nil {
+			return err
+		}
+		disk, err := pv.GetGCEDisk()
+		if err != nil {
+			return err
+		}
+
+		backups, err := client.GetDiskBackups(cmd.Context(), location, disk)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backup of disk %s of pv %s, only restores with --keep-old-disk keep one", disk, pv.Name)
+		}
+		backup := backups[0]
+
+		diskType, err := diskTypes.of(cmd.Context(), pv)
+		if err != nil {
+			return err
+		}
+
+		rollback := &diskRestore{
+			Claim:    pv.Spec.ClaimRef.Name,
+			PV:       pv.Name,
+			Disk:     disk,
+			Location: location,
+			SizeGB:   backup.SizeGB,
+			DiskType: diskType,
+		}
+		if backup.Method == gcloud.BackupClone {
+			rollback.SourceDisk = backup.Name
+		} else {
+			rollback.Snapshot = backup.Name
+		}
+		rollbacks = append(rollbacks, rollback)
+	}
+
+	plan := newRollbackPlan(namespace, podName, sts, rollbacks)
+	if err := plan.print(os.Stdout, output); err != nil {
+		return err
+	}
+
+	if err := checkPermissions(cmd.Context(), client, client, plan.Steps); err != nil {
+		return err
+	}
+
+	if viper.GetBool("rollback-dry-run") {
+		return nil
+	}
+
+	return plan.execute(cmd.Context(), kube, client)
+}
@@ -0,0 +1,424 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("csi-volume-snapshot", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewCSIVolumeSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// VolumeSnapshotGVR is the resource of the `snapshot.storage.k8s.io/v1`
+// VolumeSnapshots created by the csi-volume-snapshot backend.
+var VolumeSnapshotGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// CSIVolumeSnapshotter snapshots the pod's PVCs with Kubernetes
+// VolumeSnapshots, it works with any CSI driver supporting snapshots.
+type CSIVolumeSnapshotter struct {
+	tag           string
+	namespace     string
+	pod           string
+	volumes       volumeSelector
+	snapshotClass string
+	mounts        []string
+	freeze        string
+	timeout       time.Duration
+
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+}
+
+// csiExampleConfigString lists the required keys, `pvcs` can replace `prefix`
+// like for gke-pvc-snapshot and `mounts`, `freeze` and `timeout=5m` are
+// accepted too. `volume-snapshot-class` sets the VolumeSnapshotClass, the
+// cluster default is used otherwise.
+var csiExampleConfigString = "type=csi-volume-snapshot tag=v1 namespace=default prefix=datadir"
+
+// NewCSIVolumeSnapshotter creates the backend with clients built from the in
+// cluster config, or the default kubeconfig outside of a cluster.
+func NewCSIVolumeSnapshotter(conf map[string]string) (*CSIVolumeSnapshotter, error) {
+	config, err := KubernetesConfig(KubernetesOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("new for config: %s", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("new dynamic for config: %s", err)
+	}
+
+	return NewCSIVolumeSnapshotterWithClients(conf, clientset, dynamicClient)
+}
+
+// NewCSIVolumeSnapshotterWithClients creates the backend with the given
+// clients, the fake clientsets of client-go can be used in tests.
+func NewCSIVolumeSnapshotterWithClients(conf map[string]string, clientset kubernetes.Interface, dynamicClient dynamic.Interface) (*CSIVolumeSnapshotter, error) {
+	required := []string{"tag", "namespace", "prefix"}
+	if conf["pvcs"] != "" {
+		required = []string{"tag", "namespace"}
+	}
+
+	for _, label := range required {
+		if conf[label] == "" {
+			return nil, fmt.Errorf("backup module csi-volume-snapshot missing value for %s. Example: %s", label, csiExampleConfigString)
+		}
+	}
+
+	timeout := 5 * time.Minute
+	if conf["timeout"] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module csi-volume-snapshot invalid value for timeout: %w", err)
+		}
+	}
+
+	mounts, freeze, err := parseFreezeConfig("csi-volume-snapshot", conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CSIVolumeSnapshotter{
+		tag:           conf["tag"],
+		namespace:     conf["namespace"],
+		pod:           os.Getenv("HOSTNAME"),
+		volumes:       parseVolumeSelector(conf),
+		snapshotClass: conf["volume-snapshot-class"],
+		mounts:        mounts,
+		freeze:        freeze,
+		timeout:       timeout,
+		clientset:     clientset,
+		dynamic:       dynamicClient,
+	}, nil
+}
+
+func (s *CSIVolumeSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// Backup creates one VolumeSnapshot per selected PVC of the pod and waits
+// until they are all `readyToUse`. The mounts are thawed as soon as every
+// snapshot has a creation time, the point in time it captured. The group
+// succeeds or fails as a whole, on failure the VolumeSnapshots already
+// created are deleted.
+func (s *CSIVolumeSnapshotter) Backup(lastSeenBlockNum uint32) (snapshotName string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	claims, err := getPodClaims(ctx, s.clientset, s.pod, s.namespace, s.volumes)
+	if err != nil {
+		return "", fmt.Errorf("error getting pod claims: %w", err)
+	}
+
+	req := &snapshotRequest{
+		name:      GenerateName(s.namespace, s.tag, lastSeenBlockNum),
+		namespace: s.namespace,
+		pod:       s.pod,
+		tag:       s.tag,
+		blockNum:  lastSeenBlockNum,
+	}
+
+	thaw, err := quiesce(ctx, s.mounts, s.freeze)
+	if err != nil {
+		return "", fmt.Errorf("quiescing filesystems: %w", err)
+	}
+	defer thaw()
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		thaw()
+		for _, name := range created {
+			zlog.Info("deleting volume snapshot of failed group", zap.String("volume_snapshot", name), zap.String("group", req.name))
+			if deleteErr := s.snapshots().Delete(context.Background(), name, metav1.DeleteOptions{}); deleteErr != nil && !errors.IsNotFound(deleteErr) {
+				zlog.Error("unable to delete volume snapshot of failed group", zap.String("volume_snapshot", name), zap.Error(deleteErr))
+			}
+		}
+	}()
+
+	for _, claimName := range claims {
+		pd := &pdDef{claimName: claimName, volume: volumeName(claimName, s.pod)}
+		name := GroupMemberName(req.name, pd.volume, len(claims))
+
+		zlog.Info("creating volume snapshot", zap.String("volume_snapshot", name), zap.String("pvc", claimName))
+		if _, err = s.snapshots().Create(ctx, s.newVolumeSnapshot(name, claimName, snapshotLabels(req, pd)), metav1.CreateOptions{}); err != nil {
+			return "", fmt.Errorf("creating volume snapshot %s: %w", name, err)
+		}
+		created = append(created, name)
+	}
+
+	if err = s.waitFor(ctx, created, csiSnapshotTaken); err != nil {
+		return "", err
+	}
+	thaw()
+
+	if err = s.waitFor(ctx, created, csiSnapshotReady); err != nil {
+		return "", err
+	}
+
+	return req.name, nil
+}
+
+// Restore creates, from each VolumeSnapshot of the group, a PVC named
+// `restore-<volume snapshot>` with the snapshot as `dataSource`. The storage
+// class and access modes are copied from the PVC the snapshot was taken of.
+// Like for gke-pvc-snapshot, binding the new PVCs to the pod is the job of
+// the `snapshotter restore` command.
+func (s *CSIVolumeSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	apiGroup := VolumeSnapshotGVR.Group
+	for _, member := range members {
+		if ready, _, _ := unstructured.NestedBool(member.Object, "status", "readyToUse"); !ready {
+			return fmt.Errorf("volume snapshot %s is not ready to use", member.GetName())
+		}
+
+		claimName, _, _ := unstructured.NestedString(member.Object, "spec", "source", "persistentVolumeClaimName")
+		source, err := s.clientset.CoreV1().PersistentVolumeClaims(s.namespace).Get(ctx, claimName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting pvc %s snapshot %s was taken of: %w", claimName, member.GetName(), err)
+		}
+
+		size := source.Spec.Resources.Requests[corev1.ResourceStorage]
+		if restoreSize, _, _ := unstructured.NestedString(member.Object, "status", "restoreSize"); restoreSize != "" {
+			if size, err = resource.ParseQuantity(restoreSize); err != nil {
+				return fmt.Errorf("invalid restore size %q of volume snapshot %s: %w", restoreSize, member.GetName(), err)
+			}
+		}
+
+		if size.IsZero() {
+			return fmt.Errorf("unknown size to restore volume snapshot %s to, neither its restore size nor pvc %s request is set", member.GetName(), claimName)
+		}
+
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      RestoreName(member.GetName()),
+				Namespace: s.namespace,
+				Labels:    member.GetLabels(),
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      source.Spec.AccessModes,
+				StorageClassName: source.Spec.StorageClassName,
+				VolumeMode:       source.Spec.VolumeMode,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+				},
+				DataSource: &corev1.TypedLocalObjectReference{
+					APIGroup: &apiGroup,
+					Kind:     "VolumeSnapshot",
+					Name:     member.GetName(),
+				},
+			},
+		}
+
+		zlog.Info("creating pvc from volume snapshot", zap.String("pvc", pvc.Name), zap.String("volume_snapshot", member.GetName()))
+		if _, err := s.clientset.CoreV1().PersistentVolumeClaims(s.namespace).Create(ctx, pvc, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("creating pvc %s: %w", pvc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// List returns one Snapshot per group, listing the volumes it captured.
+func (s *CSIVolumeSnapshotter) List() ([]*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	snapshots, err := s.listVolumeSnapshots(ctx, map[string]string{
+		LabelNamespace: s.namespace,
+		LabelTag:       s.tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups snapshotGroups
+	for _, snapshot := range snapshots {
+		createdAt := snapshot.GetCreationTimestamp().Time
+		if creationTime, _, _ := unstructured.NestedString(snapshot.Object, "status", "creationTime"); creationTime != "" {
+			if createdAt, err = time.Parse(time.RFC3339, creationTime); err != nil {
+				return nil, fmt.Errorf("invalid creation time %q for volume snapshot %q: %w", creationTime, snapshot.GetName(), err)
+			}
+		}
+
+		snap, err := NewSnapshotFromLabels(snapshot.GetName(), createdAt, snapshot.GetLabels())
+		if err != nil {
+			return nil, err
+		}
+		groups.add(snapshot.GetLabels()[LabelGroup], snap)
+	}
+
+	sortSnapshotsByMostRecent(groups.list)
+	return groups.list, nil
+}
+
+// Delete deletes every VolumeSnapshot of the group.
+func (s *CSIVolumeSnapshotter) Delete(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if err := s.snapshots().Delete(ctx, member.GetName(), metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("deleting volume snapshot %s: %w", member.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func (s *CSIVolumeSnapshotter) snapshots() dynamic.ResourceInterface {
+	return s.dynamic.Resource(VolumeSnapshotGVR).Namespace(s.namespace)
+}
+
+func (s *CSIVolumeSnapshotter) newVolumeSnapshot(name, claimName string, labels map[string]string) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": claimName,
+		},
+	}
+	if s.snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = s.snapshotClass
+	}
+
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VolumeSnapshotGVR.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"spec":       spec,
+	}}
+	snapshot.SetName(name)
+	snapshot.SetNamespace(s.namespace)
+	snapshot.SetLabels(labels)
+	return snapshot
+}
+
+func (s *CSIVolumeSnapshotter) listVolumeSnapshots(ctx context.Context, selector map[string]string) ([]unstructured.Unstructured, error) {
+	set := labels.Set{}
+	for key, value := range selector {
+		set[key] = sanitizeLabelValue(value)
+	}
+
+	list, err := s.snapshots().List(ctx, metav1.ListOptions{LabelSelector: set.String()})
+	if err != nil {
+		return nil, fmt.Errorf("listing volume snapshots: %w", err)
+	}
+	return list.Items, nil
+}
+
+// groupMembers returns the VolumeSnapshots of the group, or the
+// VolumeSnapshot of that name.
+func (s *CSIVolumeSnapshotter) groupMembers(ctx context.Context, groupName string) ([]unstructured.Unstructured, error) {
+	members, err := s.listVolumeSnapshots(ctx, map[string]string{LabelGroup: groupName})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) > 0 {
+		return members, nil
+	}
+
+	snapshot, err := s.snapshots().Get(ctx, groupName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting volume snapshot %q: %w", groupName, err)
+	}
+	return []unstructured.Unstructured{*snapshot}, nil
+}
+
+// csiSnapshotCondition reports whether the VolumeSnapshot reached the awaited
+// state, an error stops the wait.
+type csiSnapshotCondition func(snapshot *unstructured.Unstructured) (bool, error)
+
+// csiSnapshotTaken is true once the point in time of the snapshot is known,
+// the volume can then be written to again.
+func csiSnapshotTaken(snapshot *unstructured.Unstructured) (bool, error) {
+	if err := csiSnapshotError(snapshot); err != nil {
+		return false, err
+	}
+
+	creationTime, _, _ := unstructured.NestedString(snapshot.Object, "status", "creationTime")
+	return creationTime != "", nil
+}
+
+func csiSnapshotReady(snapshot *unstructured.Unstructured) (bool, error) {
+	if err := csiSnapshotError(snapshot); err != nil {
+		return false, err
+	}
+
+	ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+	return ready, nil
+}
+
+func csiSnapshotError(snapshot *unstructured.Unstructured) error {
+	if message, found, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message"); found {
+		return &SnapshotFailedError{Snapshot: snapshot.GetName(), Reason: message}
+	}
+	return nil
+}
+
+// waitFor polls the VolumeSnapshots until they all satisfy the condition.
+func (s *CSIVolumeSnapshotter) waitFor(ctx context.Context, names []string, condition csiSnapshotCondition) error {
+	delay := pollInitialDelay
+	for _, name := range names {
+		for {
+			snapshot, err := s.snapshots().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("getting volume snapshot %s: %w", name, err)
+			}
+
+			done, err := condition(snapshot)
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+
+			if err := sleepContext(ctx, delay); err != nil {
+				return fmt.Errorf("waiting for volume snapshot %s: %w", name, err)
+			}
+			delay = nextDelay(delay)
+		}
+	}
+	return nil
+}
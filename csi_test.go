@@ -0,0 +1,232 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newCSITestSnapshotter returns the backend of pod `node-0`, with a `datadir`
+// and a `state` PVC, the VolumeSnapshots given being in the fake cluster.
+func newCSITestSnapshotter(t *testing.T, snapshots ...runtime.Object) (*CSIVolumeSnapshotter, *dynamicfake.FakeDynamicClient, *fake.Clientset) {
+	t.Setenv("HOSTNAME", "node-0")
+
+	storageClass := "standard"
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "node-0", Namespace: "default"}}
+	objects := []runtime.Object{pod}
+	for _, volume := range []string{"datadir", "state"} {
+		claimName := volume + "-node-0"
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         volume,
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+		})
+		objects = append(objects, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: claimName, Namespace: "default"},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				StorageClassName: &storageClass,
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+				},
+			},
+		})
+	}
+
+	clientset := fake.NewSimpleClientset(objects...)
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{VolumeSnapshotGVR: "VolumeSnapshotList"}, snapshots...)
+
+	s, err := NewCSIVolumeSnapshotterWithClients(map[string]string{
+		"tag":       "v1",
+		"namespace": "default",
+		"pvcs":      "datadir,state",
+	}, clientset, dynamicClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dynamicClient, clientset
+}
+
+func newTestVolumeSnapshot(name, claimName string, labels map[string]string, status map[string]interface{}) *unstructured.Unstructured {
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": VolumeSnapshotGVR.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"persistentVolumeClaimName": claimName},
+		},
+		"status": status,
+	}}
+	snapshot.SetName(name)
+	snapshot.SetNamespace("default")
+	snapshot.SetLabels(labels)
+	return snapshot
+}
+
+func TestCSIVolumeSnapshotterBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		// status of the created VolumeSnapshots by PVC, the CSI snapshotter
+		// sets it in a real cluster
+		status        map[string]map[string]interface{}
+		rejectCreate  string
+		wantErr       string
+		wantSnapshots []string
+	}{
+		{
+			name: "group",
+			status: map[string]map[string]interface{}{
+				"datadir-node-0": {"creationTime": "2022-05-01T00:00:00Z", "readyToUse": true},
+				"state-node-0":   {"creationTime": "2022-05-01T00:00:00Z", "readyToUse": true},
+			},
+			wantSnapshots: []string{"default-v1-0000000100-datadir", "default-v1-0000000100-state"},
+		},
+		{
+			name: "failed snapshot",
+			status: map[string]map[string]interface{}{
+				"datadir-node-0": {"creationTime": "2022-05-01T00:00:00Z", "readyToUse": true},
+				"state-node-0":   {"error": map[string]interface{}{"message": "out of quota"}},
+			},
+			wantErr: "out of quota",
+		},
+		{
+			name: "rejected snapshot",
+			status: map[string]map[string]interface{}{
+				"datadir-node-0": {"creationTime": "2022-05-01T00:00:00Z", "readyToUse": true},
+			},
+			rejectCreate: "state-node-0",
+			wantErr:      "creating volume snapshot default-v1-0000000100-state",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, dynamicClient, _ := newCSITestSnapshotter(t)
+			dynamicClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				snapshot := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+				claimName, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+				if claimName == test.rejectCreate {
+					return true, nil, fmt.Errorf("admission webhook denied the request")
+				}
+				snapshot.Object["status"] = test.status[claimName]
+				return false, nil, nil
+			})
+
+			snapshotName, err := s.Backup(100)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("backup error %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("backup: %s", err)
+			} else if snapshotName != "default-v1-0000000100" {
+				t.Errorf("snapshot name %q, want the group name", snapshotName)
+			}
+
+			list, err := s.snapshots().List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, snapshot := range list.Items {
+				names = append(names, snapshot.GetName())
+				if snapshot.GetLabels()[LabelGroup] != "default-v1-0000000100" {
+					t.Errorf("volume snapshot %s has labels %v", snapshot.GetName(), snapshot.GetLabels())
+				}
+			}
+			sort.Strings(names)
+			if strings.Join(names, " ") != strings.Join(test.wantSnapshots, " ") {
+				t.Errorf("volume snapshots %q, want %q", names, test.wantSnapshots)
+			}
+		})
+	}
+}
+
+func TestCSIVolumeSnapshotterList(t *testing.T) {
+	labels := func(group, volume, blockNum string) map[string]string {
+		out := map[string]string{LabelNamespace: "default", LabelTag: "v1", LabelBlockNum: blockNum}
+		if group != "" {
+			out[LabelGroup] = group
+			out[LabelVolume] = volume
+		}
+		return out
+	}
+
+	s, _, _ := newCSITestSnapshotter(t,
+		newTestVolumeSnapshot("default-v1-0000000050", "datadir-node-0", labels("", "", "50"), map[string]interface{}{"creationTime": "2022-05-01T00:00:00Z"}),
+		newTestVolumeSnapshot("default-v1-0000000100-datadir", "datadir-node-0", labels("default-v1-0000000100", "datadir", "100"), map[string]interface{}{"creationTime": "2022-05-02T00:00:00Z"}),
+		newTestVolumeSnapshot("default-v1-0000000100-state", "state-node-0", labels("default-v1-0000000100", "state", "100"), map[string]interface{}{"creationTime": "2022-05-02T00:00:00Z"}),
+		newTestVolumeSnapshot("other-v1-0000000200", "datadir-node-0", map[string]string{LabelNamespace: "other", LabelTag: "v1"}, nil),
+	)
+
+	snapshots, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, snapshot := range snapshots {
+		volumes := append([]string{}, snapshot.Volumes...)
+		sort.Strings(volumes)
+		got = append(got, fmt.Sprintf("%s@%d%v %s", snapshot.Name, snapshot.BlockNum, volumes, snapshot.CreatedAt.Format(time.RFC3339)))
+	}
+	want := []string{
+		"default-v1-0000000100@100[datadir state] 2022-05-02T00:00:00Z",
+		"default-v1-0000000050@50[] 2022-05-01T00:00:00Z",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("list %q, want %q", got, want)
+	}
+}
+
+func TestCSIVolumeSnapshotterRestore(t *testing.T) {
+	group := map[string]string{LabelNamespace: "default", LabelTag: "v1", LabelGroup: "default-v1-0000000100"}
+	s, _, clientset := newCSITestSnapshotter(t,
+		newTestVolumeSnapshot("default-v1-0000000100-datadir", "datadir-node-0", group, map[string]interface{}{"readyToUse": true, "restoreSize": "20Gi"}),
+		newTestVolumeSnapshot("default-v1-0000000100-state", "state-node-0", group, map[string]interface{}{"readyToUse": true}),
+	)
+
+	if err := s.Restore("default-v1-0000000100"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pvc      string
+		snapshot string
+		size     string
+	}{
+		{pvc: "restore-default-v1-0000000100-datadir", snapshot: "default-v1-0000000100-datadir", size: "20Gi"},
+		{pvc: "restore-default-v1-0000000100-state", snapshot: "default-v1-0000000100-state", size: "10Gi"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pvc, func(t *testing.T) {
+			pvc, err := clientset.CoreV1().PersistentVolumeClaims("default").Get(context.Background(), test.pvc, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source := pvc.Spec.DataSource
+			if source == nil || source.Kind != "VolumeSnapshot" || source.Name != test.snapshot || source.APIGroup == nil || *source.APIGroup != VolumeSnapshotGVR.Group {
+				t.Errorf("data source %+v, want volume snapshot %s", source, test.snapshot)
+			}
+			if size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; size.String() != test.size {
+				t.Errorf("size %s, want %s", size.String(), test.size)
+			}
+			if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName != "standard" {
+				t.Errorf("storage class %v, want the one of the source pvc", pvc.Spec.StorageClassName)
+			}
+		})
+	}
+}
@@ -0,0 +1,730 @@
+package snapshotter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("dedup-chunks", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewDedupSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// DedupSnapshotter cuts the files of a mounted directory in content defined
+// chunks stored once, by checksum, in an object store. A snapshot is an index
+// `<url>/indexes/<name>.json` listing the chunks of each file, so a backup
+// only uploads the chunks that changed since the previous ones while a
+// restore is always a full restore. Chunks are stored zstd compressed as
+// `<url>/chunks/<xx>/<sha256>`.
+type DedupSnapshotter struct {
+	tag         string
+	namespace   string
+	source      string
+	url         string
+	chunkSize   int
+	concurrency int
+	gc          bool
+	gcGrace     time.Duration
+	timeout     time.Duration
+
+	store   objectStore
+	encoder *zstd.Encoder
+}
+
+// dedupExampleConfigString lists the required keys, `url` is a gs://, s3://
+// or file:// URL. `chunk-size-kb=1024` (the average chunk size, a power of
+// two), `concurrency=8`, `gc=true`, `gc-grace=6h` and `timeout=6h` are
+// optional.
+var dedupExampleConfigString = "type=dedup-chunks tag=v1 namespace=default source=/data url=gs://mybucket/dedup"
+
+func NewDedupSnapshotter(conf map[string]string) (*DedupSnapshotter, error) {
+	for _, label := range []string{"tag", "namespace", "source", "url"} {
+		if conf[label] == "" {
+			return nil, fmt.Errorf("backup module dedup-chunks missing value for %s. Example: %s", label, dedupExampleConfigString)
+		}
+	}
+
+	s := &DedupSnapshotter{
+		tag:         conf["tag"],
+		namespace:   conf["namespace"],
+		source:      filepath.Clean(conf["source"]),
+		url:         conf["url"],
+		chunkSize:   1 << 20,
+		concurrency: 8,
+		gc:          true,
+		gcGrace:     6 * time.Hour,
+		timeout:     6 * time.Hour,
+	}
+
+	if conf["chunk-size-kb"] != "" {
+		size, err := strconv.Atoi(conf["chunk-size-kb"])
+		if err != nil || size < 16 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("backup module dedup-chunks invalid value %q for chunk-size-kb, must be a power of two of at least 16", conf["chunk-size-kb"])
+		}
+		s.chunkSize = size << 10
+	}
+
+	if conf["concurrency"] != "" {
+		concurrency, err := strconv.Atoi(conf["concurrency"])
+		if err != nil || concurrency <= 0 {
+			return nil, fmt.Errorf("backup module dedup-chunks invalid value %q for concurrency", conf["concurrency"])
+		}
+		s.concurrency = concurrency
+	}
+
+	if conf["gc"] != "" {
+		gc, err := strconv.ParseBool(conf["gc"])
+		if err != nil {
+			return nil, fmt.Errorf("backup module dedup-chunks invalid value %q for gc", conf["gc"])
+		}
+		s.gc = gc
+	}
+
+	if conf["gc-grace"] != "" {
+		var err error
+		if s.gcGrace, err = time.ParseDuration(conf["gc-grace"]); err != nil {
+			return nil, fmt.Errorf("backup module dedup-chunks invalid value for gc-grace: %w", err)
+		}
+	}
+
+	if conf["timeout"] != "" {
+		var err error
+		if s.timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module dedup-chunks invalid value for timeout: %w", err)
+		}
+	}
+
+	store, err := newObjectStore(context.Background(), s.url)
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+
+	if s.encoder, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *DedupSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// Backup chunks every regular file of the source directory, uploading up to
+// `concurrency` chunks missing from the store at the same time, and writes
+// the index once every chunk is uploaded. Chunks uploaded by a failed backup
+// are left to the garbage collector. Chunks are only reused when a current
+// index refers to them.
+func (s *DedupSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	manifest := &Manifest{
+		Name:      GenerateName(s.namespace, s.tag, lastSeenBlockNum),
+		Namespace: s.namespace,
+		Tag:       s.tag,
+		BlockNum:  lastSeenBlockNum,
+		CreatedAt: time.Now().UTC(),
+		Version:   Version,
+	}
+
+	// Only the chunks of the current indexes are reused, the ones no index
+	// refers to may be collected while this backup runs. Uploading them again
+	// restarts their grace period.
+	manifests, err := s.readIndexes(ctx)
+	if err != nil {
+		return "", err
+	}
+	stored := map[string]bool{}
+	for _, existing := range manifests {
+		addManifestChunks(stored, existing)
+	}
+
+	uploader := newChunkUploader(ctx, s.store, s.encoder, s.concurrency, stored)
+
+	zlog.Info("chunking data directory", zap.String("source", s.source), zap.String("snapshot", manifest.Name), zap.String("url", s.url), zap.Int("stored_chunks", len(stored)))
+	err = s.chunkTree(uploader, manifest)
+	// An upload failure cancels the walk, it is the error to report
+	if uploadErr := uploader.Wait(); uploadErr != nil {
+		err = uploadErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("chunking %s: %w", s.source, err)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.WriteObject(ctx, dedupIndexName(manifest.Name), content); err != nil {
+		return "", fmt.Errorf("writing index: %w", err)
+	}
+
+	zlog.Info("chunks uploaded", zap.String("snapshot", manifest.Name), zap.Int64("size", manifest.Size), zap.Int("new_chunks", uploader.uploaded), zap.Int64("new_size", uploader.uploadedSize))
+	return manifest.Name, nil
+}
+
+// chunkTree records the directories, symlinks and chunked regular files of
+// the source directory in the manifest, handing the chunks to the uploader.
+func (s *DedupSnapshotter) chunkTree(uploader *chunkUploader, manifest *Manifest) error {
+	return filepath.WalkDir(s.source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := uploader.ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.source, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := &ManifestFile{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+		switch {
+		case info.IsDir():
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			if file.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+
+		case info.Mode().IsRegular():
+			if err := s.chunkFile(path, uploader, file); err != nil {
+				return fmt.Errorf("chunking %s: %w", path, err)
+			}
+			manifest.Size += file.Size
+			manifest.FileCount++
+
+		default:
+			zlog.Warn("skipping file that is not a regular file, directory or symlink", zap.String("path", path))
+			return nil
+		}
+
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+}
+
+func (s *DedupSnapshotter) chunkFile(path string, uploader *chunkUploader, file *ManifestFile) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	total := sha256.New()
+	chunks := newChunker(in, s.chunkSize)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		checksum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(checksum[:])
+		total.Write(chunk)
+
+		file.Chunks = append(file.Chunks, hash)
+		file.Size += int64(len(chunk))
+		if err := uploader.Add(hash, chunk); err != nil {
+			return err
+		}
+	}
+
+	file.SHA256 = hex.EncodeToString(total.Sum(nil))
+	return nil
+}
+
+// Restore rebuilds the source directory, which must be empty, from the
+// chunks of the snapshot, fetching up to `concurrency` chunks ahead. The
+// checksum of every chunk and every file is verified, a mismatch fails the
+// restore, leaving a partially restored directory.
+func (s *DedupSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	manifest, err := s.readIndex(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.source, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.source)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("cannot restore snapshot %s, directory %s is not empty", snapshotName, s.source)
+	}
+
+	root, err := filepath.Abs(s.source)
+	if err != nil {
+		return err
+	}
+	// Compared to the resolved parents of the entries below
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	// Stop the downloads in progress before the decoder is closed
+	fetchCtx, stopFetch := context.WithCancel(ctx)
+	var fetching sync.WaitGroup
+	defer fetching.Wait()
+	defer stopFetch()
+	chunks := s.fetchChunks(fetchCtx, decoder, manifest.Files, &fetching)
+
+	zlog.Info("restoring chunks to data directory", zap.String("snapshot", snapshotName), zap.String("source", s.source), zap.Int("files", manifest.FileCount))
+	for _, file := range manifest.Files {
+		target := filepath.Join(root, filepath.FromSlash(file.Path))
+		if !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return fmt.Errorf("index entry %q is outside of the directory", file.Path)
+		}
+		if parent, err := filepath.EvalSymlinks(filepath.Dir(target)); err == nil && parent != root && !strings.HasPrefix(parent, root+string(filepath.Separator)) {
+			return fmt.Errorf("index entry %q is outside of the directory through a symlink", file.Path)
+		}
+
+		switch {
+		case file.Mode.IsDir():
+			if err := os.MkdirAll(target, file.Mode.Perm()|0700); err != nil {
+				return err
+			}
+
+		case file.Mode&fs.ModeSymlink != 0:
+			if err := os.Symlink(file.Link, target); err != nil {
+				return err
+			}
+
+		case file.Mode.IsRegular():
+			if err := restoreChunkedFile(target, file, chunks); err != nil {
+				return fmt.Errorf("restoring snapshot %s: %w", snapshotName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// fetchChunks downloads, in order, the chunks of the regular files, up to
+// `concurrency` at the same time. Each chunk is delivered on its own channel
+// so they are read in order whatever order they are downloaded in. wg is done
+// once every download has returned.
+func (s *DedupSnapshotter) fetchChunks(ctx context.Context, decoder *zstd.Decoder, files []*ManifestFile, wg *sync.WaitGroup) <-chan chan chunkResult {
+	out := make(chan chan chunkResult, s.concurrency)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(out)
+		for _, file := range files {
+			for _, hash := range file.Chunks {
+				result := make(chan chunkResult, 1)
+				select {
+				case out <- result:
+				case <-ctx.Done():
+					return
+				}
+
+				wg.Add(1)
+				go func(hash string) {
+					defer wg.Done()
+					content, err := s.readChunk(ctx, decoder, hash)
+					result <- chunkResult{content: content, err: err}
+				}(hash)
+			}
+		}
+	}()
+	return out
+}
+
+type chunkResult struct {
+	content []byte
+	err     error
+}
+
+func (s *DedupSnapshotter) readChunk(ctx context.Context, decoder *zstd.Decoder, hash string) ([]byte, error) {
+	reader, err := s.store.OpenObject(ctx, dedupChunkName(hash))
+	if err != nil {
+		return nil, fmt.Errorf("opening chunk %s: %w", hash, err)
+	}
+	defer reader.Close()
+
+	compressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk %s: %w", hash, err)
+	}
+	content, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing chunk %s: %w", hash, err)
+	}
+
+	if checksum := sha256.Sum256(content); hex.EncodeToString(checksum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupted, got checksum %s", hash, hex.EncodeToString(checksum[:]))
+	}
+	return content, nil
+}
+
+func restoreChunkedFile(target string, file *ManifestFile, chunks <-chan chan chunkResult) error {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	total := sha256.New()
+	var size int64
+	for range file.Chunks {
+		result, ok := <-chunks
+		if !ok {
+			out.Close()
+			return fmt.Errorf("chunk download stopped")
+		}
+		chunk := <-result
+		if chunk.err != nil {
+			out.Close()
+			return chunk.err
+		}
+
+		if _, err := out.Write(chunk.content); err != nil {
+			out.Close()
+			return err
+		}
+		total.Write(chunk.content)
+		size += int64(len(chunk.content))
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if checksum := hex.EncodeToString(total.Sum(nil)); size != file.Size || checksum != file.SHA256 {
+		return fmt.Errorf("file %s is corrupted, got %d bytes with checksum %s, expected %d bytes with checksum %s", file.Path, size, checksum, file.Size, file.SHA256)
+	}
+	return nil
+}
+
+// List returns the snapshots of the store matching the namespace and tag.
+func (s *DedupSnapshotter) List() (out []*Snapshot, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	manifests, err := s.readIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, manifest := range manifests {
+		if manifest.Namespace != s.namespace || manifest.Tag != s.tag {
+			continue
+		}
+		out = append(out, manifest.Snapshot())
+	}
+
+	sortSnapshotsByMostRecent(out)
+	return out, nil
+}
+
+// Delete moves the index of the snapshot to `<url>/deleted/<name>.json` then,
+// unless `gc=false`, collects the chunks no snapshot refers to anymore.
+func (s *DedupSnapshotter) Delete(snapshotName string) error {
+	return s.DeleteSnapshots([]string{snapshotName})
+}
+
+// DeleteSnapshots deletes the snapshots like Delete but collects the chunks
+// once, after the last index is deleted. ApplyRetention uses it to prune.
+func (s *DedupSnapshotter) DeleteSnapshots(snapshotNames []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	for _, snapshotName := range snapshotNames {
+		if err := s.deleteIndex(ctx, snapshotName); err != nil {
+			return err
+		}
+	}
+
+	if !s.gc {
+		return nil
+	}
+	return s.CollectGarbage(ctx)
+}
+
+// deleteIndex writes the tombstone of the snapshot, a copy of its index
+// keeping its chunks for `gc-grace`, before deleting the index. A backup
+// reusing the chunks of the index is then done before they are collected.
+func (s *DedupSnapshotter) deleteIndex(ctx context.Context, snapshotName string) error {
+	if err := validateDedupSnapshotName(snapshotName); err != nil {
+		return err
+	}
+
+	reader, err := s.store.OpenObject(ctx, dedupIndexName(snapshotName))
+	if err != nil {
+		return fmt.Errorf("reading index of snapshot %s: %w", snapshotName, err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("reading index of snapshot %s: %w", snapshotName, err)
+	}
+
+	if err := s.store.WriteObject(ctx, dedupTombstoneName(snapshotName), content); err != nil {
+		return fmt.Errorf("writing tombstone of snapshot %s: %w", snapshotName, err)
+	}
+	if err := s.store.DeleteObject(ctx, dedupIndexName(snapshotName)); err != nil {
+		return fmt.Errorf("deleting index of snapshot %s: %w", snapshotName, err)
+	}
+	return nil
+}
+
+// CollectGarbage deletes the chunks referenced by no index of the store,
+// whatever their namespace and tag. Chunks written less than `gc-grace` ago
+// are kept since a backup in progress may refer to them before writing its
+// index, so backups to the store must not take longer than the grace period.
+// For the same reason, the chunks of the snapshots deleted less than
+// `gc-grace` ago are kept, older tombstones are deleted.
+func (s *DedupSnapshotter) CollectGarbage(ctx context.Context) error {
+	// Taken before the indexes are read, a snapshot deleted more than the
+	// grace period before was deleted after any backup that read its index
+	// completed and wrote its own.
+	start := time.Now()
+
+	manifests, err := s.readIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
+	referenced := map[string]bool{}
+	for _, manifest := range manifests {
+		addManifestChunks(referenced, manifest)
+	}
+
+	tombstones, err := s.store.ListObjects(ctx, "deleted/")
+	if err != nil {
+		return fmt.Errorf("listing tombstones of %s: %w", s.url, err)
+	}
+
+	var expired []string
+	for _, tombstone := range tombstones {
+		if start.Sub(tombstone.ModTime) >= s.gcGrace {
+			expired = append(expired, tombstone.Name)
+			continue
+		}
+
+		manifest, err := s.readManifest(ctx, tombstone.Name)
+		if err != nil {
+			return err
+		}
+		addManifestChunks(referenced, manifest)
+	}
+
+	chunks, err := s.store.ListObjects(ctx, "chunks/")
+	if err != nil {
+		return fmt.Errorf("listing chunks of %s: %w", s.url, err)
+	}
+
+	deleted := 0
+	for _, chunk := range chunks {
+		if referenced[chunk.Name] || time.Since(chunk.ModTime) < s.gcGrace {
+			continue
+		}
+
+		if err := s.store.DeleteObject(ctx, chunk.Name); err != nil {
+			return fmt.Errorf("deleting chunk %s: %w", chunk.Name, err)
+		}
+		deleted++
+	}
+
+	for _, name := range expired {
+		if err := s.store.DeleteObject(ctx, name); err != nil {
+			return fmt.Errorf("deleting tombstone %s: %w", name, err)
+		}
+	}
+
+	zlog.Info("collected unreferenced chunks", zap.String("url", s.url), zap.Int("deleted", deleted), zap.Int("chunks", len(chunks)), zap.Int("indexes", len(manifests)), zap.Int("tombstones", len(tombstones)-len(expired)))
+	return nil
+}
+
+func addManifestChunks(chunks map[string]bool, manifest *Manifest) {
+	for _, file := range manifest.Files {
+		for _, hash := range file.Chunks {
+			chunks[dedupChunkName(hash)] = true
+		}
+	}
+}
+
+func (s *DedupSnapshotter) readIndexes(ctx context.Context) ([]*Manifest, error) {
+	indexes, err := s.store.ListObjects(ctx, "indexes/")
+	if err != nil {
+		return nil, fmt.Errorf("listing indexes of %s: %w", s.url, err)
+	}
+
+	var out []*Manifest
+	for _, index := range indexes {
+		rel := strings.TrimPrefix(index.Name, "indexes/")
+		snapshotName := strings.TrimSuffix(rel, ".json")
+		if snapshotName == rel || validateDedupSnapshotName(snapshotName) != nil {
+			continue
+		}
+
+		manifest, err := s.readIndex(ctx, snapshotName)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, manifest)
+	}
+	return out, nil
+}
+
+func (s *DedupSnapshotter) readIndex(ctx context.Context, snapshotName string) (*Manifest, error) {
+	if err := validateDedupSnapshotName(snapshotName); err != nil {
+		return nil, err
+	}
+
+	return s.readManifest(ctx, dedupIndexName(snapshotName))
+}
+
+// readManifest reads an index or a tombstone.
+func (s *DedupSnapshotter) readManifest(ctx context.Context, name string) (*Manifest, error) {
+	reader, err := s.store.OpenObject(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	defer reader.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid index %s: %w", name, err)
+	}
+	return manifest, nil
+}
+
+func validateDedupSnapshotName(snapshotName string) error {
+	if snapshotName == "" || strings.ContainsAny(snapshotName, `/\`) || strings.HasPrefix(snapshotName, ".") {
+		return fmt.Errorf("invalid snapshot name %q", snapshotName)
+	}
+	return nil
+}
+
+func dedupIndexName(snapshotName string) string {
+	return "indexes/" + snapshotName + ".json"
+}
+
+func dedupTombstoneName(snapshotName string) string {
+	return "deleted/" + snapshotName + ".json"
+}
+
+func dedupChunkName(hash string) string {
+	return "chunks/" + hash[:2] + "/" + hash
+}
+
+// chunkUploader compresses and uploads the chunks missing from the store,
+// up to `concurrency` at the same time, stopping at the first failure.
+type chunkUploader struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	store   objectStore
+	encoder *zstd.Encoder
+	slots   chan struct{}
+	wg      sync.WaitGroup
+
+	lock         sync.Mutex
+	stored       map[string]bool
+	uploaded     int
+	uploadedSize int64
+	err          error
+}
+
+func newChunkUploader(ctx context.Context, store objectStore, encoder *zstd.Encoder, concurrency int, stored map[string]bool) *chunkUploader {
+	ctx, cancel := context.WithCancel(ctx)
+	return &chunkUploader{
+		ctx:     ctx,
+		cancel:  cancel,
+		store:   store,
+		encoder: encoder,
+		slots:   make(chan struct{}, concurrency),
+		stored:  stored,
+	}
+}
+
+// Add uploads the chunk unless the store already has it. The content is
+// copied, the caller can reuse it.
+func (u *chunkUploader) Add(hash string, content []byte) error {
+	name := dedupChunkName(hash)
+
+	u.lock.Lock()
+	if u.stored[name] {
+		u.lock.Unlock()
+		return nil
+	}
+	u.stored[name] = true
+	u.lock.Unlock()
+
+	select {
+	case u.slots <- struct{}{}:
+	case <-u.ctx.Done():
+		return u.ctx.Err()
+	}
+
+	compressed := u.encoder.EncodeAll(content, nil)
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		defer func() { <-u.slots }()
+
+		err := u.store.WriteObject(u.ctx, name, compressed)
+
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		if err != nil {
+			if u.err == nil {
+				u.err = fmt.Errorf("uploading chunk %s: %w", hash, err)
+				u.cancel()
+			}
+			return
+		}
+		u.uploaded++
+		u.uploadedSize += int64(len(compressed))
+	}()
+	return nil
+}
+
+// Wait waits for the uploads in progress and returns the first failure.
+func (u *chunkUploader) Wait() error {
+	u.wg.Wait()
+	u.cancel()
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.err
+}
@@ -0,0 +1,179 @@
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func newTestDedupSnapshotter(t *testing.T, source, store string) *DedupSnapshotter {
+	s, err := NewDedupSnapshotter(map[string]string{
+		"tag":           "v1",
+		"namespace":     "default",
+		"source":        source,
+		"url":           "file://" + store,
+		"chunk-size-kb": "16",
+		"gc-grace":      "0s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// readTestChunks returns the names of the chunks of the store.
+func readTestChunks(t *testing.T, store string) (out []string) {
+	root := filepath.Join(store, "chunks")
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(store, path)
+		out = append(out, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDedupSnapshotterRoundTrip(t *testing.T) {
+	source := newTestArchiveSource(t)
+	store := t.TempDir()
+	s := newTestDedupSnapshotter(t, source, store)
+
+	first, err := s.Backup(100)
+	if err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+
+	target := t.TempDir()
+	if err := newTestDedupSnapshotter(t, target, store).Restore(first); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if got, want := readTestTree(t, target), readTestTree(t, source); !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %s differs from the source", first)
+	}
+
+	// The second backup adds a file and changes another, the chunks of its
+	// previous content are only referenced by the first snapshot
+	extra := make([]byte, 100<<10)
+	rand.New(rand.NewSource(2)).Read(extra)
+	if err := os.WriteFile(filepath.Join(source, "extra.bin"), extra, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "state", "db", "CURRENT"), []byte("MANIFEST-000002\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.Backup(200)
+	if err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+
+	// Left by an interrupted backup
+	orphan := filepath.Join(store, "chunks", "00", strings.Repeat("0", 64))
+	if err := os.MkdirAll(filepath.Dir(orphan), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ApplyRetention(s, &RetentionPolicy{KeepLast: 1}); err != nil {
+		t.Fatalf("apply retention: %s", err)
+	}
+
+	snapshots, err := s.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != second {
+		t.Fatalf("list %+v, want only snapshot %s", snapshots, second)
+	}
+
+	manifest, err := s.readIndex(context.Background(), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referenced := map[string]bool{}
+	addManifestChunks(referenced, manifest)
+	var want []string
+	for name := range referenced {
+		want = append(want, name)
+	}
+	sort.Strings(want)
+	if got := readTestChunks(t, store); !reflect.DeepEqual(got, want) {
+		t.Errorf("%d chunks left, want the %d chunks of snapshot %s", len(got), len(want), second)
+	}
+	if _, err := os.Stat(filepath.Join(store, dedupTombstoneName(first))); !os.IsNotExist(err) {
+		t.Errorf("tombstone of %s kept past the grace period: %v", first, err)
+	}
+
+	target = t.TempDir()
+	if err := newTestDedupSnapshotter(t, target, store).Restore(second); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if got, want := readTestTree(t, target), readTestTree(t, source); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %s differs from the source", second)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(3)).Read(content)
+
+	chunks := func(r io.Reader) (out [][]byte) {
+		c := newChunker(r, 16<<10)
+		for {
+			chunk, err := c.Next()
+			if err == io.EOF {
+				return out
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, append([]byte(nil), chunk...))
+		}
+	}
+
+	want := chunks(bytes.NewReader(content))
+	if !bytes.Equal(bytes.Join(want, nil), content) {
+		t.Fatalf("chunks do not add up to the content")
+	}
+	for i, chunk := range want[:len(want)-1] {
+		if len(chunk) < 4<<10 || len(chunk) > 64<<10 {
+			t.Errorf("chunk %d of %d bytes, want between 4 and 64 KB", i, len(chunk))
+		}
+	}
+
+	// Boundaries only depend on the content, not on how it is read
+	if got := chunks(iotest.HalfReader(bytes.NewReader(content))); !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks of a slow reader differ")
+	}
+	if got := chunks(iotest.DataErrReader(bytes.NewReader(content))); !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks of a reader returning io.EOF with the data differ")
+	}
+
+	// The changes only affect the chunks around them
+	edited := append([]byte("header"), content...)
+	shared := map[string]bool{}
+	for _, chunk := range chunks(bytes.NewReader(edited)) {
+		shared[string(chunk)] = true
+	}
+	for _, chunk := range want[1:] {
+		if !shared[string(chunk)] {
+			t.Errorf("chunk of %d bytes changed by a change before it", len(chunk))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package snapshotter
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultDiskType is the type of the disks created from snapshots when the
+// storage class of the PV does not tell it.
+const DefaultDiskType = "pd-ssd"
+
+var (
+	zoneLabels   = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+	regionLabels = []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}
+
+	// zoneAffinityKeys are the node affinity keys the CSI drivers and the
+	// in-tree plugins use to pin a PV to its zones.
+	zoneAffinityKeys = []string{"topology.gke.io/zone", "topology.ebs.csi.aws.com/zone", "topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+)
+
+// PersistentDisk is the GCE disk backing a PV. Regional disks have no Zone,
+// they are replicated in the ReplicaZones of their Region.
+type PersistentDisk struct {
+	Name         string
+	Zone         string
+	Region       string
+	ReplicaZones []string
+}
+
+// IsRegional returns true for a regional disk.
+func (d *PersistentDisk) IsRegional() bool {
+	return d.Zone == ""
+}
+
+// PersistentDiskOfPV resolves the GCE disk of an in-tree `gcePersistentDisk`
+// or a CSI PV. A disk is regional when its CSI volume handle is of the form
+// `projects/p/regions/r/disks/d` or when its zone label lists several zones
+// separated by `__`, as the in-tree plugin does for regional disks.
+func PersistentDiskOfPV(pv *corev1.PersistentVolume) (*PersistentDisk, error) {
+	out := &PersistentDisk{}
+
+	var handleZone, handleRegion string
+	switch {
+	case pv.Spec.GCEPersistentDisk != nil:
+		out.Name = pv.Spec.GCEPersistentDisk.PDName
+	case pv.Spec.CSI != nil:
+		handle := pv.Spec.CSI.VolumeHandle
+		out.Name = volumeHandleField(handle, "disks")
+		handleZone = volumeHandleField(handle, "zones")
+		handleRegion = volumeHandleField(handle, "regions")
+		if out.Name == "" {
+			return nil, fmt.Errorf("cannot find disk name in CSI volume handle %q of PV %s", handle, pv.Name)
+		}
+	default:
+		return nil, fmt.Errorf("no gce persistent disk")
+	}
+
+	labels := pv.GetLabels()
+	zone := firstLabel(labels, zoneLabels)
+	if zone == "" {
+		zone = handleZone
+	}
+
+	zones := strings.Split(zone, "__")
+	if handleRegion != "" || len(zones) > 1 {
+		out.ReplicaZones = zones
+		if len(zones) < 2 {
+			out.ReplicaZones = affinityZones(pv)
+		}
+		if len(out.ReplicaZones) < 2 {
+			return nil, fmt.Errorf("cannot find the replica zones of regional PV %s, no multi-zone label nor node affinity", pv.Name)
+		}
+	} else {
+		out.Zone = zone
+		if out.Zone == "" {
+			return nil, fmt.Errorf("cannot find zone for PV %s, no failure-domain.beta.kubernetes.io/zone or topology.kubernetes.io/zone label on PV", pv.Name)
+		}
+	}
+
+	out.Region = firstLabel(labels, regionLabels)
+	if out.Region == "" {
+		out.Region = handleRegion
+	}
+	if out.Region == "" {
+		out.Region = zoneRegion(zones[0])
+	}
+	if out.Region == "" {
+		return nil, fmt.Errorf("cannot find region for PV %s, no failure-domain.beta.kubernetes.io/region or topology.kubernetes.io/region label on PV", pv.Name)
+	}
+
+	return out, nil
+}
+
+func pdDefFromPV(pv *corev1.PersistentVolume, claimName string) (*pdDef, error) {
+	disk, err := PersistentDiskOfPV(pv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pdDef{
+		name:         disk.Name,
+		claimName:    claimName,
+		zone:         disk.Zone,
+		region:       disk.Region,
+		regional:     disk.IsRegional(),
+		replicaZones: disk.ReplicaZones,
+	}, nil
+}
+
+// location returns the zone of the disk or, for regional disks, its region.
+func (pd *pdDef) location() string {
+	if pd.regional {
+		return pd.region
+	}
+	return pd.zone
+}
+
+func volumeHandleField(handle, field string) string {
+	fields := strings.Split(handle, "/")
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == field {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+func firstLabel(labels map[string]string, keys []string) string {
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func affinityZones(pv *corev1.PersistentVolume) (out []string) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			for _, key := range zoneAffinityKeys {
+				if expr.Key != key || expr.Operator != corev1.NodeSelectorOpIn {
+					continue
+				}
+
+				for _, zone := range expr.Values {
+					if !seen[zone] {
+						seen[zone] = true
+						out = append(out, zone)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// zoneRegion returns `us-central1` for `us-central1-a`.
+func zoneRegion(zone string) string {
+	idx := strings.LastIndex(zone, "-")
+	if idx <= 0 {
+		return ""
+	}
+	return zone[:idx]
+}
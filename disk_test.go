@@ -0,0 +1,108 @@
+package snapshotter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPersistentDiskOfPV(t *testing.T) {
+	inTree := func(labels map[string]string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-0", Labels: labels},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				GCEPersistentDisk: &corev1.GCEPersistentDiskVolumeSource{PDName: "disk-0"},
+			}},
+		}
+	}
+	csi := func(handle string, affinityZones ...string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-0"},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "pd.csi.storage.gke.io", VolumeHandle: handle},
+			}},
+		}
+		if len(affinityZones) > 0 {
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{
+					{Key: "topology.gke.io/zone", Operator: corev1.NodeSelectorOpIn, Values: affinityZones},
+				}}},
+			}}
+		}
+		return pv
+	}
+
+	tests := []struct {
+		name    string
+		pv      *corev1.PersistentVolume
+		want    *PersistentDisk
+		wantErr string
+	}{
+		{
+			name: "in-tree zonal",
+			pv:   inTree(map[string]string{"topology.kubernetes.io/zone": "us-central1-a", "topology.kubernetes.io/region": "us-central1"}),
+			want: &PersistentDisk{Name: "disk-0", Zone: "us-central1-a", Region: "us-central1"},
+		},
+		{
+			name: "in-tree zonal, beta labels",
+			pv:   inTree(map[string]string{"failure-domain.beta.kubernetes.io/zone": "us-central1-a"}),
+			want: &PersistentDisk{Name: "disk-0", Zone: "us-central1-a", Region: "us-central1"},
+		},
+		{
+			name: "in-tree regional",
+			pv:   inTree(map[string]string{"failure-domain.beta.kubernetes.io/zone": "us-central1-a__us-central1-b"}),
+			want: &PersistentDisk{Name: "disk-0", Region: "us-central1", ReplicaZones: []string{"us-central1-a", "us-central1-b"}},
+		},
+		{
+			name: "csi zonal",
+			pv:   csi("projects/chain-data/zones/us-central1-a/disks/disk-0"),
+			want: &PersistentDisk{Name: "disk-0", Zone: "us-central1-a", Region: "us-central1"},
+		},
+		{
+			name: "csi regional",
+			pv:   csi("projects/chain-data/regions/us-central1/disks/disk-0", "us-central1-a", "us-central1-c"),
+			want: &PersistentDisk{Name: "disk-0", Region: "us-central1", ReplicaZones: []string{"us-central1-a", "us-central1-c"}},
+		},
+		{
+			name:    "csi regional without replica zones",
+			pv:      csi("projects/chain-data/regions/us-central1/disks/disk-0"),
+			wantErr: "cannot find the replica zones",
+		},
+		{
+			name:    "csi handle without disk",
+			pv:      csi("projects/chain-data/zones/us-central1-a"),
+			wantErr: "cannot find disk name",
+		},
+		{
+			name:    "in-tree without zone",
+			pv:      inTree(nil),
+			wantErr: "cannot find zone",
+		},
+		{
+			name:    "not a gce disk",
+			pv:      &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-0"}},
+			wantErr: "no gce persistent disk",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := PersistentDiskOfPV(test.pv)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("disk %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
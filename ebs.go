@@ -0,0 +1,542 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("aws-ebs-snapshot", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewEBSSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// EBSCSIDriver is the name of the AWS EBS CSI driver.
+const EBSCSIDriver = "ebs.csi.aws.com"
+
+// ebsNameTag holds the snapshot name, EBS snapshots only having an ID.
+const ebsNameTag = "Name"
+
+// EC2API is the part of the EC2 client used by EBSSnapshotter.
+type EC2API interface {
+	CreateSnapshot(ctx context.Context, params *ec2.CreateSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.CreateSnapshotOutput, error)
+	DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error)
+	DeleteSnapshot(ctx context.Context, params *ec2.DeleteSnapshotInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSnapshotOutput, error)
+	CreateVolume(ctx context.Context, params *ec2.CreateVolumeInput, optFns ...func(*ec2.Options)) (*ec2.CreateVolumeOutput, error)
+	DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+}
+
+// EBSSnapshotter snapshots the EBS volumes of the pod's PVCs, for pods
+// running on EKS (or any cluster) with `ebs.csi.aws.com` or in-tree
+// `awsElasticBlockStore` volumes.
+type EBSSnapshotter struct {
+	tag       string
+	namespace string
+	pod       string
+	volumes   volumeSelector
+	mounts    []string
+	freeze    string
+	timeout   time.Duration
+
+	ec2       EC2API
+	clientset kubernetes.Interface
+}
+
+// ebsExampleConfigString lists the required keys, `pvcs`, `mounts`, `freeze`
+// are accepted like for gke-pvc-snapshot and `timeout` defaults to 30m as
+// the backup waits for the snapshots to be completed. `region` overrides the
+// region of the AWS config and `endpoint` the EC2 endpoint, to use a local
+// EC2 API stand-in.
+var ebsExampleConfigString = "type=aws-ebs-snapshot tag=v1 namespace=default prefix=datadir"
+
+// NewEBSSnapshotter creates the backend with the default AWS config, from
+// the environment or the instance metadata, and the in cluster Kubernetes
+// config, or the default kubeconfig outside of a cluster.
+func NewEBSSnapshotter(conf map[string]string) (*EBSSnapshotter, error) {
+	ctx := context.Background()
+
+	var options []func(*awsconfig.LoadOptions) error
+	if conf["region"] != "" {
+		options = append(options, awsconfig.WithRegion(conf["region"]))
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+
+	client := ec2.NewFromConfig(cfg, func(o *ec2.Options) {
+		if conf["endpoint"] != "" {
+			o.EndpointResolver = ec2.EndpointResolverFromURL(conf["endpoint"])
+		}
+	})
+
+	clientset, err := newKubernetesClientset()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEBSSnapshotterWithClients(conf, client, clientset)
+}
+
+// NewEBSSnapshotterWithClients creates the backend with the given clients.
+func NewEBSSnapshotterWithClients(conf map[string]string, ec2Client EC2API, clientset kubernetes.Interface) (*EBSSnapshotter, error) {
+	required := []string{"tag", "namespace", "prefix"}
+	if conf["pvcs"] != "" {
+		required = []string{"tag", "namespace"}
+	}
+
+	for _, label := range required {
+		if conf[label] == "" {
+			return nil, fmt.Errorf("backup module aws-ebs-snapshot missing value for %s. Example: %s", label, ebsExampleConfigString)
+		}
+	}
+
+	timeout := 30 * time.Minute
+	if conf["timeout"] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module aws-ebs-snapshot invalid value for timeout: %w", err)
+		}
+	}
+
+	mounts, freeze, err := parseFreezeConfig("aws-ebs-snapshot", conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EBSSnapshotter{
+		tag:       conf["tag"],
+		namespace: conf["namespace"],
+		pod:       os.Getenv("HOSTNAME"),
+		volumes:   parseVolumeSelector(conf),
+		mounts:    mounts,
+		freeze:    freeze,
+		timeout:   timeout,
+		ec2:       ec2Client,
+		clientset: clientset,
+	}, nil
+}
+
+func (s *EBSSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// ebsVolume is the EBS volume behind a PVC of the pod.
+type ebsVolume struct {
+	id        string
+	zone      string
+	claimName string
+	volume    string
+}
+
+// ebsVolumeFromPV resolves the EBS volume ID of an `ebs.csi.aws.com` PV,
+// whose volume handle is the volume ID, or of an in-tree
+// `awsElasticBlockStore` PV, whose volume ID is `aws://<zone>/<volume ID>`.
+func ebsVolumeFromPV(pv *corev1.PersistentVolume, claimName string) (*ebsVolume, error) {
+	out := &ebsVolume{claimName: claimName}
+
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == EBSCSIDriver:
+		out.id = pv.Spec.CSI.VolumeHandle
+	case pv.Spec.AWSElasticBlockStore != nil:
+		volumeID := strings.TrimPrefix(pv.Spec.AWSElasticBlockStore.VolumeID, "aws://")
+		if idx := strings.LastIndex(volumeID, "/"); idx >= 0 {
+			out.zone = volumeID[:idx]
+			volumeID = volumeID[idx+1:]
+		}
+		out.id = volumeID
+	default:
+		return nil, fmt.Errorf("pv %s is not an ebs volume", pv.Name)
+	}
+
+	if !strings.HasPrefix(out.id, "vol-") {
+		return nil, fmt.Errorf("invalid ebs volume id %q in pv %s", out.id, pv.Name)
+	}
+
+	if zones := affinityZones(pv); len(zones) > 0 {
+		out.zone = zones[0]
+	} else if zone := firstLabel(pv.Labels, zoneLabels); zone != "" {
+		out.zone = zone
+	}
+
+	return out, nil
+}
+
+func (s *EBSSnapshotter) getVolumes(ctx context.Context) (out []*ebsVolume, err error) {
+	claims, err := getPodClaims(ctx, s.clientset, s.pod, s.namespace, s.volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, claimName := range claims {
+		pv, err := getClaimPersistentVolume(ctx, s.clientset, s.namespace, claimName)
+		if err != nil {
+			return nil, err
+		}
+
+		vol, err := ebsVolumeFromPV(pv, claimName)
+		if err != nil {
+			return nil, err
+		}
+		vol.volume = volumeName(claimName, s.pod)
+		out = append(out, vol)
+	}
+	return out, nil
+}
+
+// Backup snapshots the EBS volume of every selected PVC of the pod as one
+// group and waits for the snapshots to be completed. EBS captures the volume
+// when CreateSnapshot returns, the mounts are thawed right after. The group
+// succeeds or fails as a whole, on failure the snapshots already created are
+// deleted.
+func (s *EBSSnapshotter) Backup(lastSeenBlockNum uint32) (snapshotName string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	vols, err := s.getVolumes(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error getting ebs volumes: %w", err)
+	}
+
+	req := &snapshotRequest{
+		name:      GenerateName(s.namespace, s.tag, lastSeenBlockNum),
+		namespace: s.namespace,
+		pod:       s.pod,
+		tag:       s.tag,
+		blockNum:  lastSeenBlockNum,
+	}
+
+	thaw, err := quiesce(ctx, s.mounts, s.freeze)
+	if err != nil {
+		return "", fmt.Errorf("quiescing filesystems: %w", err)
+	}
+	defer thaw()
+
+	var created []string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		thaw()
+		for _, id := range created {
+			zlog.Info("deleting ebs snapshot of failed group", zap.String("snapshot_id", id), zap.String("group", req.name))
+			if _, deleteErr := s.ec2.DeleteSnapshot(context.Background(), &ec2.DeleteSnapshotInput{SnapshotId: aws.String(id)}); deleteErr != nil {
+				zlog.Error("unable to delete ebs snapshot of failed group", zap.String("snapshot_id", id), zap.Error(deleteErr))
+			}
+		}
+	}()
+
+	for _, vol := range vols {
+		name := GroupMemberName(req.name, vol.volume, len(vols))
+		tags := ebsTags(snapshotLabels(req, &pdDef{claimName: vol.claimName, volume: vol.volume}), name)
+
+		zlog.Info("creating ebs snapshot", zap.String("snapshot", name), zap.String("volume_id", vol.id))
+		var resp *ec2.CreateSnapshotOutput
+		resp, err = s.ec2.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(vol.id),
+			Description: aws.String(fmt.Sprintf("%s of pvc %s", name, vol.claimName)),
+			TagSpecifications: []types.TagSpecification{
+				{ResourceType: types.ResourceTypeSnapshot, Tags: tags},
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("creating snapshot %s of volume %s: %w", name, vol.id, err)
+		}
+		created = append(created, aws.ToString(resp.SnapshotId))
+	}
+	thaw()
+
+	if err = s.waitForSnapshotsCompleted(ctx, created); err != nil {
+		return "", err
+	}
+
+	return req.name, nil
+}
+
+// Restore creates a new EBS volume from each snapshot of the group, in the
+// availability zone of the volume currently used by the pod for the same
+// volume and with the same volume type, IOPS and throughput. The new volumes
+// are tagged with Name `restore-<snapshot>`, swapping them under the pod is
+// the job of the `snapshotter restore` command.
+func (s *EBSSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	vols, err := s.getVolumes(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting ebs volumes: %w", err)
+	}
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		tags := ebsTagMap(member.Tags)
+		name := ebsSnapshotName(member)
+
+		vol := vols[0]
+		if volume := tags[LabelVolume]; volume != "" {
+			if vol = findEBSVolume(vols, volume); vol == nil {
+				return fmt.Errorf("snapshot %s is of volume %q which the pod does not have", name, volume)
+			}
+		}
+
+		current, err := s.describeVolume(ctx, vol.id)
+		if err != nil {
+			return err
+		}
+
+		zone := vol.zone
+		if zone == "" {
+			zone = aws.ToString(current.AvailabilityZone)
+		}
+
+		delete(tags, ebsNameTag)
+		restoreName := RestoreName(name)
+
+		zlog.Info("creating ebs volume from snapshot", zap.String("volume", restoreName), zap.String("snapshot_id", aws.ToString(member.SnapshotId)), zap.String("zone", zone))
+		input := &ec2.CreateVolumeInput{
+			AvailabilityZone: aws.String(zone),
+			SnapshotId:       member.SnapshotId,
+			VolumeType:       current.VolumeType,
+			TagSpecifications: []types.TagSpecification{
+				{ResourceType: types.ResourceTypeVolume, Tags: ebsTags(tags, restoreName)},
+			},
+		}
+		// EC2 rejects the IOPS of the other types, which derive them from
+		// the size, and the throughput of any type but gp3
+		switch current.VolumeType {
+		case types.VolumeTypeIo1, types.VolumeTypeIo2:
+			input.Iops = current.Iops
+		case types.VolumeTypeGp3:
+			input.Iops = current.Iops
+			input.Throughput = current.Throughput
+		}
+
+		resp, err := s.ec2.CreateVolume(ctx, input)
+		if err != nil {
+			return fmt.Errorf("creating volume %s from snapshot %s: %w", restoreName, name, err)
+		}
+
+		if err := s.waitForVolumeAvailable(ctx, aws.ToString(resp.VolumeId)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns one Snapshot per group, listing the volumes it captured.
+func (s *EBSSnapshotter) List() ([]*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	snapshots, err := s.describeSnapshots(ctx, map[string]string{
+		LabelNamespace: s.namespace,
+		LabelTag:       s.tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups snapshotGroups
+	for _, snapshot := range snapshots {
+		tags := ebsTagMap(snapshot.Tags)
+		snap, err := NewSnapshotFromLabels(ebsSnapshotName(snapshot), aws.ToTime(snapshot.StartTime), tags)
+		if err != nil {
+			return nil, err
+		}
+		groups.add(tags[LabelGroup], snap)
+	}
+
+	sortSnapshotsByMostRecent(groups.list)
+	return groups.list, nil
+}
+
+// Delete deletes every snapshot of the group.
+func (s *EBSSnapshotter) Delete(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if _, err := s.ec2.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: member.SnapshotId}); err != nil {
+			return fmt.Errorf("deleting snapshot %s: %w", ebsSnapshotName(member), err)
+		}
+	}
+	return nil
+}
+
+// groupMembers returns the snapshots of the group, or the snapshot of that
+// name.
+func (s *EBSSnapshotter) groupMembers(ctx context.Context, groupName string) ([]types.Snapshot, error) {
+	members, err := s.describeSnapshots(ctx, map[string]string{LabelGroup: groupName})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		if members, err = s.describeSnapshots(ctx, map[string]string{ebsNameTag: groupName}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, fmt.Errorf("cannot find snapshot %q", groupName)
+	}
+	return members, nil
+}
+
+// describeSnapshots returns the snapshots owned by the account having all
+// the given tags.
+func (s *EBSSnapshotter) describeSnapshots(ctx context.Context, tags map[string]string) (out []types.Snapshot, err error) {
+	input := &ec2.DescribeSnapshotsInput{OwnerIds: []string{"self"}}
+	for key, value := range tags {
+		if key != ebsNameTag {
+			value = sanitizeLabelValue(value)
+		}
+		input.Filters = append(input.Filters, types.Filter{Name: aws.String("tag:" + key), Values: []string{value}})
+	}
+
+	paginator := ec2.NewDescribeSnapshotsPaginator(s.ec2, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("describing snapshots: %w", err)
+		}
+		out = append(out, page.Snapshots...)
+	}
+	return out, nil
+}
+
+func (s *EBSSnapshotter) describeVolume(ctx context.Context, volumeID string) (*types.Volume, error) {
+	resp, err := s.ec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: []string{volumeID}})
+	if err != nil {
+		return nil, fmt.Errorf("describing volume %s: %w", volumeID, err)
+	}
+	if len(resp.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found", volumeID)
+	}
+	return &resp.Volumes[0], nil
+}
+
+// waitForSnapshotsCompleted polls the snapshots until they are all
+// completed, returning a *SnapshotFailedError if one ends up in error. EC2
+// being eventually consistent, snapshots not found yet right after their
+// creation are polled again.
+func (s *EBSSnapshotter) waitForSnapshotsCompleted(ctx context.Context, snapshotIDs []string) error {
+	delay := pollInitialDelay
+	for {
+		resp, err := s.ec2.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: snapshotIDs})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidSnapshot.NotFound" {
+			zlog.Debug("ebs snapshots not visible yet", zap.Strings("snapshot_ids", snapshotIDs))
+			resp, err = &ec2.DescribeSnapshotsOutput{}, nil
+		}
+		if err != nil {
+			return fmt.Errorf("describing snapshots: %w", err)
+		}
+
+		completed := 0
+		for _, snapshot := range resp.Snapshots {
+			switch snapshot.State {
+			case types.SnapshotStateCompleted:
+				completed++
+			case types.SnapshotStateError:
+				return &SnapshotFailedError{Snapshot: ebsSnapshotName(snapshot), Reason: aws.ToString(snapshot.StateMessage)}
+			}
+		}
+		if completed == len(snapshotIDs) {
+			return nil
+		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("waiting for snapshots to complete: %w", err)
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+func (s *EBSSnapshotter) waitForVolumeAvailable(ctx context.Context, volumeID string) error {
+	delay := pollInitialDelay
+	for {
+		vol, err := s.describeVolume(ctx, volumeID)
+		if err != nil {
+			return err
+		}
+
+		switch vol.State {
+		case types.VolumeStateAvailable:
+			return nil
+		case types.VolumeStateError:
+			return fmt.Errorf("volume %s is in state error", volumeID)
+		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("waiting for volume %s to be available: %w", volumeID, err)
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+func findEBSVolume(vols []*ebsVolume, volume string) *ebsVolume {
+	for _, vol := range vols {
+		if vol.volume == volume {
+			return vol
+		}
+	}
+	return nil
+}
+
+// ebsTags converts the labels to EC2 tags, adding the Name tag.
+func ebsTags(labels map[string]string, name string) []types.Tag {
+	tags := []types.Tag{{Key: aws.String(ebsNameTag), Value: aws.String(name)}}
+	for key, value := range labels {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return tags
+}
+
+func ebsTagMap(tags []types.Tag) map[string]string {
+	out := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		out[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return out
+}
+
+// ebsSnapshotName returns the Name tag of the snapshot, or its ID when it
+// has none.
+func ebsSnapshotName(snapshot types.Snapshot) string {
+	for _, tag := range snapshot.Tags {
+		if aws.ToString(tag.Key) == ebsNameTag {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return aws.ToString(snapshot.SnapshotId)
+}
@@ -0,0 +1,410 @@
+package snapshotter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeEBSSnapshot struct {
+	id        string
+	volumeID  string
+	state     string
+	startTime time.Time
+	tags      map[string]string
+}
+
+type fakeEBSVolume struct {
+	id         string
+	zone       string
+	volumeType string
+	tags       map[string]string
+}
+
+// fakeEC2 serves the EC2 query API calls of the backend, keeping snapshots
+// and volumes in memory and recording every mutating call.
+type fakeEC2 struct {
+	lock      sync.Mutex
+	snapshots []*fakeEBSSnapshot
+	volumes   map[string]*fakeEBSVolume
+	requests  []string
+	nextID    int
+
+	// notVisible is the number of DescribeSnapshots calls by ID answered
+	// with InvalidSnapshot.NotFound, like right after CreateSnapshot
+	notVisible int
+	// failSnapshotOf fails CreateSnapshot for that volume
+	failSnapshotOf string
+}
+
+func newFakeEC2(t *testing.T) (*fakeEC2, ec2.Options) {
+	api := &fakeEC2{volumes: map[string]*fakeEBSVolume{}}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	return api, ec2.Options{
+		Region:           "us-east-1",
+		Credentials:      aws.AnonymousCredentials{},
+		EndpointResolver: ec2.EndpointResolverFromURL(srv.URL),
+		Retryer:          aws.NopRetryer{},
+	}
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		f.writeError(w, "InvalidParameterValue")
+		return
+	}
+
+	action := r.Form.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	switch action {
+	case "CreateSnapshot":
+		volumeID := r.Form.Get("VolumeId")
+		f.requests = append(f.requests, action+" "+volumeID)
+		if volumeID == f.failSnapshotOf {
+			f.writeError(w, "SnapshotCreationPerVolumeRateExceeded")
+			return
+		}
+
+		f.nextID++
+		snapshot := &fakeEBSSnapshot{
+			id:        fmt.Sprintf("snap-%d", f.nextID),
+			volumeID:  volumeID,
+			state:     "pending",
+			startTime: time.Now().UTC(),
+			tags:      formTags(r, "TagSpecification.1.Tag"),
+		}
+		f.snapshots = append(f.snapshots, snapshot)
+		fmt.Fprintf(w, `<CreateSnapshotResponse><snapshotId>%s</snapshotId><volumeId>%s</volumeId><status>pending</status></CreateSnapshotResponse>`, snapshot.id, volumeID)
+
+	case "DescribeSnapshots":
+		ids := formList(r, "SnapshotId")
+		if len(ids) > 0 && f.notVisible > 0 {
+			f.notVisible--
+			f.writeError(w, "InvalidSnapshot.NotFound")
+			return
+		}
+
+		filters := map[string]string{}
+		for i := 1; r.Form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+			filters[strings.TrimPrefix(r.Form.Get(fmt.Sprintf("Filter.%d.Name", i)), "tag:")] = r.Form.Get(fmt.Sprintf("Filter.%d.Value.1", i))
+		}
+
+		fmt.Fprint(w, `<DescribeSnapshotsResponse><snapshotSet>`)
+	snapshots:
+		for _, snapshot := range f.snapshots {
+			if len(ids) > 0 && !containsString(ids, snapshot.id) {
+				continue
+			}
+			for key, value := range filters {
+				if snapshot.tags[key] != value {
+					continue snapshots
+				}
+			}
+
+			// Listed snapshots are completed by the next describe
+			state := snapshot.state
+			snapshot.state = "completed"
+			fmt.Fprintf(w, `<item><snapshotId>%s</snapshotId><volumeId>%s</volumeId><status>%s</status><startTime>%s</startTime><tagSet>%s</tagSet></item>`,
+				snapshot.id, snapshot.volumeID, state, snapshot.startTime.Format("2006-01-02T15:04:05.000Z"), tagSet(snapshot.tags))
+		}
+		fmt.Fprint(w, `</snapshotSet></DescribeSnapshotsResponse>`)
+
+	case "DeleteSnapshot":
+		id := r.Form.Get("SnapshotId")
+		f.requests = append(f.requests, action+" "+id)
+		for i, snapshot := range f.snapshots {
+			if snapshot.id == id {
+				f.snapshots = append(f.snapshots[:i], f.snapshots[i+1:]...)
+				break
+			}
+		}
+		fmt.Fprint(w, `<DeleteSnapshotResponse><return>true</return></DeleteSnapshotResponse>`)
+
+	case "CreateVolume":
+		volumeType := r.Form.Get("VolumeType")
+		iops, throughput := r.Form.Get("Iops"), r.Form.Get("Throughput")
+		if (iops != "" && volumeType != "io1" && volumeType != "io2" && volumeType != "gp3") || (throughput != "" && volumeType != "gp3") {
+			f.writeError(w, "InvalidParameterCombination")
+			return
+		}
+
+		f.nextID++
+		volume := &fakeEBSVolume{
+			id:         fmt.Sprintf("vol-%d", f.nextID),
+			zone:       r.Form.Get("AvailabilityZone"),
+			volumeType: volumeType,
+			tags:       formTags(r, "TagSpecification.1.Tag"),
+		}
+		f.volumes[volume.id] = volume
+		f.requests = append(f.requests, fmt.Sprintf("%s %s %s %s %s iops=%s throughput=%s", action, r.Form.Get("SnapshotId"), volume.zone, volume.tags[ebsNameTag], volumeType, iops, throughput))
+		fmt.Fprintf(w, `<CreateVolumeResponse><volumeId>%s</volumeId><availabilityZone>%s</availabilityZone><status>creating</status></CreateVolumeResponse>`, volume.id, volume.zone)
+
+	case "DescribeVolumes":
+		fmt.Fprint(w, `<DescribeVolumesResponse><volumeSet>`)
+		for _, id := range formList(r, "VolumeId") {
+			if volume, found := f.volumes[id]; found {
+				fmt.Fprintf(w, `<item><volumeId>%s</volumeId><availabilityZone>%s</availabilityZone><status>available</status><volumeType>%s</volumeType>`, volume.id, volume.zone, volume.volumeType)
+				switch volume.volumeType {
+				case "gp3":
+					fmt.Fprint(w, `<iops>3000</iops><throughput>125</throughput>`)
+				case "gp2":
+					// gp2 volumes report the IOPS derived from their size
+					fmt.Fprint(w, `<iops>300</iops>`)
+				}
+				fmt.Fprint(w, `</item>`)
+			}
+		}
+		fmt.Fprint(w, `</volumeSet></DescribeVolumesResponse>`)
+
+	default:
+		f.writeError(w, "InvalidAction")
+	}
+}
+
+func (f *fakeEC2) writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>fake error</Message></Error></Errors><RequestID>1</RequestID></Response>`, code)
+}
+
+func formList(r *http.Request, prefix string) (out []string) {
+	for i := 1; r.Form.Get(prefix+"."+strconv.Itoa(i)) != ""; i++ {
+		out = append(out, r.Form.Get(prefix+"."+strconv.Itoa(i)))
+	}
+	return out
+}
+
+func formTags(r *http.Request, prefix string) map[string]string {
+	out := map[string]string{}
+	for i := 1; r.Form.Get(fmt.Sprintf("%s.%d.Key", prefix, i)) != ""; i++ {
+		out[r.Form.Get(fmt.Sprintf("%s.%d.Key", prefix, i))] = r.Form.Get(fmt.Sprintf("%s.%d.Value", prefix, i))
+	}
+	return out
+}
+
+func tagSet(tags map[string]string) string {
+	out := ""
+	for key, value := range tags {
+		out += fmt.Sprintf("<item><key>%s</key><value>%s</value></item>", key, value)
+	}
+	return out
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// newEBSTestClientset returns the pod `node-0` with a `datadir` and a
+// `state` PVC, bound to the EBS volumes vol-datadir and vol-state, the PVs
+// being pinned to `pvZone` when set.
+func newEBSTestClientset(pvZone string) *fake.Clientset {
+	var objects []runtime.Object
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "node-0", Namespace: "default"}}
+	for _, volume := range []string{"datadir", "state"} {
+		claimName := volume + "-node-0"
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         volume,
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+		})
+
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-" + volume},
+			Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: EBSCSIDriver, VolumeHandle: "vol-" + volume},
+			}},
+		}
+		if pvZone != "" {
+			pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{Required: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "topology.ebs.csi.aws.com/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{pvZone}}},
+			}}}}
+		}
+
+		objects = append(objects, pv, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: claimName, Namespace: "default"},
+			Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: pv.Name},
+		})
+	}
+
+	return fake.NewSimpleClientset(append(objects, pod)...)
+}
+
+func newTestEBSSnapshotter(t *testing.T, api *fakeEC2, options ec2.Options, pvZone, volumeType string) *EBSSnapshotter {
+	t.Setenv("HOSTNAME", "node-0")
+
+	for _, volume := range []string{"datadir", "state"} {
+		api.volumes["vol-"+volume] = &fakeEBSVolume{id: "vol-" + volume, zone: "us-east-1a", volumeType: volumeType}
+	}
+
+	s, err := NewEBSSnapshotterWithClients(map[string]string{
+		"tag":       "v1",
+		"namespace": "default",
+		"pvcs":      "datadir,state",
+	}, ec2.New(options), newEBSTestClientset(pvZone))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEBSSnapshotterBackup(t *testing.T) {
+	tests := []struct {
+		name           string
+		notVisible     int
+		failSnapshotOf string
+		wantErr        string
+		wantRequests   []string
+		wantSnapshots  int
+	}{
+		{
+			name:          "group",
+			wantRequests:  []string{"CreateSnapshot vol-datadir", "CreateSnapshot vol-state"},
+			wantSnapshots: 2,
+		},
+		{
+			name:          "snapshots not visible yet",
+			notVisible:    1,
+			wantRequests:  []string{"CreateSnapshot vol-datadir", "CreateSnapshot vol-state"},
+			wantSnapshots: 2,
+		},
+		{
+			name:           "rolled back",
+			failSnapshotOf: "vol-state",
+			wantErr:        "creating snapshot default-v1-0000000100-state of volume vol-state",
+			wantRequests:   []string{"CreateSnapshot vol-datadir", "CreateSnapshot vol-state", "DeleteSnapshot snap-1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, options := newFakeEC2(t)
+			api.notVisible = test.notVisible
+			api.failSnapshotOf = test.failSnapshotOf
+			s := newTestEBSSnapshotter(t, api, options, "", "gp3")
+
+			snapshotName, err := s.Backup(100)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("backup error %v, want %q", err, test.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("backup: %s", err)
+				}
+				if snapshotName != "default-v1-0000000100" {
+					t.Errorf("snapshot name %q, want the group name", snapshotName)
+				}
+			}
+
+			if strings.Join(api.requests, "\n") != strings.Join(test.wantRequests, "\n") {
+				t.Errorf("requests %q, want %q", api.requests, test.wantRequests)
+			}
+			if len(api.snapshots) != test.wantSnapshots {
+				t.Fatalf("%d snapshots left, want %d", len(api.snapshots), test.wantSnapshots)
+			}
+			for _, snapshot := range api.snapshots {
+				if snapshot.tags[LabelGroup] != "default-v1-0000000100" || snapshot.tags[ebsNameTag] != "default-v1-0000000100-"+snapshot.tags[LabelVolume] {
+					t.Errorf("snapshot %s has tags %v", snapshot.id, snapshot.tags)
+				}
+			}
+		})
+	}
+}
+
+func TestEBSSnapshotterList(t *testing.T) {
+	api, options := newFakeEC2(t)
+	s := newTestEBSSnapshotter(t, api, options, "", "gp3")
+
+	tags := func(group, name, volume, blockNum string) map[string]string {
+		out := map[string]string{ebsNameTag: name, LabelNamespace: "default", LabelTag: "v1", LabelBlockNum: blockNum, LabelVolume: volume}
+		if group != "" {
+			out[LabelGroup] = group
+		}
+		return out
+	}
+	now := time.Now().UTC()
+	api.snapshots = []*fakeEBSSnapshot{
+		{id: "snap-1", state: "completed", startTime: now.Add(-2 * time.Hour), tags: tags("", "default-v1-0000000050", "", "50")},
+		{id: "snap-2", state: "completed", startTime: now.Add(-time.Hour), tags: tags("default-v1-0000000100", "default-v1-0000000100-datadir", "datadir", "100")},
+		{id: "snap-3", state: "completed", startTime: now.Add(-time.Hour), tags: tags("default-v1-0000000100", "default-v1-0000000100-state", "state", "100")},
+		{id: "snap-4", state: "completed", startTime: now, tags: map[string]string{ebsNameTag: "other", LabelNamespace: "other", LabelTag: "v1"}},
+	}
+
+	snapshots, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, snapshot := range snapshots {
+		volumes := append([]string{}, snapshot.Volumes...)
+		sort.Strings(volumes)
+		got = append(got, fmt.Sprintf("%s@%d%v", snapshot.Name, snapshot.BlockNum, volumes))
+	}
+	want := []string{"default-v1-0000000100@100[datadir state]", "default-v1-0000000050@50[]"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("list %q, want %q", got, want)
+	}
+}
+
+func TestEBSSnapshotterRestore(t *testing.T) {
+	tests := []struct {
+		name       string
+		pvZone     string
+		volumeType string
+		wantZone   string
+		wantParams string
+	}{
+		{name: "zone of the pv", pvZone: "us-east-1b", volumeType: "gp3", wantZone: "us-east-1b", wantParams: "gp3 iops=3000 throughput=125"},
+		{name: "zone of the current volume", volumeType: "gp3", wantZone: "us-east-1a", wantParams: "gp3 iops=3000 throughput=125"},
+		{name: "gp2", volumeType: "gp2", wantZone: "us-east-1a", wantParams: "gp2 iops= throughput="},
+		{name: "st1", volumeType: "st1", wantZone: "us-east-1a", wantParams: "st1 iops= throughput="},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, options := newFakeEC2(t)
+			s := newTestEBSSnapshotter(t, api, options, test.pvZone, test.volumeType)
+
+			snapshotName, err := s.Backup(100)
+			if err != nil {
+				t.Fatalf("backup: %s", err)
+			}
+			api.requests = nil
+
+			if err := s.Restore(snapshotName); err != nil {
+				t.Fatalf("restore: %s", err)
+			}
+
+			sort.Strings(api.requests)
+			want := []string{
+				"CreateVolume snap-1 " + test.wantZone + " restore-default-v1-0000000100-datadir " + test.wantParams,
+				"CreateVolume snap-2 " + test.wantZone + " restore-default-v1-0000000100-state " + test.wantParams,
+			}
+			if strings.Join(api.requests, "\n") != strings.Join(want, "\n") {
+				t.Errorf("requests %q, want %q", api.requests, want)
+			}
+		})
+	}
+}
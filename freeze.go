@@ -0,0 +1,149 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Freeze methods accepted by the `freeze` config key.
+const (
+	FreezeIoctl    = "ioctl"
+	FreezeFsfreeze = "fsfreeze"
+	FreezeOff      = "off"
+)
+
+// parseFreezeConfig reads the `mounts` and `freeze` keys of the config of
+// backup module `module`, freeze defaulting to FreezeIoctl.
+func parseFreezeConfig(module string, conf map[string]string) (mounts []string, method string, err error) {
+	if conf["mounts"] != "" {
+		mounts = strings.Split(conf["mounts"], ",")
+	}
+
+	method = conf["freeze"]
+	switch method {
+	case "":
+		method = FreezeIoctl
+	case FreezeIoctl, FreezeFsfreeze, FreezeOff:
+	default:
+		return nil, "", fmt.Errorf("backup module %s invalid value %q for freeze, valid values are %s, %s and %s", module, method, FreezeIoctl, FreezeFsfreeze, FreezeOff)
+	}
+
+	return mounts, method, nil
+}
+
+// errFreezeNotAllowed is returned by the freeze implementations when the
+// process lacks the permission (CAP_SYS_ADMIN) or the filesystem or platform
+// does not support freezing.
+var errFreezeNotAllowed = errors.New("filesystem freeze not allowed")
+
+// quiesce makes the content of the mounts consistent on disk until the
+// returned thaw function is called. It freezes the mounts with the given
+// method and, when freezing is off or not allowed, falls back to a sync
+// that completes before quiesce returns. thaw is idempotent and must be
+// called on every path.
+func quiesce(ctx context.Context, mounts []string, method string) (thaw func(), err error) {
+	noop := func() {}
+
+	if len(mounts) == 0 || method == FreezeOff {
+		return noop, syncFilesystems(ctx, mounts)
+	}
+
+	var frozen []string
+	thawAll := func() {
+		for i := len(frozen) - 1; i >= 0; i-- {
+			if err := thawFilesystem(method, frozen[i]); err != nil {
+				zlog.Error("unable to thaw filesystem", zap.String("mount", frozen[i]), zap.Error(err))
+				continue
+			}
+			zlog.Info("filesystem thawed", zap.String("mount", frozen[i]))
+		}
+	}
+
+	for _, mount := range mounts {
+		err := freezeFilesystem(ctx, method, mount)
+		if errors.Is(err, errFreezeNotAllowed) {
+			thawAll()
+			zlog.Warn("filesystem freeze not allowed, falling back to sync", zap.String("mount", mount), zap.Error(err))
+			return noop, syncFilesystems(ctx, mounts)
+		}
+		if err != nil {
+			thawAll()
+			return noop, fmt.Errorf("freezing %s: %w", mount, err)
+		}
+
+		zlog.Info("filesystem frozen", zap.String("mount", mount))
+		frozen = append(frozen, mount)
+	}
+
+	var once sync.Once
+	return func() { once.Do(thawAll) }, nil
+}
+
+func freezeFilesystem(ctx context.Context, method, mount string) error {
+	switch method {
+	case FreezeIoctl, "":
+		return ioctlFreeze(mount)
+	case FreezeFsfreeze:
+		return runFsfreeze(ctx, "--freeze", mount)
+	}
+	return fmt.Errorf("unknown freeze method %q, valid methods are %s, %s and %s", method, FreezeIoctl, FreezeFsfreeze, FreezeOff)
+}
+
+// thawFilesystem does not use the backup context which may be the reason
+// we are thawing.
+func thawFilesystem(method, mount string) error {
+	if method == FreezeFsfreeze {
+		return runFsfreeze(context.Background(), "--unfreeze", mount)
+	}
+	return ioctlThaw(mount)
+}
+
+// fsfreezeCommand is the fsfreeze binary run by the fsfreeze method.
+var fsfreezeCommand = "fsfreeze"
+
+// fsfreezeNotAllowed are the messages of the errors mapped to
+// errFreezeNotAllowed, fsfreeze exits with 1 on every error so its output
+// tells EPERM and EOPNOTSUPP apart from a busy or missing mount.
+var fsfreezeNotAllowed = []string{"Operation not permitted", "Operation not supported"}
+
+func runFsfreeze(ctx context.Context, flag, mount string) error {
+	cmd := exec.CommandContext(ctx, fsfreezeCommand, flag, mount)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && flag == "--freeze" {
+		for _, message := range fsfreezeNotAllowed {
+			if strings.Contains(string(output), message) {
+				return fmt.Errorf("%w: fsfreeze: %s", errFreezeNotAllowed, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+	return fmt.Errorf("fsfreeze %s %s: %s: %w", flag, mount, strings.TrimSpace(string(output)), err)
+}
+
+// syncFilesystems flushes the mounts, or every filesystem when none is
+// given, and waits for the flush to complete.
+func syncFilesystems(ctx context.Context, mounts []string) error {
+	if len(mounts) == 0 {
+		if err := exec.CommandContext(ctx, "/bin/sync").Run(); err != nil {
+			return fmt.Errorf("/bin/sync: %w", err)
+		}
+		return nil
+	}
+
+	for _, mount := range mounts {
+		if err := syncFilesystem(ctx, mount); err != nil {
+			return fmt.Errorf("syncing %s: %w", mount, err)
+		}
+	}
+	return nil
+}
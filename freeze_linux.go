@@ -0,0 +1,51 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/fs.h, _IOWR('X', 119, int) and _IOWR('X', 120, int)
+const (
+	ioctlFIFREEZE = 0xc0045877
+	ioctlFITHAW   = 0xc0045878
+)
+
+func ioctlFreeze(mount string) error {
+	err := ioctlMount(mount, ioctlFIFREEZE)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("%w: %s", errFreezeNotAllowed, err)
+	}
+	return err
+}
+
+func ioctlThaw(mount string) error {
+	return ioctlMount(mount, ioctlFITHAW)
+}
+
+func ioctlMount(mount string, request uintptr) error {
+	f, err := os.Open(mount)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), request, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func syncFilesystem(_ context.Context, mount string) error {
+	f, err := os.Open(mount)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return unix.Syncfs(int(f.Fd()))
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func ioctlFreeze(mount string) error {
+	return fmt.Errorf("%w: no FIFREEZE ioctl on %s", errFreezeNotAllowed, runtime.GOOS)
+}
+
+func ioctlThaw(mount string) error {
+	return fmt.Errorf("no FITHAW ioctl on %s", runtime.GOOS)
+}
+
+func syncFilesystem(ctx context.Context, _ string) error {
+	return exec.CommandContext(ctx, "/bin/sync").Run()
+}
@@ -0,0 +1,134 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// stubFsfreeze replaces the fsfreeze binary with a script printing `output`
+// and exiting with `status`.
+func stubFsfreeze(t *testing.T, output string, status string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fsfreeze stub is a shell script")
+	}
+
+	script := filepath.Join(t.TempDir(), "fsfreeze")
+	content := "#!/bin/sh\necho '" + output + "' >&2\nexit " + status + "\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := fsfreezeCommand
+	fsfreezeCommand = script
+	t.Cleanup(func() { fsfreezeCommand = previous })
+}
+
+func TestRunFsfreeze(t *testing.T) {
+	tests := []struct {
+		name           string
+		flag           string
+		output         string
+		status         string
+		wantErr        string
+		wantNotAllowed bool
+	}{
+		{name: "frozen", flag: "--freeze", status: "0"},
+		{
+			name:           "not permitted",
+			flag:           "--freeze",
+			output:         "fsfreeze: /data: freeze failed: Operation not permitted",
+			status:         "1",
+			wantErr:        "Operation not permitted",
+			wantNotAllowed: true,
+		},
+		{
+			name:           "not supported",
+			flag:           "--freeze",
+			output:         "fsfreeze: /data: freeze failed: Operation not supported",
+			status:         "1",
+			wantErr:        "Operation not supported",
+			wantNotAllowed: true,
+		},
+		{
+			name:    "busy",
+			flag:    "--freeze",
+			output:  "fsfreeze: /data: freeze failed: Device or resource busy",
+			status:  "1",
+			wantErr: "fsfreeze --freeze /data: fsfreeze: /data: freeze failed: Device or resource busy: exit status 1",
+		},
+		{
+			name:    "missing mount",
+			flag:    "--freeze",
+			output:  "fsfreeze: cannot open /data: No such file or directory",
+			status:  "1",
+			wantErr: "No such file or directory",
+		},
+		{
+			name:    "unfreeze not permitted",
+			flag:    "--unfreeze",
+			output:  "fsfreeze: /data: unfreeze failed: Operation not permitted",
+			status:  "1",
+			wantErr: "fsfreeze --unfreeze /data",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stubFsfreeze(t, test.output, test.status)
+
+			err := runFsfreeze(context.Background(), test.flag, "/data")
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error %v, want %q", err, test.wantErr)
+			}
+			if notAllowed := errors.Is(err, errFreezeNotAllowed); notAllowed != test.wantNotAllowed {
+				t.Errorf("error %q is errFreezeNotAllowed %t, want %t", err, notAllowed, test.wantNotAllowed)
+			}
+		})
+	}
+
+	t.Run("missing binary", func(t *testing.T) {
+		previous := fsfreezeCommand
+		fsfreezeCommand = filepath.Join(t.TempDir(), "fsfreeze")
+		defer func() { fsfreezeCommand = previous }()
+
+		err := runFsfreeze(context.Background(), "--freeze", "/data")
+		if err == nil || errors.Is(err, errFreezeNotAllowed) {
+			t.Errorf("error %v, want a failure other than errFreezeNotAllowed", err)
+		}
+	})
+}
+
+func TestQuiesceFsfreeze(t *testing.T) {
+	mount := t.TempDir()
+
+	t.Run("falls back to sync when not allowed", func(t *testing.T) {
+		stubFsfreeze(t, "fsfreeze: freeze failed: Operation not permitted", "1")
+
+		thaw, err := quiesce(context.Background(), []string{mount}, FreezeFsfreeze)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		thaw()
+	})
+
+	t.Run("fails on other errors", func(t *testing.T) {
+		stubFsfreeze(t, "fsfreeze: freeze failed: Device or resource busy", "1")
+
+		thaw, err := quiesce(context.Background(), []string{mount}, FreezeFsfreeze)
+		if err == nil || !strings.Contains(err.Error(), "freezing "+mount) {
+			t.Fatalf("error %v, want the freeze failure", err)
+		}
+		thaw()
+	})
+}
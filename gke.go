@@ -0,0 +1,235 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func init() {
+	Register("gke-pvc-snapshot", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewGKEPVCSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+type GKEPVCSnapshotter struct {
+	tag       string
+	project   string
+	namespace string
+	pod       string
+	volumes   volumeSelector
+	mounts    []string
+	freeze    string
+	archive   bool
+	waitReady bool
+	timeout   time.Duration
+}
+
+// gkeExampleConfigString lists the required keys, the optional ones are
+// described in the README.
+var gkeExampleConfigString = "type=gke-pvc-snapshot tag=v1 namespace=default project=mygcpproject prefix=datadir archive=true"
+
+func NewGKEPVCSnapshotter(conf map[string]string) (*GKEPVCSnapshotter, error) {
+	required := []string{"tag", "project", "namespace", "prefix", "archive"}
+	if conf["pvcs"] != "" {
+		required = []string{"tag", "project", "namespace", "archive"}
+	}
+
+	for _, label := range required {
+		if err := gkeCheckMissing(conf, label); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := 5 * time.Minute
+	if conf["timeout"] != "" {
+		var err error
+		if timeout, err = time.ParseDuration(conf["timeout"]); err != nil {
+			return nil, fmt.Errorf("backup module gke-pvc-snapshot invalid value for timeout: %w", err)
+		}
+	}
+
+	mounts, freeze, err := parseFreezeConfig("gke-pvc-snapshot", conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GKEPVCSnapshotter{
+		tag:       conf["tag"],
+		project:   conf["project"],
+		namespace: conf["namespace"],
+		pod:       os.Getenv("HOSTNAME"),
+		volumes:   parseVolumeSelector(conf),
+		mounts:    mounts,
+		freeze:    freeze,
+		archive:   conf["archive"] == "true",
+		waitReady: conf["wait-ready"] == "true",
+		timeout:   timeout,
+	}, nil
+}
+
+func (s *GKEPVCSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// Backup snapshots every selected PVC of the pod as one group, the returned
+// name is the group name shared by all the snapshots.
+func (s *GKEPVCSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	snapshotName := GenerateName(s.namespace, s.tag, lastSeenBlockNum)
+	err := takeSnapshot(ctx, &snapshotRequest{
+		name:      snapshotName,
+		project:   s.project,
+		namespace: s.namespace,
+		pod:       s.pod,
+		volumes:   s.volumes,
+		mounts:    s.mounts,
+		freeze:    s.freeze,
+		archive:   s.archive,
+		tag:       s.tag,
+		blockNum:  lastSeenBlockNum,
+		waitReady: s.waitReady,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return snapshotName, nil
+}
+
+// Restore creates a new persistent disk from each snapshot of the group, in
+// the zone (or region) of the disk currently used by the pod for the same
+// volume. The pod cannot detach its own disks, swapping the new disks under
+// the pod is the job of the `snapshotter restore` command.
+func (s *GKEPVCSnapshotter) Restore(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	pds, err := getPersistentDisks(ctx, s.pod, s.namespace, s.volumes)
+	if err != nil {
+		return fmt.Errorf("error getting persistent disk: %w", err)
+	}
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		pd := pds[0]
+		if volume := member.Labels[LabelVolume]; volume != "" {
+			if pd = findVolume(pds, volume); pd == nil {
+				return fmt.Errorf("snapshot %s is of volume %q which the pod does not have", member.Name, volume)
+			}
+		}
+
+		if _, err := insertDiskFromSnapshot(ctx, zlog, s.project, member, RestoreName(member.Name), pd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns one Snapshot per group, listing the volumes it captured.
+func (s *GKEPVCSnapshotter) List() (out []*Snapshot, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	snapshots, err := listSnapshots(ctx, s.project, LabelFilter(map[string]string{
+		LabelNamespace: s.namespace,
+		LabelTag:       s.tag,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups snapshotGroups
+	for _, snapshot := range snapshots {
+		snap, err := newSnapshotFromCompute(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		groups.add(snapshot.Labels[LabelGroup], snap)
+	}
+
+	out = groups.list
+	sortSnapshotsByMostRecent(out)
+	return
+}
+
+// Delete deletes every snapshot of the group.
+func (s *GKEPVCSnapshotter) Delete(snapshotName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	members, err := s.groupMembers(ctx, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if err := deleteSnapshot(ctx, s.project, member.Name); err != nil {
+			return fmt.Errorf("deleting snapshot %s: %w", member.Name, err)
+		}
+	}
+	return nil
+}
+
+// groupMembers returns the snapshots of the group, or the snapshot itself
+// when it was taken before groups existed.
+func (s *GKEPVCSnapshotter) groupMembers(ctx context.Context, groupName string) ([]*compute.Snapshot, error) {
+	members, err := listSnapshots(ctx, s.project, LabelFilter(map[string]string{LabelGroup: groupName}))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) > 0 {
+		return members, nil
+	}
+
+	service, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := service.Snapshots.Get(s.project, groupName).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting snapshot %q: %w", groupName, err)
+	}
+	return []*compute.Snapshot{snapshot}, nil
+}
+
+func findVolume(pds []*pdDef, volume string) *pdDef {
+	for _, pd := range pds {
+		if pd.volume == volume {
+			return pd
+		}
+	}
+	return nil
+}
+
+func gkeCheckMissing(conf map[string]string, param string) error {
+	if conf[param] == "" {
+		return fmt.Errorf("backup module gke-pvc-snapshot missing value for %s. Example: %s", param, gkeExampleConfigString)
+	}
+	return nil
+}
+
+func newSnapshotFromCompute(snapshot *compute.Snapshot) (*Snapshot, error) {
+	createdAt, err := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid creation timestamp %q for snapshot %q: %w", snapshot.CreationTimestamp, snapshot.Name, err)
+	}
+
+	return NewSnapshotFromLabels(snapshot.Name, createdAt, snapshot.Labels)
+}
@@ -0,0 +1,330 @@
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Hook phases
+const (
+	HookPre  = "pre"
+	HookPost = "post"
+)
+
+// Hook failure policies, see Hooks.OnFailure
+const (
+	HookAbort    = "abort"
+	HookContinue = "continue"
+)
+
+// HookEvent describes the backup a hook runs for. SnapshotName and Err are
+// only set for post hooks, Err being the error Backup failed with, if any.
+type HookEvent struct {
+	Phase        string `json:"phase"`
+	BlockNum     uint32 `json:"block_num"`
+	SnapshotName string `json:"snapshot_name,omitempty"`
+	Err          error  `json:"-"`
+}
+
+// Hook is run before or after Backup.
+type Hook interface {
+	Run(ctx context.Context, event *HookEvent) error
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(ctx context.Context, event *HookEvent) error
+
+func (f HookFunc) Run(ctx context.Context, event *HookEvent) error {
+	return f(ctx, event)
+}
+
+var hookRegistry = map[string]Hook{}
+var hookRegistryLock sync.RWMutex
+
+// RegisterHook makes a Go hook available to the `pre-hook` and `post-hook`
+// config keys as `go:<name>`.
+func RegisterHook(name string, hook Hook) {
+	hookRegistryLock.Lock()
+	defer hookRegistryLock.Unlock()
+
+	hookRegistry[name] = hook
+}
+
+// Hooks are run around Backup. Post hooks run as soon as pre hooks started,
+// even when a pre hook or the backup failed, so they can undo what pre hooks
+// did (like resuming ingestion).
+type Hooks struct {
+	Pre  []Hook
+	Post []Hook
+
+	// Timeout of each hook run, defaults to 1 minute
+	Timeout time.Duration
+	// OnFailure is HookAbort (default) to fail the backup when a hook fails,
+	// or HookContinue to log the failure and go on.
+	OnFailure string
+}
+
+// HookError is returned by Backup when a hook failed with the HookAbort
+// policy. SnapshotName is set when a post hook failed, the snapshot was
+// taken in this case.
+type HookError struct {
+	Phase        string
+	Hook         string
+	SnapshotName string
+	Err          error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook %s failed: %s", e.Phase, e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// ParseHooks reads the `pre-hook`, `post-hook`, `hook-timeout` and
+// `hook-failure` keys of a snapshotter config. Hooks are `;` separated and
+// each one is either:
+//
+//   - `exec:<command>[,<arg>...]` runs the command, arguments are `,`
+//     separated and URL unescaped (use `%20` for a space). The command gets
+//     the SNAPSHOTTER_PHASE, SNAPSHOTTER_BLOCK_NUM, SNAPSHOTTER_SNAPSHOT_NAME
+//     and SNAPSHOTTER_ERROR environment variables.
+//   - `http://...` or `https://...` POSTs the event as JSON to the URL, any
+//     status other than 2xx is a failure.
+//   - `go:<name>` runs the Go hook registered under that name with RegisterHook.
+func ParseHooks(conf map[string]string) (*Hooks, error) {
+	hooks := &Hooks{Timeout: time.Minute, OnFailure: HookAbort}
+
+	var err error
+	if hooks.Pre, err = parseHookList(conf["pre-hook"]); err != nil {
+		return nil, fmt.Errorf("invalid pre-hook: %w", err)
+	}
+	if hooks.Post, err = parseHookList(conf["post-hook"]); err != nil {
+		return nil, fmt.Errorf("invalid post-hook: %w", err)
+	}
+
+	if conf["hook-timeout"] != "" {
+		if hooks.Timeout, err = time.ParseDuration(conf["hook-timeout"]); err != nil {
+			return nil, fmt.Errorf("invalid hook-timeout: %w", err)
+		}
+	}
+
+	switch conf["hook-failure"] {
+	case "":
+	case HookAbort, HookContinue:
+		hooks.OnFailure = conf["hook-failure"]
+	default:
+		return nil, fmt.Errorf("invalid hook-failure %q, valid values are %s and %s", conf["hook-failure"], HookAbort, HookContinue)
+	}
+
+	return hooks, nil
+}
+
+// IsEmpty returns true when there is no hook to run.
+func (h *Hooks) IsEmpty() bool {
+	return len(h.Pre) == 0 && len(h.Post) == 0
+}
+
+func parseHookList(spec string) (out []Hook, err error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		hook, err := parseHook(entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hook)
+	}
+	return out, nil
+}
+
+func parseHook(spec string) (Hook, error) {
+	switch {
+	case strings.HasPrefix(spec, "exec:"):
+		var args []string
+		for _, arg := range strings.Split(strings.TrimPrefix(spec, "exec:"), ",") {
+			unescaped, err := url.PathUnescape(arg)
+			if err != nil {
+				return nil, fmt.Errorf("hook %q: %w", spec, err)
+			}
+			args = append(args, unescaped)
+		}
+		if args[0] == "" {
+			return nil, fmt.Errorf("hook %q has no command", spec)
+		}
+		return &execHook{args: args}, nil
+
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		if _, err := url.Parse(spec); err != nil {
+			return nil, fmt.Errorf("hook %q: %w", spec, err)
+		}
+		return &httpHook{url: spec}, nil
+
+	case strings.HasPrefix(spec, "go:"):
+		name := strings.TrimPrefix(spec, "go:")
+
+		hookRegistryLock.RLock()
+		defer hookRegistryLock.RUnlock()
+		hook, found := hookRegistry[name]
+		if !found {
+			return nil, fmt.Errorf("no Go hook registered under %q", name)
+		}
+		return &namedHook{name: spec, Hook: hook}, nil
+	}
+
+	return nil, fmt.Errorf("hook %q must start with exec:, http://, https:// or go:", spec)
+}
+
+type execHook struct {
+	args []string
+}
+
+func (h *execHook) String() string {
+	return "exec:" + strings.Join(h.args, " ")
+}
+
+func (h *execHook) Run(ctx context.Context, event *HookEvent) error {
+	cmd := exec.CommandContext(ctx, h.args[0], h.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SNAPSHOTTER_PHASE="+event.Phase,
+		"SNAPSHOTTER_BLOCK_NUM="+strconv.FormatUint(uint64(event.BlockNum), 10),
+		"SNAPSHOTTER_SNAPSHOT_NAME="+event.SnapshotName,
+	)
+	if event.Err != nil {
+		cmd.Env = append(cmd.Env, "SNAPSHOTTER_ERROR="+event.Err.Error())
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+type httpHook struct {
+	url string
+}
+
+func (h *httpHook) String() string {
+	return h.url
+}
+
+func (h *httpHook) Run(ctx context.Context, event *HookEvent) error {
+	body := struct {
+		*HookEvent
+		Error string `json:"error,omitempty"`
+	}{HookEvent: event}
+	if event.Err != nil {
+		body.Error = event.Err.Error()
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+type namedHook struct {
+	Hook
+	name string
+}
+
+func (h *namedHook) String() string {
+	return h.name
+}
+
+// run runs the hooks of a phase in order. With the HookAbort policy, it
+// stops at the first failure and returns it as a *HookError.
+func (h *Hooks) run(hooks []Hook, event *HookEvent) error {
+	for _, hook := range hooks {
+		name := fmt.Sprintf("%v", hook)
+		zlog.Info("running snapshot hook", zap.String("phase", event.Phase), zap.String("hook", name))
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+		err := hook.Run(ctx, event)
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		if h.OnFailure == HookContinue {
+			zlog.Warn("snapshot hook failed, continuing", zap.String("phase", event.Phase), zap.String("hook", name), zap.Error(err))
+			continue
+		}
+		return &HookError{Phase: event.Phase, Hook: name, SnapshotName: event.SnapshotName, Err: err}
+	}
+	return nil
+}
+
+// hookedSnapshotter runs its hooks around Backup.
+type hookedSnapshotter struct {
+	Snapshotter
+	hooks *Hooks
+}
+
+// WithHooks wraps the backend so the hooks run around each Backup. When only
+// a post hook fails, Backup returns the name of the snapshot it took along
+// with the *HookError. The hooks are copied, `hooks` is left untouched.
+func WithHooks(s Snapshotter, hooks *Hooks) Snapshotter {
+	copied := *hooks
+	if copied.Timeout == 0 {
+		copied.Timeout = time.Minute
+	}
+	if copied.OnFailure == "" {
+		copied.OnFailure = HookAbort
+	}
+	return &hookedSnapshotter{Snapshotter: s, hooks: &copied}
+}
+
+func (s *hookedSnapshotter) Backup(lastSeenBlockNum uint32) (snapshotName string, err error) {
+	err = s.hooks.run(s.hooks.Pre, &HookEvent{Phase: HookPre, BlockNum: lastSeenBlockNum})
+	if err == nil {
+		snapshotName, err = s.Snapshotter.Backup(lastSeenBlockNum)
+	}
+
+	postErr := s.hooks.run(s.hooks.Post, &HookEvent{Phase: HookPost, BlockNum: lastSeenBlockNum, SnapshotName: snapshotName, Err: err})
+	if err != nil {
+		if postErr != nil {
+			zlog.Warn("post snapshot hook failed after a failed backup", zap.Error(postErr))
+		}
+		return "", err
+	}
+
+	if postErr != nil {
+		return snapshotName, postErr
+	}
+
+	return snapshotName, nil
+}
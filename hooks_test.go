@@ -0,0 +1,123 @@
+package snapshotter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseHookExecArgs(t *testing.T) {
+	tests := []struct {
+		spec     string
+		wantArgs []string
+	}{
+		{spec: "exec:/usr/local/bin/flush", wantArgs: []string{"/usr/local/bin/flush"}},
+		{spec: "exec:/usr/local/bin/flush,--all,--wait", wantArgs: []string{"/usr/local/bin/flush", "--all", "--wait"}},
+		{spec: "exec:/bin/echo,hello%20world", wantArgs: []string{"/bin/echo", "hello world"}},
+		{spec: "exec:/bin/echo,a+b", wantArgs: []string{"/bin/echo", "a+b"}},
+		{spec: "exec:/bin/echo,a%2Cb", wantArgs: []string{"/bin/echo", "a,b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			hook, err := parseHook(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if args := hook.(*execHook).args; !reflect.DeepEqual(args, test.wantArgs) {
+				t.Errorf("args %q, want %q", args, test.wantArgs)
+			}
+		})
+	}
+}
+
+type fakeBackupSnapshotter struct {
+	Snapshotter
+	err error
+}
+
+func (s *fakeBackupSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	return GenerateName("default", "v1", lastSeenBlockNum), nil
+}
+
+func TestHookedSnapshotterBackup(t *testing.T) {
+	failing := HookFunc(func(ctx context.Context, event *HookEvent) error {
+		return errors.New("hook failed")
+	})
+	backupErr := errors.New("backup failed")
+
+	tests := []struct {
+		name      string
+		hooks     *Hooks
+		backupErr error
+		wantName  string
+		wantPhase string
+		wantErr   error
+	}{
+		{
+			name:     "no failure",
+			hooks:    &Hooks{},
+			wantName: "default-v1-0000000100",
+		},
+		{
+			name:      "pre hook failure",
+			hooks:     &Hooks{Pre: []Hook{failing}},
+			wantPhase: HookPre,
+		},
+		{
+			name:      "post hook failure",
+			hooks:     &Hooks{Post: []Hook{failing}},
+			wantName:  "default-v1-0000000100",
+			wantPhase: HookPost,
+		},
+		{
+			name:      "backup and post hook failure",
+			hooks:     &Hooks{Post: []Hook{failing}},
+			backupErr: backupErr,
+			wantErr:   backupErr,
+		},
+		{
+			name:     "post hook failure continued",
+			hooks:    &Hooks{Post: []Hook{failing}, OnFailure: HookContinue},
+			wantName: "default-v1-0000000100",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := WithHooks(&fakeBackupSnapshotter{err: test.backupErr}, test.hooks)
+
+			name, err := s.Backup(100)
+			if name != test.wantName {
+				t.Errorf("snapshot name %q, want %q", name, test.wantName)
+			}
+
+			var hookErr *HookError
+			switch {
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("error %v, want %v", err, test.wantErr)
+				}
+			case test.wantPhase != "":
+				if !errors.As(err, &hookErr) || hookErr.Phase != test.wantPhase {
+					t.Errorf("error %v, want a %s hook error", err, test.wantPhase)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestWithHooksCopiesHooks(t *testing.T) {
+	hooks := &Hooks{}
+	WithHooks(&fakeBackupSnapshotter{}, hooks)
+
+	if hooks.Timeout != 0 || hooks.OnFailure != "" {
+		t.Errorf("hooks were modified to %+v", hooks)
+	}
+}
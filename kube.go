@@ -0,0 +1,379 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// KubernetesOptions selects the cluster to talk to, like the `--kubeconfig`
+// and `--context` flags of kubectl.
+type KubernetesOptions struct {
+	Kubeconfig string
+	Context    string
+}
+
+// KubernetesConfig returns the in cluster config when running in a pod and
+// no option is set, the kubeconfig config otherwise: the `Kubeconfig` file
+// or the files of `$KUBECONFIG` or `~/.kube/config`, at the `Context`
+// context or the current one.
+func KubernetesConfig(options KubernetesOptions) (*rest.Config, error) {
+	if options.Kubeconfig == "" && options.Context == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, nil
+		}
+		if err != rest.ErrNotInCluster {
+			return nil, fmt.Errorf("in cluster config: %w", err)
+		}
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = options.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: options.Context}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("loading kubeconfig: %w", err)
+	}
+	return config, nil
+}
+
+// NewKubernetesClientset returns a clientset for the cluster selected by the
+// options, see KubernetesConfig.
+func NewKubernetesClientset(options KubernetesOptions) (kubernetes.Interface, error) {
+	config, err := KubernetesConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("new for config: %s", err)
+	}
+	return clientset, nil
+}
+
+func newKubernetesClientset() (kubernetes.Interface, error) {
+	return NewKubernetesClientset(KubernetesOptions{})
+}
+
+// getPodClaims returns the names of the pod PVCs picked by the selector, in
+// the order of the pod volumes.
+func getPodClaims(ctx context.Context, clientset kubernetes.Interface, pod, namespace string, volumes volumeSelector) (out []string, err error) {
+	mypod, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("pod %s not found in namespace %s", pod, namespace)
+	} else if statusError, isStatus := err.(*errors.StatusError); isStatus {
+		return nil, fmt.Errorf("cannot get pod: %s", statusError.ErrStatus.Message)
+	} else if err != nil {
+		return
+	}
+
+	for _, vol := range mypod.Spec.Volumes {
+		if vol.PersistentVolumeClaim == nil || !volumes.matches(vol.PersistentVolumeClaim.ClaimName, pod) {
+			continue
+		}
+		out = append(out, vol.PersistentVolumeClaim.ClaimName)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("did not find any pvc")
+	}
+
+	return out, nil
+}
+
+// getClaimPersistentVolume returns the PV bound to the PVC.
+func getClaimPersistentVolume(ctx context.Context, clientset kubernetes.Interface, namespace, claimName string) (*corev1.PersistentVolume, error) {
+	mypvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pvName := mypvc.Spec.VolumeName
+
+	mypv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pv %q: %s", pvName, err)
+	}
+	return mypv, nil
+}
+
+// StatefulSetOfPod returns the name of the StatefulSet owning the pod.
+func StatefulSetOfPod(ctx context.Context, clientset kubernetes.Interface, namespace, pod string) (string, error) {
+	mypod, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("getting pod %s: %w", pod, err)
+	}
+
+	for _, owner := range mypod.OwnerReferences {
+		if owner.Kind == "StatefulSet" {
+			return owner.Name, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s is not owned by a statefulset", pod)
+}
+
+// DeleteStatefulSetOrphan deletes the StatefulSet leaving its pods running,
+// like `kubectl delete --cascade=orphan`, and waits for it to be gone. The
+// definition it had is returned, to recreate it with RecreateStatefulSet.
+func DeleteStatefulSetOrphan(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*appsv1.StatefulSet, error) {
+	statefulSets := clientset.AppsV1().StatefulSets(namespace)
+
+	sts, err := statefulSets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting statefulset %s: %w", name, err)
+	}
+
+	orphan := metav1.DeletePropagationOrphan
+	err = statefulSets.Delete(ctx, name, metav1.DeleteOptions{
+		PropagationPolicy: &orphan,
+		Preconditions:     metav1.NewUIDPreconditions(string(sts.UID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("deleting statefulset %s: %w", name, err)
+	}
+
+	err = waitForDeletion(ctx, name,
+		func(ctx context.Context) (metav1.Object, error) {
+			return statefulSets.Get(ctx, name, metav1.GetOptions{})
+		},
+		statefulSets.Watch,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for statefulset %s deletion: %w", name, err)
+	}
+	return sts, nil
+}
+
+// RecreateStatefulSet creates the StatefulSet from a definition returned by
+// DeleteStatefulSetOrphan, the pods it left running are adopted back.
+func RecreateStatefulSet(ctx context.Context, clientset kubernetes.Interface, sts *appsv1.StatefulSet) error {
+	definition := StatefulSetDefinition(sts)
+	if _, err := clientset.AppsV1().StatefulSets(sts.Namespace).Create(ctx, definition, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating statefulset %s: %w", sts.Name, err)
+	}
+	return nil
+}
+
+// StatefulSetDefinition returns the StatefulSet stripped of its status and
+// server set metadata, ready to be created again.
+func StatefulSetDefinition(sts *appsv1.StatefulSet) *appsv1.StatefulSet {
+	definition := sts.DeepCopy()
+	definition.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"}
+	definition.ObjectMeta = metav1.ObjectMeta{
+		Name:        sts.Name,
+		Namespace:   sts.Namespace,
+		Labels:      sts.Labels,
+		Annotations: sts.Annotations,
+	}
+	definition.Status = appsv1.StatefulSetStatus{}
+	return definition
+}
+
+// DeletePod deletes the pod and waits for it to be gone, so the volumes it
+// used are detached.
+func DeletePod(ctx context.Context, clientset kubernetes.Interface, namespace, name string) error {
+	pods := clientset.CoreV1().Pods(namespace)
+
+	if err := pods.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("deleting pod %s: %w", name, err)
+	}
+
+	err := waitForDeletion(ctx, name,
+		func(ctx context.Context) (metav1.Object, error) {
+			return pods.Get(ctx, name, metav1.GetOptions{})
+		},
+		pods.Watch,
+	)
+	if err != nil {
+		return fmt.Errorf("waiting for pod %s deletion: %w", name, err)
+	}
+	return nil
+}
+
+// waitForDeletion watches the object named `name` until it is deleted,
+// restarting the watch from a fresh get when the server closes it.
+func waitForDeletion(ctx context.Context, name string, get func(context.Context) (metav1.Object, error), watchFunc func(context.Context, metav1.ListOptions) (watch.Interface, error)) error {
+	for {
+		object, err := get(ctx)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		watcher, err := watchFunc(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: object.GetResourceVersion(),
+		})
+		if err != nil {
+			return err
+		}
+
+		deleted, err := waitForDeletedEvent(ctx, watcher, name)
+		watcher.Stop()
+		if deleted || err != nil {
+			return err
+		}
+	}
+}
+
+// waitForDeletedEvent returns true once the object is deleted, false when
+// the watch is closed before.
+func waitForDeletedEvent(ctx context.Context, watcher watch.Interface, name string) (bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, nil
+			}
+
+			switch event.Type {
+			case watch.Deleted:
+				if object, ok := event.Object.(metav1.Object); ok && object.GetName() == name {
+					return true, nil
+				}
+			case watch.Error:
+				// Expired resource version and the like, restart from a get
+				zlog.Debug("watch error, restarting", zap.String("name", name), zap.Error(errors.FromObject(event.Object)))
+				return false, nil
+			}
+		}
+	}
+}
+
+// RetainPersistentVolume sets the reclaim policy of the PV to Retain, so
+// deleting its claim leaves the PV and its disk in place.
+func RetainPersistentVolume(ctx context.Context, clientset kubernetes.Interface, name string) error {
+	patch := []byte(`{"spec":{"persistentVolumeReclaimPolicy":"Retain"}}`)
+	if _, err := clientset.CoreV1().PersistentVolumes().Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("retaining pv %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeletePersistentVolumeClaim deletes the PVC and waits for it to be gone,
+// which only happens once no pod uses it. The definition it had is returned,
+// to recreate it with RecreatePersistentVolumeClaim.
+func DeletePersistentVolumeClaim(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	claims := clientset.CoreV1().PersistentVolumeClaims(namespace)
+
+	pvc, err := claims.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pvc %s: %w", name, err)
+	}
+
+	if err := claims.Delete(ctx, name, metav1.DeleteOptions{Preconditions: metav1.NewUIDPreconditions(string(pvc.UID))}); err != nil {
+		return nil, fmt.Errorf("deleting pvc %s: %w", name, err)
+	}
+
+	err = waitForDeletion(ctx, name,
+		func(ctx context.Context) (metav1.Object, error) {
+			return claims.Get(ctx, name, metav1.GetOptions{})
+		},
+		claims.Watch,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for pvc %s deletion: %w", name, err)
+	}
+	return pvc, nil
+}
+
+// RecreatePersistentVolumeClaim creates the PVC from a definition returned by
+// DeletePersistentVolumeClaim, bound to the PV `volumeName`.
+func RecreatePersistentVolumeClaim(ctx context.Context, clientset kubernetes.Interface, pvc *corev1.PersistentVolumeClaim, volumeName string) error {
+	definition := pvc.DeepCopy()
+	definition.ObjectMeta = metav1.ObjectMeta{
+		Name:        pvc.Name,
+		Namespace:   pvc.Namespace,
+		Labels:      pvc.Labels,
+		Annotations: map[string]string{},
+	}
+	// The binding annotations belong to the previous PV
+	for key, value := range pvc.Annotations {
+		if !strings.HasPrefix(key, "pv.kubernetes.io/") && key != "volume.kubernetes.io/selected-node" {
+			definition.Annotations[key] = value
+		}
+	}
+	definition.Spec.VolumeName = volumeName
+	definition.Status = corev1.PersistentVolumeClaimStatus{}
+
+	if _, err := clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(ctx, definition, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating pvc %s: %w", pvc.Name, err)
+	}
+	return nil
+}
+
+// StorageClassDiskType returns the GCE disk type the storage class
+// provisions, from its `type` parameter which defaults to pd-standard for the
+// in-tree and CSI provisioners. An empty string is returned for PVs without a
+// storage class or when their class was deleted.
+func StorageClassDiskType(ctx context.Context, clientset kubernetes.Interface, className string) (string, error) {
+	if className == "" {
+		return "", nil
+	}
+
+	class, err := clientset.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		zlog.Warn("storage class of pv not found", zap.String("storage_class", className))
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("getting storage class %s: %w", className, err)
+	}
+
+	if diskType := class.Parameters["type"]; diskType != "" {
+		return diskType, nil
+	}
+	return "pd-standard", nil
+}
+
+// ExpandPersistentVolumeClaim raises the storage request of the PVC to `size`
+// once it is bound, so the volume expansion resizes the filesystem the next
+// time a pod mounts it. The storage class must allow volume expansion.
+func ExpandPersistentVolumeClaim(ctx context.Context, clientset kubernetes.Interface, namespace, name string, size resource.Quantity) error {
+	claims := clientset.CoreV1().PersistentVolumeClaims(namespace)
+
+	for {
+		pvc, err := claims.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting pvc %s: %w", name, err)
+		}
+
+		if pvc.Status.Phase == corev1.ClaimBound {
+			if request := pvc.Spec.Resources.Requests[corev1.ResourceStorage]; request.Cmp(size) >= 0 {
+				return nil
+			}
+			break
+		}
+
+		zlog.Info("waiting for pvc to be bound before expanding it", zap.String("pvc", name), zap.String("phase", string(pvc.Status.Phase)))
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+
+	patch := []byte(fmt.Sprintf(`{"spec":{"resources":{"requests":{"storage":%q}}}}`, size.String()))
+	if _, err := claims.Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("expanding pvc %s: %w", name, err)
+	}
+	return nil
+}
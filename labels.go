@@ -0,0 +1,115 @@
+package snapshotter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Labels attached to every GCE snapshot created by the snapshotter, they are
+// used to list and select snapshots instead of parsing their names.
+const (
+	LabelNamespace = "namespace"
+	LabelTag       = "tag"
+	LabelBlockNum  = "block-num"
+	LabelPod       = "pod"
+	LabelPVC       = "pvc"
+	LabelVersion   = "snapshotter-version"
+
+	// LabelGroup is the name shared by the snapshots of all the volumes taken
+	// in one Backup, LabelVolume tells them apart.
+	LabelGroup  = "snapshot-group"
+	LabelVolume = "volume"
+
+	// LabelBackupOf is set on the snapshots and disks keeping a disk replaced
+	// by a restore, to the name of that disk, so it can be rolled back.
+	LabelBackupOf = "backup-of"
+)
+
+// BackupLabels returns the labels of the backup of the disk of the pod, kept
+// by a restore.
+func BackupLabels(disk, pod string) map[string]string {
+	return map[string]string{
+		LabelBackupOf: sanitizeLabelValue(disk),
+		LabelPod:      sanitizeLabelValue(pod),
+		LabelVersion:  sanitizeLabelValue(Version),
+	}
+}
+
+func snapshotLabels(req *snapshotRequest, pd *pdDef) map[string]string {
+	labels := map[string]string{
+		LabelNamespace: req.namespace,
+		LabelPod:       req.pod,
+		LabelPVC:       pd.claimName,
+		LabelVersion:   Version,
+		LabelGroup:     req.name,
+		LabelVolume:    pd.volume,
+	}
+	if req.tag != "" {
+		labels[LabelTag] = req.tag
+		labels[LabelBlockNum] = strconv.FormatUint(uint64(req.blockNum), 10)
+	}
+
+	for key, value := range labels {
+		if value == "" {
+			delete(labels, key)
+			continue
+		}
+		labels[key] = sanitizeLabelValue(value)
+	}
+	return labels
+}
+
+// sanitizeLabelValue maps the value to what GCE accepts as a label value: at
+// most 63 lowercase letters, digits, underscores and dashes. Long values are
+// truncated like names, see limitName.
+func sanitizeLabelValue(value string) string {
+	out := []rune(strings.ToLower(value))
+	for i, r := range out {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '_' && r != '-' {
+			out[i] = '_'
+		}
+	}
+	return limitName(string(out))
+}
+
+// LabelFilter returns a GCE list filter matching all of the given labels.
+func LabelFilter(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	expressions := make([]string, len(keys))
+	for i, key := range keys {
+		expressions[i] = fmt.Sprintf("(labels.%s = %q)", key, sanitizeLabelValue(labels[key]))
+	}
+	return strings.Join(expressions, " ")
+}
+
+// NewSnapshotFromLabels decodes the snapshot labels set by the snapshotter.
+func NewSnapshotFromLabels(name string, createdAt time.Time, labels map[string]string) (*Snapshot, error) {
+	out := &Snapshot{
+		Name:      name,
+		Namespace: labels[LabelNamespace],
+		Tag:       labels[LabelTag],
+		CreatedAt: createdAt,
+	}
+
+	if volume := labels[LabelVolume]; volume != "" {
+		out.Volumes = []string{volume}
+	}
+
+	if value := labels[LabelBlockNum]; value != "" {
+		blockNum, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label %q on snapshot %q: %w", LabelBlockNum, value, name, err)
+		}
+		out.BlockNum = uint32(blockNum)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,53 @@
+package snapshotter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeLabelValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: ""},
+		{value: "default-v1_0", want: "default-v1_0"},
+		{value: "Geth-V1", want: "geth-v1"},
+		{value: "v1.10.17+stable", want: "v1_10_17_stable"},
+		{value: "été", want: "_t_"},
+		{value: strings.Repeat("a", 70), want: strings.Repeat("a", 54) + "-6bd5e503"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := sanitizeLabelValue(test.value); got != test.want {
+				t.Errorf("sanitizeLabelValue %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLabelFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "empty", labels: nil, want: ""},
+		{name: "single", labels: map[string]string{LabelGroup: "default-v1-0000000100"}, want: `(labels.snapshot-group = "default-v1-0000000100")`},
+		{
+			name:   "sorted by key",
+			labels: map[string]string{LabelTag: "v1", LabelNamespace: "default"},
+			want:   `(labels.namespace = "default") (labels.tag = "v1")`,
+		},
+		{name: "sanitized value", labels: map[string]string{LabelTag: "Geth-v1.10"}, want: `(labels.tag = "geth-v1_10")`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := LabelFilter(test.labels); got != test.want {
+				t.Errorf("LabelFilter %q, want %q", got, test.want)
+			}
+		})
+	}
+}
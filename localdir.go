@@ -0,0 +1,387 @@
+package snapshotter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func init() {
+	Register("local-dir", func(conf map[string]string) (Snapshotter, error) {
+		s, err := NewLocalDirSnapshotter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// Local directory snapshot modes, see the `mode` config key.
+const (
+	LocalDirCopy     = "copy"
+	LocalDirHardlink = "hardlink"
+)
+
+// LocalDirSnapshotter snapshots a data directory into a directory per
+// snapshot, for development, CI and bare-metal nodes. Each snapshot is
+// `<dest>/<name>/data` along with `<dest>/<name>/manifest.json`.
+type LocalDirSnapshotter struct {
+	tag       string
+	namespace string
+	source    string
+	dest      string
+	mode      string
+}
+
+// localDirExampleConfigString lists the required keys, `mode=hardlink`
+// hardlinks the files instead of copying them (`mode=copy`, the default),
+// which is only safe when the files are never modified in place, like the
+// immutable files of most chain data stores. `dest` must be on the same
+// filesystem as `source` to hardlink.
+var localDirExampleConfigString = "type=local-dir tag=v1 namespace=default source=/data dest=/snapshots"
+
+func NewLocalDirSnapshotter(conf map[string]string) (*LocalDirSnapshotter, error) {
+	for _, label := range []string{"tag", "namespace", "source", "dest"} {
+		if conf[label] == "" {
+			return nil, fmt.Errorf("backup module local-dir missing value for %s. Example: %s", label, localDirExampleConfigString)
+		}
+	}
+
+	mode := conf["mode"]
+	switch mode {
+	case "":
+		mode = LocalDirCopy
+	case LocalDirCopy, LocalDirHardlink:
+	default:
+		return nil, fmt.Errorf("backup module local-dir invalid value %q for mode, valid values are %s and %s", mode, LocalDirCopy, LocalDirHardlink)
+	}
+
+	source, err := resolvePath(conf["source"])
+	if err != nil {
+		return nil, fmt.Errorf("backup module local-dir invalid source: %w", err)
+	}
+	dest, err := resolvePath(conf["dest"])
+	if err != nil {
+		return nil, fmt.Errorf("backup module local-dir invalid dest: %w", err)
+	}
+
+	// Backup would copy the snapshots into themselves and Restore, which
+	// empties source, would delete them
+	if isWithin(source, dest) {
+		return nil, fmt.Errorf("backup module local-dir dest %s must not be inside source %s", dest, source)
+	}
+
+	return &LocalDirSnapshotter{
+		tag:       conf["tag"],
+		namespace: conf["namespace"],
+		source:    source,
+		dest:      dest,
+		mode:      mode,
+	}, nil
+}
+
+// resolvePath returns the absolute path of `path`, with its symlinks
+// resolved when it exists.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if os.IsNotExist(err) {
+		return abs, nil
+	}
+	return resolved, err
+}
+
+// isWithin returns whether `path` is `dir` or one of its descendants.
+func isWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *LocalDirSnapshotter) RequiresStop() bool {
+	return true
+}
+
+// Backup copies (or hardlinks) the source directory into a temporary
+// directory under dest, writes the manifest and renames it to the snapshot
+// name, so a snapshot directory is always complete.
+func (s *LocalDirSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
+	name := GenerateName(s.namespace, s.tag, lastSeenBlockNum)
+	dir := filepath.Join(s.dest, name)
+
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("snapshot %s already exists in %s", name, s.dest)
+	}
+
+	tmp := filepath.Join(s.dest, "."+name+".tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", fmt.Errorf("cleaning up %s: %w", tmp, err)
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+
+	manifest := &Manifest{
+		Name:      name,
+		Namespace: s.namespace,
+		Tag:       s.tag,
+		BlockNum:  lastSeenBlockNum,
+		CreatedAt: time.Now().UTC(),
+		Version:   Version,
+	}
+
+	zlog.Info("copying data directory to snapshot", zap.String("source", s.source), zap.String("snapshot", name), zap.String("mode", s.mode))
+	err := copyTree(s.source, filepath.Join(tmp, "data"), s.mode == LocalDirHardlink, manifest)
+	if err == nil {
+		err = writeManifest(filepath.Join(tmp, ManifestFileName), manifest)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		if cleanupErr := os.RemoveAll(tmp); cleanupErr != nil {
+			zlog.Warn("unable to clean up failed snapshot", zap.String("dir", tmp), zap.Error(cleanupErr))
+		}
+		return "", fmt.Errorf("snapshotting %s: %w", s.source, err)
+	}
+
+	return name, nil
+}
+
+// Restore verifies the checksum of every file of the snapshot against its
+// manifest, then replaces the content of the source directory with a copy of
+// the snapshot. Nothing is touched in the source directory when the
+// verification fails.
+func (s *LocalDirSnapshotter) Restore(snapshotName string) error {
+	dir, err := s.snapshotDir(snapshotName)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := readManifest(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return err
+	}
+
+	data := filepath.Join(dir, "data")
+	if err := verifyTree(data, manifest); err != nil {
+		return fmt.Errorf("verifying snapshot %s: %w", snapshotName, err)
+	}
+
+	entries, err := os.ReadDir(s.source)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(s.source, entry.Name())); err != nil {
+			return fmt.Errorf("emptying %s: %w", s.source, err)
+		}
+	}
+
+	zlog.Info("restoring snapshot to data directory", zap.String("snapshot", snapshotName), zap.String("source", s.source))
+	if err := copyTree(data, s.source, false, &Manifest{}); err != nil {
+		return fmt.Errorf("restoring snapshot %s: %w", snapshotName, err)
+	}
+	return nil
+}
+
+// List returns the snapshots of dest matching the namespace and tag.
+func (s *LocalDirSnapshotter) List() (out []*Snapshot, err error) {
+	entries, err := os.ReadDir(s.dest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		manifest, err := readManifest(filepath.Join(s.dest, entry.Name(), ManifestFileName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if manifest.Namespace != s.namespace || manifest.Tag != s.tag {
+			continue
+		}
+		out = append(out, manifest.Snapshot())
+	}
+
+	sortSnapshotsByMostRecent(out)
+	return out, nil
+}
+
+// Delete removes the snapshot directory.
+func (s *LocalDirSnapshotter) Delete(snapshotName string) error {
+	dir, err := s.snapshotDir(snapshotName)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// snapshotDir returns the directory of the snapshot, refusing names that are
+// not a snapshot of dest.
+func (s *LocalDirSnapshotter) snapshotDir(snapshotName string) (string, error) {
+	if snapshotName == "" || strings.ContainsAny(snapshotName, `/\`) || strings.HasPrefix(snapshotName, ".") {
+		return "", fmt.Errorf("invalid snapshot name %q", snapshotName)
+	}
+
+	dir := filepath.Join(s.dest, snapshotName)
+	if _, err := os.Stat(filepath.Join(dir, ManifestFileName)); err != nil {
+		return "", fmt.Errorf("snapshot %s not found in %s: %w", snapshotName, s.dest, err)
+	}
+	return dir, nil
+}
+
+// copyTree copies, or hardlinks, the regular files, directories and symlinks
+// of `from` into `to`, recording them with their checksum in the manifest.
+func copyTree(from, to string, hardlink bool, manifest *Manifest) error {
+	return filepath.WalkDir(from, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		file := &ManifestFile{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()|0700); err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			if file.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+			if err := os.Symlink(file.Link, target); err != nil {
+				return err
+			}
+
+		case info.Mode().IsRegular():
+			if hardlink {
+				if err := os.Link(path, target); err != nil {
+					return err
+				}
+				file.SHA256, err = fileChecksum(path)
+			} else {
+				file.SHA256, err = copyFile(path, target, info)
+			}
+			if err != nil {
+				return err
+			}
+			file.Size = info.Size()
+			manifest.Size += file.Size
+			manifest.FileCount++
+
+		default:
+			zlog.Warn("skipping file that is not a regular file, directory or symlink", zap.String("path", path))
+			return nil
+		}
+
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+}
+
+// verifyTree checks that every regular file of the manifest is in `dir` with
+// the recorded size and checksum.
+func verifyTree(dir string, manifest *Manifest) error {
+	for _, file := range manifest.Files {
+		if !file.Mode.IsRegular() {
+			continue
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(file.Path))
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() != file.Size {
+			return fmt.Errorf("file %s is %d bytes, expected %d", file.Path, info.Size(), file.Size)
+		}
+
+		checksum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		if checksum != file.SHA256 {
+			return fmt.Errorf("checksum mismatch for file %s, got %s, expected %s", file.Path, checksum, file.SHA256)
+		}
+	}
+	return nil
+}
+
+func copyFile(from, to string, info fs.FileInfo) (checksum string, err error) {
+	in, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(out, io.TeeReader(in, hash)); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Chtimes(to, info.ModTime(), info.ModTime()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileChecksum(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
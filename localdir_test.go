@@ -0,0 +1,230 @@
+package snapshotter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewLocalDirSnapshotterDest(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "data")
+	if err := os.MkdirAll(filepath.Join(source, "snapshots"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(source, "snapshots"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dest    string
+		wantErr bool
+	}{
+		{name: "sibling", dest: filepath.Join(root, "snapshots")},
+		{name: "sibling sharing the prefix", dest: filepath.Join(root, "data-snapshots")},
+		{name: "same directory", dest: source, wantErr: true},
+		{name: "inside", dest: filepath.Join(source, "snapshots"), wantErr: true},
+		{name: "inside, not created yet", dest: filepath.Join(source, "new", "snapshots"), wantErr: true},
+		{name: "inside, unclean", dest: filepath.Join(root, "other") + "/../data/snapshots", wantErr: true},
+		{name: "inside through a symlink", dest: filepath.Join(root, "link"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewLocalDirSnapshotter(map[string]string{
+				"tag":       "v1",
+				"namespace": "default",
+				"source":    source,
+				"dest":      test.dest,
+			})
+			switch {
+			case test.wantErr && (err == nil || !strings.Contains(err.Error(), "must not be inside source")):
+				t.Errorf("error %v, want dest rejected", err)
+			case !test.wantErr && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+// readTestTree returns the content of the regular files and the target of
+// the symlinks of the directory, by relative path.
+func readTestTree(t *testing.T, root string) map[string]string {
+	out := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			out[filepath.ToSlash(rel)] = "-> " + link
+			return err
+		}
+		content, err := os.ReadFile(path)
+		out[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// newTestLocalDirSource writes a directory with a file, a nested file and a
+// symlink.
+func newTestLocalDirSource(t *testing.T) string {
+	source := filepath.Join(t.TempDir(), "data")
+	if err := os.MkdirAll(filepath.Join(source, "state", "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "blocks.dat"), []byte("block 1\nblock 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "state", "db", "CURRENT"), []byte("MANIFEST-000001\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("db/CURRENT", filepath.Join(source, "state", "current")); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func newTestLocalDirSnapshotter(t *testing.T, source, dest, mode string) *LocalDirSnapshotter {
+	s, err := NewLocalDirSnapshotter(map[string]string{
+		"tag":       "v1",
+		"namespace": "default",
+		"source":    source,
+		"dest":      dest,
+		"mode":      mode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLocalDirSnapshotterRoundTrip(t *testing.T) {
+	for _, mode := range []string{LocalDirCopy, LocalDirHardlink} {
+		t.Run(mode, func(t *testing.T) {
+			source := newTestLocalDirSource(t)
+			dest := filepath.Join(filepath.Dir(source), "snapshots")
+			s := newTestLocalDirSnapshotter(t, source, dest, mode)
+			want := readTestTree(t, source)
+
+			snapshotName, err := s.Backup(100)
+			if err != nil {
+				t.Fatalf("backup: %s", err)
+			}
+
+			snapshots, err := s.List()
+			if err != nil {
+				t.Fatalf("list: %s", err)
+			}
+			if len(snapshots) != 1 || snapshots[0].Name != snapshotName || snapshots[0].BlockNum != 100 {
+				t.Fatalf("list %+v, want snapshot %s", snapshots, snapshotName)
+			}
+
+			sourceInfo, err := os.Stat(filepath.Join(source, "blocks.dat"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshotInfo, err := os.Stat(filepath.Join(dest, snapshotName, "data", "blocks.dat"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if linked := os.SameFile(sourceInfo, snapshotInfo); linked != (mode == LocalDirHardlink) {
+				t.Errorf("snapshot file hardlinked to the source %t, want %t", linked, mode == LocalDirHardlink)
+			}
+
+			// Files are replaced rather than modified in place, as the
+			// hardlink mode requires
+			if err := os.Remove(filepath.Join(source, "blocks.dat")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(source, "blocks.dat"), []byte("block 3\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(source, "state", "LOCK"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Restore(snapshotName); err != nil {
+				t.Fatalf("restore: %s", err)
+			}
+			if got := readTestTree(t, source); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLocalDirSnapshotterRestoreCorrupted(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, data string)
+		wantErr string
+	}{
+		{
+			name: "modified",
+			corrupt: func(t *testing.T, data string) {
+				if err := os.WriteFile(filepath.Join(data, "blocks.dat"), []byte("block 1\nblock X\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "checksum mismatch for file blocks.dat",
+		},
+		{
+			name: "truncated",
+			corrupt: func(t *testing.T, data string) {
+				if err := os.Truncate(filepath.Join(data, "state", "db", "CURRENT"), 3); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "file state/db/CURRENT is 3 bytes, expected 16",
+		},
+		{
+			name: "missing",
+			corrupt: func(t *testing.T, data string) {
+				if err := os.Remove(filepath.Join(data, "blocks.dat")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "no such file or directory",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTestLocalDirSource(t)
+			dest := filepath.Join(filepath.Dir(source), "snapshots")
+			s := newTestLocalDirSnapshotter(t, source, dest, LocalDirCopy)
+
+			snapshotName, err := s.Backup(100)
+			if err != nil {
+				t.Fatalf("backup: %s", err)
+			}
+
+			if err := os.WriteFile(filepath.Join(source, "state", "LOCK"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			want := readTestTree(t, source)
+			test.corrupt(t, filepath.Join(dest, snapshotName, "data"))
+
+			err = s.Restore(snapshotName)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("restore error %v, want %q", err, test.wantErr)
+			}
+			if got := readTestTree(t, source); !reflect.DeepEqual(got, want) {
+				t.Errorf("source %v after a failed restore, want it untouched %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package snapshotter
+
+import (
+	"github.com/streamingfast/logging"
+)
+
+var zlog, _ = logging.PackageLogger("snapshotter", "github.com/streamingfast/snapshotter")
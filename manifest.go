@@ -0,0 +1,86 @@
+package snapshotter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ManifestFileName is the name of the manifest written next to the data of
+// the file based backends.
+const ManifestFileName = "manifest.json"
+
+// Manifest describes a snapshot taken by a file based backend.
+type Manifest struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Tag       string    `json:"tag"`
+	BlockNum  uint32    `json:"block_num"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   string    `json:"snapshotter_version"`
+
+	// Size is the total size of the regular files and FileCount their count
+	Size      int64 `json:"size"`
+	FileCount int   `json:"file_count"`
+
+	Files []*ManifestFile `json:"files,omitempty"`
+
+	// SHA256 and ArchiveSize are the checksum and size of the compressed
+	// archive uploaded in Parts, for the archive based backends.
+	SHA256      string          `json:"sha256,omitempty"`
+	ArchiveSize int64           `json:"archive_size,omitempty"`
+	Parts       []*ManifestPart `json:"parts,omitempty"`
+}
+
+// ManifestPart is an object holding a part of the archive, the archive is
+// the concatenation of its parts.
+type ManifestPart struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ManifestFile is an entry of the snapshotted directory, Link is set for
+// symlinks and SHA256 for regular files. Chunks lists, in order, the hashes
+// of the chunks of the file for the deduplicating backend.
+type ManifestFile struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+// Snapshot returns the library's view of the snapshot.
+func (m *Manifest) Snapshot() *Snapshot {
+	return &Snapshot{
+		Name:      m.Name,
+		Namespace: m.Namespace,
+		Tag:       m.Tag,
+		BlockNum:  m.BlockNum,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+func readManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return manifest, nil
+}
+
+func writeManifest(path string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,242 @@
+package snapshotter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"google.golang.org/api/storage/v1"
+)
+
+// objectStore stores objects under a base URL, object names are relative to
+// it and `/` separated.
+type objectStore interface {
+	WriteObject(ctx context.Context, name string, content []byte) error
+	OpenObject(ctx context.Context, name string) (io.ReadCloser, error)
+	DeleteObject(ctx context.Context, name string) error
+	// ListObjects returns the objects whose name starts with prefix
+	ListObjects(ctx context.Context, prefix string) ([]storedObject, error)
+}
+
+// storedObject is an object listed by a store, ModTime being when it was
+// last written.
+type storedObject struct {
+	Name    string
+	ModTime time.Time
+}
+
+// newObjectStore returns the store of a `gs://bucket/path`,
+// `s3://bucket/path` or `file:///path` URL. S3 URLs accept `region` and
+// `endpoint` query parameters, the latter for S3 compatible stores.
+func newObjectStore(ctx context.Context, rawURL string) (objectStore, error) {
+	storeURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store url %q: %w", rawURL, err)
+	}
+	prefix := strings.Trim(storeURL.Path, "/")
+
+	switch storeURL.Scheme {
+	case "file":
+		return &fileStore{base: filepath.FromSlash(storeURL.Host + storeURL.Path)}, nil
+
+	case "gs":
+		service, err := storage.NewService(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &gsStore{service: service, bucket: storeURL.Host, prefix: prefix}, nil
+
+	case "s3":
+		var options []func(*awsconfig.LoadOptions) error
+		if region := storeURL.Query().Get("region"); region != "" {
+			options = append(options, awsconfig.WithRegion(region))
+		}
+
+		cfg, err := awsconfig.LoadDefaultConfig(ctx, options...)
+		if err != nil {
+			return nil, fmt.Errorf("loading aws config: %w", err)
+		}
+
+		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if endpoint := storeURL.Query().Get("endpoint"); endpoint != "" {
+				o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+				o.UsePathStyle = true
+			}
+		})
+		return &s3Store{client: client, bucket: storeURL.Host, prefix: prefix}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported store url %q, valid schemes are gs://, s3:// and file://", rawURL)
+}
+
+func joinObjectName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+type fileStore struct {
+	base string
+}
+
+func (s *fileStore) WriteObject(ctx context.Context, name string, content []byte) error {
+	target := filepath.Join(s.base, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Written then renamed so readers never see a partial object
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func (s *fileStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.base, filepath.FromSlash(name)))
+}
+
+func (s *fileStore) DeleteObject(ctx context.Context, name string) error {
+	target := filepath.Join(s.base, filepath.FromSlash(name))
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove the directories left empty, up to the base
+	for dir := filepath.Dir(target); dir != s.base && strings.HasPrefix(dir, s.base); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) ListObjects(ctx context.Context, prefix string) (out []storedObject, err error) {
+	err = filepath.WalkDir(s.base, func(file string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || entry.IsDir() || strings.HasSuffix(file, ".tmp") {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.base, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		out = append(out, storedObject{Name: name, ModTime: info.ModTime()})
+		return nil
+	})
+	return out, err
+}
+
+type gsStore struct {
+	service *storage.Service
+	bucket  string
+	prefix  string
+}
+
+func (s *gsStore) WriteObject(ctx context.Context, name string, content []byte) error {
+	object := &storage.Object{Name: joinObjectName(s.prefix, name)}
+	_, err := s.service.Objects.Insert(s.bucket, object).Media(bytes.NewReader(content)).Context(ctx).Do()
+	return err
+}
+
+func (s *gsStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.service.Objects.Get(s.bucket, joinObjectName(s.prefix, name)).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *gsStore) DeleteObject(ctx context.Context, name string) error {
+	return s.service.Objects.Delete(s.bucket, joinObjectName(s.prefix, name)).Context(ctx).Do()
+}
+
+func (s *gsStore) ListObjects(ctx context.Context, prefix string) (out []storedObject, err error) {
+	fullPrefix := joinObjectName(s.prefix, prefix)
+	err = s.service.Objects.List(s.bucket).Prefix(fullPrefix).Pages(ctx, func(page *storage.Objects) error {
+		for _, object := range page.Items {
+			modTime, err := time.Parse(time.RFC3339, object.Updated)
+			if err != nil {
+				return fmt.Errorf("invalid update time of %s: %w", object.Name, err)
+			}
+			out = append(out, storedObject{Name: strings.TrimPrefix(object.Name, joinObjectName(s.prefix, "")), ModTime: modTime})
+		}
+		return nil
+	})
+	return out, err
+}
+
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) WriteObject(ctx context.Context, name string, content []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinObjectName(s.prefix, name)),
+		Body:   bytes.NewReader(content),
+	})
+	return err
+}
+
+func (s *s3Store) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinObjectName(s.prefix, name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) DeleteObject(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(joinObjectName(s.prefix, name)),
+	})
+	return err
+}
+
+func (s *s3Store) ListObjects(ctx context.Context, prefix string) (out []storedObject, err error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(joinObjectName(s.prefix, prefix)),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			out = append(out, storedObject{Name: strings.TrimPrefix(aws.ToString(object.Key), joinObjectName(s.prefix, "")), ModTime: aws.ToTime(object.LastModified)})
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,147 @@
+package snapshotter
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/compute/v1"
+)
+
+// OperationError is returned when a GCE operation reaches the DONE status
+// with errors attached to it, like a quota being exceeded or a name conflict.
+type OperationError struct {
+	Operation string
+	Target    string
+	Errors    []*compute.OperationErrorErrors
+}
+
+func newOperationError(op *compute.Operation) *OperationError {
+	return &OperationError{
+		Operation: op.Name,
+		Target:    op.TargetLink,
+		Errors:    op.Error.Errors,
+	}
+}
+
+func (e *OperationError) Error() string {
+	details := make([]string, len(e.Errors))
+	for i, opErr := range e.Errors {
+		details[i] = fmt.Sprintf("%s: %s", opErr.Code, opErr.Message)
+	}
+
+	return fmt.Sprintf("operation %s on %s failed: %s", e.Operation, e.Target, strings.Join(details, "; "))
+}
+
+// HasCode returns true if one of the operation errors has the given code,
+// like `QUOTA_EXCEEDED` or `RESOURCE_ALREADY_EXISTS`.
+func (e *OperationError) HasCode(code string) bool {
+	for _, opErr := range e.Errors {
+		if opErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotFailedError is returned when a snapshot ends up in the FAILED
+// status while waiting for it to become READY, or when a VolumeSnapshot
+// reports an error. Reason is the error reported, when known.
+type SnapshotFailedError struct {
+	Snapshot string
+	Reason   string
+}
+
+func (e *SnapshotFailedError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("snapshot %s failed: %s", e.Snapshot, e.Reason)
+	}
+	return fmt.Sprintf("snapshot %s is in status FAILED", e.Snapshot)
+}
+
+// Polling delays, doubled from pollInitialDelay up to pollMaxDelay. Variables
+// so tests poll faster.
+var (
+	pollInitialDelay = 1 * time.Second
+	pollMaxDelay     = 15 * time.Second
+)
+
+// WaitForOperation polls the zonal, regional or global operation until it
+// is DONE, returning an *OperationError if it completed with errors.
+func WaitForOperation(ctx context.Context, service *compute.Service, project string, op *compute.Operation) error {
+	delay := pollInitialDelay
+	for {
+		if op.Status == "DONE" {
+			if op.Error != nil && len(op.Error.Errors) > 0 {
+				return newOperationError(op)
+			}
+			return nil
+		}
+
+		zlog.Debug("waiting for operation", zap.String("operation", op.Name), zap.String("status", op.Status), zap.Duration("delay", delay))
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("waiting for operation %s: %w", op.Name, err)
+		}
+		delay = nextDelay(delay)
+
+		var err error
+		switch {
+		case op.Zone != "":
+			op, err = service.ZoneOperations.Get(project, path.Base(op.Zone), op.Name).Context(ctx).Do()
+		case op.Region != "":
+			op, err = service.RegionOperations.Get(project, path.Base(op.Region), op.Name).Context(ctx).Do()
+		default:
+			op, err = service.GlobalOperations.Get(project, op.Name).Context(ctx).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("getting operation status: %w", err)
+		}
+	}
+}
+
+// WaitForSnapshotReady polls the snapshot until its status is READY.
+func WaitForSnapshotReady(ctx context.Context, service *compute.Service, project, snapshotName string) error {
+	delay := pollInitialDelay
+	for {
+		snapshot, err := service.Snapshots.Get(project, snapshotName).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("getting snapshot %s: %w", snapshotName, err)
+		}
+
+		switch snapshot.Status {
+		case "READY":
+			return nil
+		case "FAILED":
+			return &SnapshotFailedError{Snapshot: snapshotName}
+		}
+
+		zlog.Debug("waiting for snapshot to be ready", zap.String("snapshot", snapshotName), zap.String("status", snapshot.Status), zap.Duration("delay", delay))
+		if err := sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("waiting for snapshot %s: %w", snapshotName, err)
+		}
+		delay = nextDelay(delay)
+	}
+}
+
+func nextDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > pollMaxDelay {
+		return pollMaxDelay
+	}
+	return delay
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,185 @@
+package snapshotter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeOperations answers the operation polls with RUNNING until the
+// operation was polled `pollsLeft` times, then with DONE and `errors`.
+type fakeOperations struct {
+	lock      sync.Mutex
+	pollsLeft int
+	errors    []*compute.OperationErrorErrors
+	paths     []string
+}
+
+func (f *fakeOperations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/compute/v1/")
+	f.paths = append(f.paths, path)
+	if !strings.Contains(path, "/operations/") {
+		http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	// projects/<project>/<zones|regions>/<location>/operations/<name>
+	parts := strings.Split(path, "/")
+	op := &compute.Operation{Name: parts[len(parts)-1], Status: "RUNNING", TargetLink: "disk-0"}
+	switch parts[2] {
+	case "zones":
+		op.Zone = strings.Join(parts[:4], "/")
+	case "regions":
+		op.Region = strings.Join(parts[:4], "/")
+	}
+	if f.pollsLeft--; f.pollsLeft <= 0 {
+		op.Status = "DONE"
+		if len(f.errors) > 0 {
+			op.Error = &compute.OperationError{Errors: f.errors}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(op)
+}
+
+func newTestComputeService(t *testing.T, handler http.Handler) *compute.Service {
+	previousInitial, previousMax := pollInitialDelay, pollMaxDelay
+	pollInitialDelay, pollMaxDelay = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { pollInitialDelay, pollMaxDelay = previousInitial, previousMax })
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestWaitForOperation(t *testing.T) {
+	quotaExceeded := []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED", Message: "Quota 'SSD_TOTAL_GB' exceeded"}}
+
+	tests := []struct {
+		name      string
+		op        *compute.Operation
+		pollsLeft int
+		errors    []*compute.OperationErrorErrors
+		wantPaths []string
+		wantErr   string
+	}{
+		{
+			name:      "zonal",
+			op:        &compute.Operation{Name: "op-1", Status: "PENDING", Zone: "https://www.googleapis.com/compute/v1/projects/p/zones/us-central1-a"},
+			pollsLeft: 3,
+			wantPaths: []string{"projects/p/zones/us-central1-a/operations/op-1", "projects/p/zones/us-central1-a/operations/op-1", "projects/p/zones/us-central1-a/operations/op-1"},
+		},
+		{
+			name:      "regional",
+			op:        &compute.Operation{Name: "op-1", Status: "RUNNING", Region: "https://www.googleapis.com/compute/v1/projects/p/regions/us-central1"},
+			pollsLeft: 1,
+			wantPaths: []string{"projects/p/regions/us-central1/operations/op-1"},
+		},
+		{
+			name:      "global",
+			op:        &compute.Operation{Name: "op-1", Status: "RUNNING"},
+			pollsLeft: 2,
+			wantPaths: []string{"projects/p/global/operations/op-1", "projects/p/global/operations/op-1"},
+		},
+		{
+			name: "already done",
+			op:   &compute.Operation{Name: "op-1", Status: "DONE"},
+		},
+		{
+			name:      "done with errors",
+			op:        &compute.Operation{Name: "op-1", Status: "RUNNING"},
+			pollsLeft: 1,
+			errors:    quotaExceeded,
+			wantPaths: []string{"projects/p/global/operations/op-1"},
+			wantErr:   "operation op-1 on disk-0 failed: QUOTA_EXCEEDED: Quota 'SSD_TOTAL_GB' exceeded",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakeOperations{pollsLeft: test.pollsLeft, errors: test.errors}
+			service := newTestComputeService(t, api)
+
+			err := WaitForOperation(context.Background(), service, "p", test.op)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.wantErr != "" {
+				var opErr *OperationError
+				if !errors.As(err, &opErr) || !opErr.HasCode("QUOTA_EXCEEDED") || err.Error() != test.wantErr {
+					t.Fatalf("error %v, want an *OperationError %q", err, test.wantErr)
+				}
+			}
+			if strings.Join(api.paths, " ") != strings.Join(test.wantPaths, " ") {
+				t.Errorf("polled %v, want %v", api.paths, test.wantPaths)
+			}
+		})
+	}
+}
+
+func TestWaitForOperationFailures(t *testing.T) {
+	t.Run("poll error", func(t *testing.T) {
+		service := newTestComputeService(t, http.NotFoundHandler())
+
+		err := WaitForOperation(context.Background(), service, "p", &compute.Operation{Name: "op-1", Status: "RUNNING"})
+		if err == nil || !strings.HasPrefix(err.Error(), "getting operation status: ") {
+			t.Fatalf("error %v, want the poll failure", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		service := newTestComputeService(t, &fakeOperations{pollsLeft: 1000})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		err := WaitForOperation(ctx, service, "p", &compute.Operation{Name: "op-1", Status: "RUNNING"})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("error %v, want the context deadline", err)
+		}
+	})
+}
+
+func TestOperationErrorHasCode(t *testing.T) {
+	err := &OperationError{Operation: "op-1", Target: "disk-0", Errors: []*compute.OperationErrorErrors{
+		{Code: "RESOURCE_ALREADY_EXISTS", Message: "The resource 'disk-0' already exists"},
+		{Code: "QUOTA_EXCEEDED", Message: "Quota exceeded"},
+	}}
+
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{code: "RESOURCE_ALREADY_EXISTS", want: true},
+		{code: "QUOTA_EXCEEDED", want: true},
+		{code: "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE", want: false},
+		{code: "", want: false},
+	}
+
+	for _, test := range tests {
+		if got := err.HasCode(test.code); got != test.want {
+			t.Errorf("HasCode(%q) %t, want %t", test.code, got, test.want)
+		}
+	}
+
+	want := "operation op-1 on disk-0 failed: RESOURCE_ALREADY_EXISTS: The resource 'disk-0' already exists; QUOTA_EXCEEDED: Quota exceeded"
+	if err.Error() != want {
+		t.Errorf("error %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,256 @@
+package snapshotter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetentionPolicy decides which snapshots of a namespace and tag are kept.
+// A snapshot is kept as soon as one of the rules selects it, and the most
+// recent snapshot of each group is never deleted.
+type RetentionPolicy struct {
+	// KeepLast keeps the N most recent snapshots
+	KeepLast int `json:"keep_last,omitempty"`
+	// KeepWithin keeps every snapshot created less than this duration ago
+	KeepWithin time.Duration `json:"keep_within,omitempty"`
+	// KeepDaily, KeepWeekly and KeepMonthly keep the most recent snapshot of
+	// each of the last N days, ISO weeks and months that have a snapshot
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+}
+
+// ParseRetentionPolicy reads the `keep-last`, `keep-within`, `keep-daily`,
+// `keep-weekly` and `keep-monthly` keys of a snapshotter config.
+func ParseRetentionPolicy(conf map[string]string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{}
+
+	counts := map[string]*int{
+		"keep-last":    &policy.KeepLast,
+		"keep-daily":   &policy.KeepDaily,
+		"keep-weekly":  &policy.KeepWeekly,
+		"keep-monthly": &policy.KeepMonthly,
+	}
+	for key, dest := range counts {
+		if conf[key] == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(conf[key])
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid value %q for %s, expecting a positive number", conf[key], key)
+		}
+		*dest = value
+	}
+
+	if conf["keep-within"] != "" {
+		value, err := time.ParseDuration(conf["keep-within"])
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid value %q for keep-within, expecting a positive duration like 72h", conf["keep-within"])
+		}
+		policy.KeepWithin = value
+	}
+
+	return policy, nil
+}
+
+// IsEmpty returns true when no rule is set, in which case nothing is pruned.
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p.KeepLast == 0 && p.KeepWithin == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 && p.KeepMonthly == 0
+}
+
+// RetentionDecision is the outcome of the policy for a single snapshot.
+type RetentionDecision struct {
+	Snapshot *Snapshot `json:"snapshot"`
+	Reasons  []string  `json:"reasons,omitempty"`
+}
+
+// RetentionPlan lists the snapshots to keep and to delete, most recent first.
+type RetentionPlan struct {
+	Keep   []*RetentionDecision `json:"keep"`
+	Delete []*RetentionDecision `json:"delete"`
+}
+
+// Plan applies the policy to the snapshots, grouped by namespace and tag. An
+// empty policy keeps everything.
+func (p *RetentionPolicy) Plan(snapshots []*Snapshot, now time.Time) *RetentionPlan {
+	plan := &RetentionPlan{}
+
+	type groupKey struct{ namespace, tag string }
+	groups := map[groupKey][]*Snapshot{}
+	var keys []groupKey
+	for _, snapshot := range snapshots {
+		key := groupKey{snapshot.Namespace, snapshot.Tag}
+		if _, found := groups[key]; !found {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], snapshot)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].CreatedAt.After(group[j].CreatedAt)
+		})
+
+		reasons := p.reasons(group, now)
+		for i, snapshot := range group {
+			decision := &RetentionDecision{Snapshot: snapshot, Reasons: reasons[i]}
+			if len(decision.Reasons) == 0 {
+				plan.Delete = append(plan.Delete, decision)
+				continue
+			}
+			plan.Keep = append(plan.Keep, decision)
+		}
+	}
+
+	return plan
+}
+
+// reasons expects the group sorted most recent first and returns, for each
+// snapshot, the rules keeping it.
+func (p *RetentionPolicy) reasons(group []*Snapshot, now time.Time) [][]string {
+	out := make([][]string, len(group))
+	keep := func(i int, reason string) {
+		out[i] = append(out[i], reason)
+	}
+
+	if p.IsEmpty() {
+		for i := range group {
+			keep(i, "no retention rule")
+		}
+		return out
+	}
+
+	for i, snapshot := range group {
+		if i == 0 {
+			keep(i, "most recent")
+		}
+
+		if i < p.KeepLast {
+			keep(i, fmt.Sprintf("keep-last %d", p.KeepLast))
+		}
+
+		if p.KeepWithin > 0 && now.Sub(snapshot.CreatedAt) <= p.KeepWithin {
+			keep(i, fmt.Sprintf("keep-within %s", p.KeepWithin))
+		}
+	}
+
+	buckets := []struct {
+		rule  string
+		count int
+		key   func(t time.Time) string
+	}{
+		{"keep-daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"keep-weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"keep-monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for _, bucket := range buckets {
+		if bucket.count == 0 {
+			continue
+		}
+
+		seen := map[string]bool{}
+		for i, snapshot := range group {
+			if len(seen) == bucket.count {
+				break
+			}
+
+			key := bucket.key(snapshot.CreatedAt.UTC())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep(i, fmt.Sprintf("%s %s", bucket.rule, key))
+		}
+	}
+
+	return out
+}
+
+// BatchDeleter is implemented by the backends deleting several snapshots at
+// once for less than deleting them one by one, like DedupSnapshotter which
+// collects its chunks once.
+type BatchDeleter interface {
+	DeleteSnapshots(snapshotNames []string) error
+}
+
+// ApplyRetention lists the snapshots of the backend and deletes the ones the
+// policy does not keep, at once when the backend is a BatchDeleter. It stops
+// at the first deletion error, the returned plan is the one that was being
+// applied.
+func ApplyRetention(s Snapshotter, policy *RetentionPolicy) (*RetentionPlan, error) {
+	snapshots, err := s.List()
+	if err != nil {
+		return nil, fmt.Errorf("listing snapshots: %w", err)
+	}
+
+	plan := policy.Plan(snapshots, time.Now())
+	if deleter, ok := batchDeleter(s); ok && len(plan.Delete) > 0 {
+		names := make([]string, len(plan.Delete))
+		for i, decision := range plan.Delete {
+			zlog.Info("deleting snapshot per retention policy", zap.String("snapshot", decision.Snapshot.Name))
+			names[i] = decision.Snapshot.Name
+		}
+		if err := deleter.DeleteSnapshots(names); err != nil {
+			return plan, fmt.Errorf("deleting snapshots: %w", err)
+		}
+		return plan, nil
+	}
+
+	for _, decision := range plan.Delete {
+		zlog.Info("deleting snapshot per retention policy", zap.String("snapshot", decision.Snapshot.Name))
+		if err := s.Delete(decision.Snapshot.Name); err != nil {
+			return plan, fmt.Errorf("deleting snapshot %q: %w", decision.Snapshot.Name, err)
+		}
+	}
+
+	return plan, nil
+}
+
+// batchDeleter returns the BatchDeleter of the backend, looking through the
+// wrappers of New.
+func batchDeleter(s Snapshotter) (BatchDeleter, bool) {
+	for {
+		if deleter, ok := s.(BatchDeleter); ok {
+			return deleter, true
+		}
+
+		hooked, ok := s.(*hookedSnapshotter)
+		if !ok {
+			return nil, false
+		}
+		s = hooked.Snapshotter
+	}
+}
+
+// retainingSnapshotter applies its retention policy after each successful
+// Backup, pruning errors are logged and do not fail the backup.
+type retainingSnapshotter struct {
+	Snapshotter
+	policy *RetentionPolicy
+}
+
+func (s *retainingSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
+	snapshotName, err := s.Snapshotter.Backup(lastSeenBlockNum)
+	if err != nil {
+		return snapshotName, err
+	}
+
+	plan, err := ApplyRetention(s.Snapshotter, s.policy)
+	if err != nil {
+		zlog.Warn("unable to apply retention policy after backup", zap.String("snapshot", snapshotName), zap.Error(err))
+		return snapshotName, nil
+	}
+
+	zlog.Info("retention policy applied", zap.String("snapshot", snapshotName), zap.Int("kept", len(plan.Keep)), zap.Int("deleted", len(plan.Delete)))
+	return snapshotName, nil
+}
@@ -0,0 +1,124 @@
+package snapshotter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyPlan(t *testing.T) {
+	now := time.Date(2022, 5, 18, 12, 0, 0, 0, time.UTC)
+	at := func(value string) time.Time {
+		out, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// Listed out of order, v2 is a group of its own whose only snapshot is
+	// always kept as its most recent one
+	snapshots := func() []*Snapshot {
+		return []*Snapshot{
+			{Name: "s4", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-16T12:00:00Z")},
+			{Name: "s1", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-18T06:00:00Z")},
+			{Name: "s8", Namespace: "default", Tag: "v1", CreatedAt: at("2022-03-31T12:00:00Z")},
+			{Name: "s2", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-18T00:30:00Z")},
+			{Name: "s3", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-17T12:00:00Z")},
+			{Name: "s5", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-15T12:00:00Z")},
+			{Name: "v2", Namespace: "default", Tag: "v2", CreatedAt: at("2022-01-01T12:00:00Z")},
+			{Name: "s6", Namespace: "default", Tag: "v1", CreatedAt: at("2022-05-10T12:00:00Z")},
+			{Name: "s7", Namespace: "default", Tag: "v1", CreatedAt: at("2022-04-30T12:00:00Z")},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		policy     RetentionPolicy
+		wantKeep   string
+		wantDelete string
+	}{
+		{
+			name:     "empty",
+			policy:   RetentionPolicy{},
+			wantKeep: "s1 s2 s3 s4 s5 s6 s7 s8 v2",
+		},
+		{
+			name:       "keep-last",
+			policy:     RetentionPolicy{KeepLast: 2},
+			wantKeep:   "s1 s2 v2",
+			wantDelete: "s3 s4 s5 s6 s7 s8",
+		},
+		{
+			name:       "keep-within",
+			policy:     RetentionPolicy{KeepWithin: 24 * time.Hour},
+			wantKeep:   "s1 s2 s3 v2",
+			wantDelete: "s4 s5 s6 s7 s8",
+		},
+		{
+			name:       "daily",
+			policy:     RetentionPolicy{KeepDaily: 3},
+			wantKeep:   "s1 s3 s4 v2",
+			wantDelete: "s2 s5 s6 s7 s8",
+		},
+		{
+			name:       "weekly",
+			policy:     RetentionPolicy{KeepWeekly: 2},
+			wantKeep:   "s1 s5 v2",
+			wantDelete: "s2 s3 s4 s6 s7 s8",
+		},
+		{
+			name:       "monthly",
+			policy:     RetentionPolicy{KeepMonthly: 3},
+			wantKeep:   "s1 s7 s8 v2",
+			wantDelete: "s2 s3 s4 s5 s6",
+		},
+		{
+			name:       "combined",
+			policy:     RetentionPolicy{KeepLast: 1, KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 2},
+			wantKeep:   "s1 s3 s5 s7 v2",
+			wantDelete: "s2 s4 s6 s8",
+		},
+	}
+
+	names := func(decisions []*RetentionDecision) string {
+		var out []string
+		for _, decision := range decisions {
+			out = append(out, decision.Snapshot.Name)
+		}
+		return strings.Join(out, " ")
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := test.policy.Plan(snapshots(), now)
+
+			if got := names(plan.Keep); got != test.wantKeep {
+				t.Errorf("keep %q, want %q", got, test.wantKeep)
+			}
+			if got := names(plan.Delete); got != test.wantDelete {
+				t.Errorf("delete %q, want %q", got, test.wantDelete)
+			}
+			for _, decision := range plan.Keep {
+				if len(decision.Reasons) == 0 {
+					t.Errorf("snapshot %s kept without a reason", decision.Snapshot.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyPlanReasons(t *testing.T) {
+	now := time.Date(2022, 5, 18, 12, 0, 0, 0, time.UTC)
+	policy := &RetentionPolicy{KeepLast: 1, KeepWithin: time.Hour, KeepDaily: 1}
+
+	plan := policy.Plan([]*Snapshot{{Name: "s1", Namespace: "default", Tag: "v1", CreatedAt: now.Add(-time.Minute)}}, now)
+	if len(plan.Keep) != 1 {
+		t.Fatalf("kept %d snapshots, want 1", len(plan.Keep))
+	}
+
+	want := "most recent, keep-last 1, keep-within 1h0m0s, keep-daily 2022-05-18"
+	if got := strings.Join(plan.Keep[0].Reasons, ", "); got != want {
+		t.Errorf("reasons %q, want %q", got, want)
+	}
+}
@@ -16,67 +16,119 @@ package snapshotter
 
 import (
 	"context"
+	"crypto/sha256"
+	goerrors "errors"
 	"fmt"
-	"os/exec"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/api/compute/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"google.golang.org/api/googleapi"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
 func ListSnapshots(ctx context.Context) (out []*compute.Snapshot, err error) {
+	return listSnapshots(ctx, EnvConfig.project, "")
+}
+
+func listSnapshots(ctx context.Context, project, filter string) (out []*compute.Snapshot, err error) {
 	service, err := compute.NewService(ctx)
 	if err != nil {
 		return
 	}
 
-	// List all snapshots
-	lst, err := service.Snapshots.List(EnvConfig.project).Do()
-	if err != nil {
-		return
+	call := service.Snapshots.List(project)
+	if filter != "" {
+		call = call.Filter(filter)
 	}
 
-	out = lst.Items
+	err = call.Pages(ctx, func(page *compute.SnapshotList) error {
+		out = append(out, page.Items...)
+		return nil
+	})
 	return
 }
 
+func deleteSnapshot(ctx context.Context, project, snapshotName string) error {
+	service, err := compute.NewService(ctx)
+	if err != nil {
+		return err
+	}
+
+	op, err := service.Snapshots.Delete(project, snapshotName).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	return WaitForOperation(ctx, service, project, op)
+}
+
 func InsertPVFromSnapshot(ctx context.Context, logger *zap.Logger, snapshot *compute.Snapshot, namePrefix, zone string) (out *compute.Disk, err error) {
+	return insertDiskFromSnapshot(ctx, logger, EnvConfig.project, snapshot, "batch-"+namePrefix+snapshot.Name, &pdDef{zone: zone})
+}
+
+// insertDiskFromSnapshot creates the disk in the zone of `location` or, when
+// it is regional, in its region replicated in its replica zones. The disk is
+// of the type of `location`, DefaultDiskType when it is not known.
+func insertDiskFromSnapshot(ctx context.Context, logger *zap.Logger, project string, snapshot *compute.Snapshot, pdName string, location *pdDef) (out *compute.Disk, err error) {
 	service, err := compute.NewService(ctx)
 	if err != nil {
 		return
 	}
 
-	pdName := "batch-" + namePrefix + snapshot.Name
+	logger.Info("launching creation of persistent disk", zap.String("name", pdName), zap.String("location", location.location()))
 
-	logger.Info("launching creation of persistent disk", zap.String("name", pdName), zap.String("zone", zone))
-
-	_, err = service.Disks.Insert(EnvConfig.project, zone, &compute.Disk{
+	disk := &compute.Disk{
 		Description:    "created by snapshotter, from " + snapshot.Name,
 		Name:           pdName,
 		SourceSnapshot: snapshot.SelfLink,
-		Type:           "projects/" + EnvConfig.project + "/zones/" + zone + "/diskTypes/pd-ssd",
-	}).Do()
+	}
+
+	diskType := location.diskType
+	if diskType == "" {
+		diskType = DefaultDiskType
+	}
+
+	var op *compute.Operation
+	if location.regional {
+		disk.Type = "projects/" + project + "/regions/" + location.region + "/diskTypes/" + diskType
+		for _, zone := range location.replicaZones {
+			disk.ReplicaZones = append(disk.ReplicaZones, "projects/"+project+"/zones/"+zone)
+		}
+		op, err = service.RegionDisks.Insert(project, location.region, disk).Context(ctx).Do()
+	} else {
+		disk.Type = "projects/" + project + "/zones/" + location.zone + "/diskTypes/" + diskType
+		op, err = service.Disks.Insert(project, location.zone, disk).Context(ctx).Do()
+	}
 	if err != nil {
 		return
 	}
 
+	if err = WaitForOperation(ctx, service, project, op); err != nil {
+		return nil, fmt.Errorf("creating disk %s: %w", pdName, err)
+	}
+
 	for {
-		disk, err := service.Disks.Get(EnvConfig.project, zone, pdName).Do()
+		if location.regional {
+			out, err = service.RegionDisks.Get(project, location.region, pdName).Context(ctx).Do()
+		} else {
+			out, err = service.Disks.Get(project, location.zone, pdName).Context(ctx).Do()
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		if disk.Status == "READY" {
-			logger.Info("disk creation ready", zap.String("name", disk.Name), zap.String("status", disk.Status), zap.Int64("size_gb", disk.SizeGb))
-			return disk, nil
+		if out.Status == "READY" {
+			logger.Info("disk creation ready", zap.String("name", out.Name), zap.String("status", out.Status), zap.Int64("size_gb", out.SizeGb))
+			return out, nil
 		}
 
-		time.Sleep(10 * time.Second)
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return nil, err
+		}
 	}
 }
 
@@ -84,135 +136,356 @@ func GenerateName(namespace, appNameVer string, lastSeenBlockNum uint32) string
 	return fmt.Sprintf("%s-%s-%0.10d", namespace, appNameVer, lastSeenBlockNum)
 }
 
+// ParseName is the inverse of GenerateName, also accepting the volume suffix
+// of snapshots taken as part of a multi-volume group. Namespace and tag can
+// both contain dashes so the namespace must be known to extract the tag, when
+// `namespace` is empty only the block number and volume are decoded. Names
+// truncated by limitName are decoded as long as their block number was kept,
+// their volume is then left empty as only the labels know it.
+func ParseName(namespace, name string) (tag string, blockNum uint32, volume string, err error) {
+	truncated := isTruncatedName(name)
+	segments := strings.Split(name, "-")
+	if truncated {
+		segments = segments[:len(segments)-1]
+	}
+
+	blockIdx := -1
+	for i := len(segments) - 1; i > 0; i-- {
+		if len(segments[i]) >= 10 && isDigits(segments[i]) {
+			blockIdx = i
+			break
+		}
+	}
+	if blockIdx == -1 {
+		return "", 0, "", fmt.Errorf("snapshot name %q does not contain a 10 digits block number", name)
+	}
+
+	block, err := strconv.ParseUint(segments[blockIdx], 10, 32)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("snapshot name %q does not contain a valid block number: %w", name, err)
+	}
+	if !truncated {
+		volume = strings.Join(segments[blockIdx+1:], "-")
+	}
+
+	if namespace == "" {
+		return "", uint32(block), volume, nil
+	}
+
+	prefix := namespace + "-"
+	base := strings.Join(segments[:blockIdx], "-")
+	if !strings.HasPrefix(base, prefix) || len(base) == len(prefix) {
+		return "", 0, "", fmt.Errorf("snapshot name %q is not of the form %s-<tag>-<block>[-<volume>]", name, namespace)
+	}
+
+	return base[len(prefix):], uint32(block), volume, nil
+}
+
+func isDigits(in string) bool {
+	for _, r := range in {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 func TakeSnapshotFromEnv(ctx context.Context, snapshotName string) error {
 	return TakeSnapshot(ctx, snapshotName, EnvConfig.project, EnvConfig.namespace, EnvConfig.podName, "", EnvConfig.archive)
 }
 
+// TakeSnapshot snapshots the persistent disks of the pod whose claim name starts
+// with `prefix` and waits for the GCE operations to complete, any asynchronous
+// failure is returned as an *OperationError. When several disks match, they
+// are snapshotted as a group named `snapshotName`, see createSnapshotGroup.
 func TakeSnapshot(ctx context.Context, snapshotName, project, namespace, pod, prefix string, archive bool) error {
-	pd, err := getPersistentDisk(ctx, pod, namespace, prefix)
+	return takeSnapshot(ctx, &snapshotRequest{
+		name:      snapshotName,
+		project:   project,
+		namespace: namespace,
+		pod:       pod,
+		volumes:   volumeSelector{prefix: prefix},
+		archive:   archive,
+	})
+}
+
+type snapshotRequest struct {
+	name      string
+	project   string
+	namespace string
+	pod       string
+	volumes   volumeSelector
+	archive   bool
+
+	// mounts are the paths where the disks are mounted in this container, they
+	// are frozen with the `freeze` method, or synced, while the snapshots are
+	// requested. Without mounts, every filesystem is synced.
+	mounts []string
+	freeze string
+
+	// tag and blockNum are recorded as labels on the snapshot when tag is set
+	tag      string
+	blockNum uint32
+
+	// waitReady waits for the snapshot to be READY instead of returning as
+	// soon as the creation operation is done.
+	waitReady bool
+}
+
+func takeSnapshot(ctx context.Context, req *snapshotRequest) error {
+	pds, err := getPersistentDisks(ctx, req.pod, req.namespace, req.volumes)
 	if err != nil {
 		return fmt.Errorf("error getting persistent disk: %v", err)
 	}
 
-	err = exec.CommandContext(ctx, "/bin/sync").Start()
+	thaw, err := quiesce(ctx, req.mounts, req.freeze)
 	if err != nil {
-		return fmt.Errorf("/bin/sync: %s", err)
+		return err
 	}
+	defer thaw()
 
-	time.Sleep(10 * time.Second)
+	return createSnapshotGroup(ctx, req, pds, thaw)
+}
 
-	err = createSnapshot(ctx, snapshotName, project, pd, archive)
+// GroupMemberName returns the name of the snapshot of `volume` within the
+// group `groupName`. A single volume group has a single snapshot named after
+// the group.
+func GroupMemberName(groupName, volume string, groupSize int) string {
+	if groupSize == 1 {
+		return limitName(groupName)
+	}
+	return limitName(groupName + "-" + volume)
+}
+
+// RestoreName returns the name of the disk (or claim) restored from the
+// snapshot `snapshotName`.
+func RestoreName(snapshotName string) string {
+	return limitName("restore-" + snapshotName)
+}
 
-	time.Sleep(10 * time.Second)
+// maxNameLength is the length limit of GCE resource names and Kubernetes
+// label values, which snapshot names are also used as.
+const maxNameLength = 63
 
-	return err
+// nameHashLength is the length of the hash ending truncated names.
+const nameHashLength = 8
+
+// limitName truncates names longer than maxNameLength, replacing the end with
+// a hash of the full name so truncated names stay distinct. Truncated names
+// are always maxNameLength long, which ParseName relies on to recognize them.
+// Backends find the members of a group from their labels, not from their names.
+func limitName(name string) string {
+	if len(name) <= maxNameLength {
+		return name
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:nameHashLength]
+	return name[:maxNameLength-nameHashLength-1] + "-" + hash
+}
+
+// isTruncatedName tells if `name` looks like the output of limitName for a
+// longer name.
+func isTruncatedName(name string) bool {
+	if len(name) != maxNameLength || name[maxNameLength-nameHashLength-1] != '-' {
+		return false
+	}
+	for _, r := range name[maxNameLength-nameHashLength:] {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
 }
 
-func createSnapshot(ctx context.Context, snapshotName, project string, pd *pdDef, archive bool) error {
+// createSnapshotGroup launches the snapshot of every disk before waiting on
+// any of them, so they all capture the same block. `thaw` is called as soon
+// as GCE acknowledged every snapshot request, the content of the disks being
+// captured from then on. The group succeeds or fails as a whole, on failure
+// the snapshots already created are deleted.
+func createSnapshotGroup(ctx context.Context, req *snapshotRequest, pds []*pdDef, thaw func()) (err error) {
 	service, err := compute.NewService(ctx)
 	if err != nil {
 		return err
 	}
 
+	type launchedSnapshot struct {
+		name string
+		pd   *pdDef
+		op   *compute.Operation
+	}
+
+	var launched []*launchedSnapshot
+	defer func() {
+		if err != nil {
+			thaw()
+			for _, snapshot := range launched {
+				deleteFailedGroupMember(req.project, snapshot.name)
+			}
+		}
+	}()
+
+	for _, pd := range pds {
+		name := GroupMemberName(req.name, pd.volume, len(pds))
+		op, err := createSnapshot(ctx, service, req, name, pd)
+		if err != nil {
+			return fmt.Errorf("creating snapshot %s of disk %s: %w", name, pd.name, err)
+		}
+		launched = append(launched, &launchedSnapshot{name: name, pd: pd, op: op})
+	}
+	thaw()
+
+	for _, snapshot := range launched {
+		if err := WaitForOperation(ctx, service, req.project, snapshot.op); err != nil {
+			return fmt.Errorf("creating snapshot %s of disk %s: %w", snapshot.name, snapshot.pd.name, err)
+		}
+	}
+
+	if req.waitReady {
+		for _, snapshot := range launched {
+			if err := WaitForSnapshotReady(ctx, service, req.project, snapshot.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	zlog.Info("snapshot group created", zap.String("group", req.name), zap.Int("volumes", len(launched)), zap.Bool("ready", req.waitReady))
+	return nil
+}
+
+func createSnapshot(ctx context.Context, service *compute.Service, req *snapshotRequest, name string, pd *pdDef) (*compute.Operation, error) {
 	theSnapshot := &compute.Snapshot{
-		Name: snapshotName,
+		Name: name,
 		//Description: "some snapshot attempt",
+		Labels: snapshotLabels(req, pd),
 		StorageLocations: []string{
 			pd.region,
 		},
 	}
 
-	if archive {
+	if req.archive {
 		theSnapshot.SnapshotType = "ARCHIVE"
 	} else {
 		theSnapshot.SnapshotType = "STANDARD"
 	}
 
-	op, err := service.Disks.CreateSnapshot(project, pd.zone, pd.name, theSnapshot).Do()
+	var op *compute.Operation
+	var err error
+	if pd.regional {
+		op, err = service.RegionDisks.CreateSnapshot(req.project, pd.region, pd.name, theSnapshot).Context(ctx).Do()
+	} else {
+		op, err = service.Disks.CreateSnapshot(req.project, pd.zone, pd.name, theSnapshot).Context(ctx).Do()
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Printf("Snapshot creation: %s %s %s\n", op.Status, op.SelfLink, op.Zone)
+	zlog.Info("snapshot creation launched", zap.String("snapshot", name), zap.String("disk", pd.name), zap.String("status", op.Status), zap.String("operation", op.SelfLink), zap.String("location", pd.location()))
+	return op, nil
+}
+
+// deleteFailedGroupMember runs on its own context since the one of the
+// backup may be the reason the group failed.
+func deleteFailedGroupMember(project, snapshotName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
 
-	return nil
+	zlog.Info("deleting snapshot of failed group", zap.String("snapshot", snapshotName))
+	if err := deleteSnapshot(ctx, project, snapshotName); err != nil && !isNotFound(err) {
+		zlog.Warn("unable to delete snapshot of failed group", zap.String("snapshot", snapshotName), zap.Error(err))
+	}
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return goerrors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
 }
 
 type pdDef struct {
-	name   string
-	zone   string
-	region string
+	name      string
+	zone      string
+	region    string
+	claimName string
+	volume    string
+	diskType  string
+
+	// regional disks have no zone, they are replicated in replicaZones
+	regional     bool
+	replicaZones []string
 }
 
-func getPersistentDisk(ctx context.Context, pod, namespace, prefix string) (out *pdDef, err error) {
-	config, err := rest.InClusterConfig()
-	if err == rest.ErrNotInCluster {
-		config = &rest.Config{
-			Host: "http://localhost:8001", // from running `kubectl proxy`
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("in cluster config: %s", err)
-	}
+// volumeSelector picks the pod PVCs to snapshot: the ones listed in `claims`,
+// by PVC name or by volume claim template name, or else every PVC whose name
+// starts with `prefix`.
+type volumeSelector struct {
+	prefix string
+	claims []string
+}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("new for config: %s", err)
+// parseVolumeSelector reads the `prefix` and `pvcs` keys of a config, `pvcs`
+// taking precedence.
+func parseVolumeSelector(conf map[string]string) volumeSelector {
+	volumes := volumeSelector{prefix: conf["prefix"]}
+	if conf["pvcs"] != "" {
+		volumes.claims = strings.Split(conf["pvcs"], ",")
 	}
+	return volumes
+}
 
-	mypod, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
-	if errors.IsNotFound(err) {
-		return
-	} else if statusError, isStatus := err.(*errors.StatusError); isStatus {
-		return nil, fmt.Errorf("cannot get pod: %s", statusError.ErrStatus.Message)
-	} else if err != nil {
-		return
+func (s volumeSelector) matches(claimName, pod string) bool {
+	if len(s.claims) == 0 {
+		return strings.HasPrefix(claimName, s.prefix)
 	}
 
-	var claimName string
-	for _, vol := range mypod.Spec.Volumes {
-		if vol.PersistentVolumeClaim != nil {
-			// Eventually, select a specific one in the list.. or match something
-			if strings.HasPrefix(vol.PersistentVolumeClaim.ClaimName, prefix) {
-				claimName = vol.PersistentVolumeClaim.ClaimName
-			}
+	for _, claim := range s.claims {
+		if claimName == claim || claimName == claim+"-"+pod {
+			return true
 		}
 	}
-	if claimName == "" {
-		return nil, fmt.Errorf("did not find any pvc")
-	}
+	return false
+}
+
+// volumeName strips the pod name from a StatefulSet claim name, leaving the
+// volume claim template name, like `datadir` for `datadir-mindreader-v3-1`.
+func volumeName(claimName, pod string) string {
+	return strings.TrimSuffix(claimName, "-"+pod)
+}
 
-	mypvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, claimName, metav1.GetOptions{})
+func getPersistentDisks(ctx context.Context, pod, namespace string, volumes volumeSelector) (out []*pdDef, err error) {
+	clientset, err := newKubernetesClientset()
 	if err != nil {
-		return
+		return nil, err
 	}
-	pvName := mypvc.Spec.VolumeName
 
-	mypv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	claims, err := getPodClaims(ctx, clientset, pod, namespace, volumes)
 	if err != nil {
-		return nil, fmt.Errorf("getting pv %q: %s", pvName, err)
+		return nil, err
 	}
 
-	if mypv.Spec.GCEPersistentDisk == nil {
-		return nil, fmt.Errorf("no gce persistent disk")
+	for _, claimName := range claims {
+		pd, err := getClaimPersistentDisk(ctx, clientset, namespace, claimName)
+		if err != nil {
+			return nil, err
+		}
+		pd.volume = volumeName(pd.claimName, pod)
+		out = append(out, pd)
 	}
 
-	labels := mypv.GetLabels()
-	zone, ok := labels["failure-domain.beta.kubernetes.io/zone"]
-	if !ok {
-		zone, ok = labels["topology.kubernetes.io/zone"]
-	}
-	if !ok {
-		return nil, fmt.Errorf("cannot find zone for PV %s, no failure-domain.beta.kubernetes.io/zone or topology.kubernetes.io/zone label on PV", pvName)
-	}
+	return out, nil
+}
 
-	region, ok := labels["failure-domain.beta.kubernetes.io/region"]
-	if !ok {
-		region, ok = labels["topology.kubernetes.io/region"]
+func getClaimPersistentDisk(ctx context.Context, clientset kubernetes.Interface, namespace, claimName string) (out *pdDef, err error) {
+	mypv, err := getClaimPersistentVolume(ctx, clientset, namespace, claimName)
+	if err != nil {
+		return nil, err
 	}
 
-	if !ok {
-		return nil, fmt.Errorf("cannot find region for PV %s, no failure-domain.beta.kubernetes.io/region or topology.kubernetes.io/region label on PV", pvName)
+	out, err = pdDefFromPV(mypv, claimName)
+	if err != nil {
+		return nil, err
 	}
 
-	return &pdDef{name: mypv.Spec.GCEPersistentDisk.PDName, zone: zone, region: region}, nil
+	if out.diskType, err = StorageClassDiskType(ctx, clientset, mypv.Spec.StorageClassName); err != nil {
+		return nil, err
+	}
+	return out, nil
 }
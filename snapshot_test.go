@@ -0,0 +1,137 @@
+package snapshotter
+
+import "testing"
+
+func TestGroupMemberName(t *testing.T) {
+	long := GenerateName("ethereum-mainnet-archive", "geth-v1-10-17-full-sync", 14000000)
+
+	tests := []struct {
+		name      string
+		groupName string
+		volume    string
+		groupSize int
+		want      string
+	}{
+		{name: "single volume", groupName: "default-v1-0000000100", volume: "datadir", groupSize: 1, want: "default-v1-0000000100"},
+		{name: "group", groupName: "default-v1-0000000100", volume: "datadir", groupSize: 2, want: "default-v1-0000000100-datadir"},
+		{name: "long group", groupName: long, volume: "datadir", groupSize: 2, want: "ethereum-mainnet-archive-geth-v1-10-17-full-sync-00140-6877da68"},
+		{name: "long single volume", groupName: long + "-more", volume: "datadir", groupSize: 1, want: "ethereum-mainnet-archive-geth-v1-10-17-full-sync-00140-1e785317"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := GroupMemberName(test.groupName, test.volume, test.groupSize)
+			if got != test.want {
+				t.Errorf("GroupMemberName %q, want %q", got, test.want)
+			}
+			if len(got) > maxNameLength {
+				t.Errorf("GroupMemberName %q is %d characters long", got, len(got))
+			}
+		})
+	}
+}
+
+func TestRestoreName(t *testing.T) {
+	long := GroupMemberName(GenerateName("ethereum-mainnet-archive", "geth-v1-10-17-full-sync", 14000000), "datadir", 2)
+
+	tests := []struct {
+		snapshotName string
+		want         string
+	}{
+		{snapshotName: "default-v1-0000000100-datadir", want: "restore-default-v1-0000000100-datadir"},
+		{snapshotName: long, want: "restore-ethereum-mainnet-archive-geth-v1-10-17-full-sy-5521c4d0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.snapshotName, func(t *testing.T) {
+			got := RestoreName(test.snapshotName)
+			if got != test.want {
+				t.Errorf("RestoreName %q, want %q", got, test.want)
+			}
+			if len(got) > maxNameLength {
+				t.Errorf("RestoreName %q is %d characters long", got, len(got))
+			}
+		})
+	}
+
+	if RestoreName(long+"-a") == RestoreName(long+"-b") {
+		t.Errorf("truncated restore names are not distinct")
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name         string
+		namespace    string
+		snapshotName string
+		wantTag      string
+		wantBlockNum uint32
+		wantVolume   string
+		wantErr      bool
+	}{
+		{name: "generated", namespace: "default", snapshotName: "default-v1-0000000100", wantTag: "v1", wantBlockNum: 100},
+		{name: "dashes in namespace and tag", namespace: "eth-mainnet", snapshotName: "eth-mainnet-geth-v1-0014000000", wantTag: "geth-v1", wantBlockNum: 14000000},
+		{name: "volume suffix", namespace: "default", snapshotName: "default-v1-0000000100-datadir", wantTag: "v1", wantBlockNum: 100, wantVolume: "datadir"},
+		{name: "volume suffix with dashes", namespace: "default", snapshotName: "default-v1-0000000100-state-db", wantTag: "v1", wantBlockNum: 100, wantVolume: "state-db"},
+		{name: "block number past 10 digits", namespace: "default", snapshotName: "default-v1-4000000000", wantTag: "v1", wantBlockNum: 4000000000},
+		{name: "digits in tag", namespace: "default", snapshotName: "default-1234-0000000100", wantTag: "1234", wantBlockNum: 100},
+		{name: "unknown namespace", snapshotName: "default-v1-0000000100-datadir", wantBlockNum: 100, wantVolume: "datadir"},
+		{name: "other namespace", namespace: "other", snapshotName: "default-v1-0000000100", wantErr: true},
+		{name: "missing tag", namespace: "default", snapshotName: "default-0000000100", wantErr: true},
+		{name: "no block number", namespace: "default", snapshotName: "default-v1-latest", wantErr: true},
+		{name: "short block number", namespace: "default", snapshotName: "default-v1-100", wantErr: true},
+		{name: "block number overflow", namespace: "default", snapshotName: "default-v1-9999999999", wantErr: true},
+		{name: "truncated volume", namespace: "default", snapshotName: "default-v1-0000000100-state-db-of-the-archive-node-for-6bd5e503", wantTag: "v1", wantBlockNum: 100},
+		{name: "truncated block number", namespace: "default", snapshotName: "default-ethereum-mainnet-archive-geth-v1-10-17-full-sy-6bd5e503", wantErr: true},
+		{name: "hash like volume", namespace: "default", snapshotName: "default-v1-0000000100-6bd5e503", wantTag: "v1", wantBlockNum: 100, wantVolume: "6bd5e503"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tag, blockNum, volume, err := ParseName(test.namespace, test.snapshotName)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %q as tag %q, block %d, volume %q, want an error", test.snapshotName, tag, blockNum, volume)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tag != test.wantTag || blockNum != test.wantBlockNum || volume != test.wantVolume {
+				t.Errorf("parsed tag %q, block %d, volume %q, want %q, %d, %q", tag, blockNum, volume, test.wantTag, test.wantBlockNum, test.wantVolume)
+			}
+		})
+	}
+}
+
+func TestParseNameTruncated(t *testing.T) {
+	groupName := GenerateName("ethereum-mainnet", "geth-v1-10-17", 14000000)
+
+	tests := []struct {
+		name       string
+		volume     string
+		wantVolume string
+	}{
+		{name: "short volume", volume: "datadir", wantVolume: "datadir"},
+		{name: "long volume", volume: "state-db-of-the-full-archive-node"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := GroupMemberName(groupName, test.volume, 2)
+			tag, blockNum, volume, err := ParseName("ethereum-mainnet", name)
+			if err != nil {
+				t.Fatalf("parsing %q: %s", name, err)
+			}
+			if tag != "geth-v1-10-17" || blockNum != 14000000 || volume != test.wantVolume {
+				t.Errorf("parsed %q as tag %q, block %d, volume %q, want %q, %d, %q", name, tag, blockNum, volume, "geth-v1-10-17", 14000000, test.wantVolume)
+			}
+
+			// Labels are truncated like names
+			if label := sanitizeLabelValue(groupName + "-" + test.volume); label != name {
+				t.Errorf("label %q differs from name %q", label, name)
+			}
+		})
+	}
+}
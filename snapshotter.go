@@ -1,55 +1,168 @@
 package snapshotter
 
 import (
-	"context"
 	"fmt"
-	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
-type GKEPVCSnapshotter struct {
-	tag       string
-	project   string
-	namespace string
-	pod       string
-	prefix    string
-	archive   bool
+// Snapshotter is implemented by every backup backend. Apps pick the backend
+// through the `type=` key of their config string, see New.
+type Snapshotter interface {
+	// RequiresStop returns true when the app must stop writing to its data
+	// directory for the whole duration of Backup.
+	RequiresStop() bool
+
+	// Backup takes a snapshot tagged with the last block the app has seen and
+	// returns the name of the created snapshot. Backends capturing several
+	// volumes return the name of the group, used with Restore and Delete.
+	Backup(lastSeenBlockNum uint32) (string, error)
+
+	// Restore restores the snapshot named `snapshotName` created by this backend.
+	Restore(snapshotName string) error
+
+	// List returns the snapshots created by this backend for its configured
+	// namespace and tag, most recent first.
+	List() ([]*Snapshot, error)
+
+	// Delete removes the snapshot named `snapshotName`.
+	Delete(snapshotName string) error
 }
 
-var gkeExampleConfigString = "type=gke-pvc-snapshot tag=v1 namespace=default project=mygcpproject prefix=datadir archive=true"
+// Version of the snapshotter recorded on the snapshots it creates, it is
+// meant to be overridden at build time through `-ldflags`.
+var Version = "dev"
 
-func NewGKEPVCSnapshotter(conf map[string]string) (*GKEPVCSnapshotter, error) {
-	for _, label := range []string{"tag", "project", "namespace", "prefix", "archive"} {
-		if err := gkeCheckMissing(conf, label); err != nil {
-			return nil, err
-		}
+// Snapshot is the backend agnostic view of a snapshot.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Tag       string    `json:"tag"`
+	BlockNum  uint32    `json:"block_num"`
+	CreatedAt time.Time `json:"created_at"`
+	// Volumes lists the volumes captured by the snapshot, when known
+	Volumes []string `json:"volumes,omitempty"`
+}
+
+// FactoryFunc creates a Snapshotter out of the key/value pairs of a config
+// string, the `type` key included.
+type FactoryFunc func(conf map[string]string) (Snapshotter, error)
+
+var registry = map[string]FactoryFunc{}
+
+// Register makes a backend available to New under `typeName`. It panics if
+// the type is registered twice, it is meant to be called from `init()`.
+func Register(typeName string, factory FactoryFunc) {
+	if _, found := registry[typeName]; found {
+		panic(fmt.Errorf("snapshotter type %q is already registered", typeName))
 	}
-	return &GKEPVCSnapshotter{
-		tag:       conf["tag"],
-		project:   conf["project"],
-		namespace: conf["namespace"],
-		pod:       os.Getenv("HOSTNAME"),
-		prefix:    conf["prefix"],
-		archive:   conf["archive"] == "true",
-	}, nil
+
+	registry[typeName] = factory
 }
 
-func (s *GKEPVCSnapshotter) RequiresStop() bool {
-	return true
+// RegisteredTypes returns the sorted list of registered backend types.
+func RegisteredTypes() (out []string) {
+	for typeName := range registry {
+		out = append(out, typeName)
+	}
+	sort.Strings(out)
+	return
 }
 
-func (s *GKEPVCSnapshotter) Backup(lastSeenBlockNum uint32) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
+// New parses a config string like `type=gke-pvc-snapshot tag=v1 namespace=default ...`
+// and returns the backend registered for its `type`. When hook keys are
+// present (see ParseHooks), the hooks run around every Backup. When retention
+// keys are present (see ParseRetentionPolicy), the backend prunes its
+// snapshots after every successful Backup.
+func New(config string) (Snapshotter, error) {
+	conf, err := ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	typeName := conf["type"]
+	if typeName == "" {
+		return nil, fmt.Errorf("snapshotter config %q is missing the 'type' key, valid types are %s", config, strings.Join(RegisteredTypes(), ", "))
+	}
+
+	factory, found := registry[typeName]
+	if !found {
+		return nil, fmt.Errorf("unknown snapshotter type %q, valid types are %s", typeName, strings.Join(RegisteredTypes(), ", "))
+	}
 
-	snapshotName := GenerateName(s.namespace, s.tag, lastSeenBlockNum)
-	return snapshotName, TakeSnapshot(ctx, snapshotName, s.project, s.namespace, s.pod, s.prefix, s.archive)
+	policy, err := ParseRetentionPolicy(conf)
+	if err != nil {
+		return nil, err
+	}
 
+	hooks, err := ParseHooks(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := factory(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hooks.IsEmpty() {
+		s = WithHooks(s, hooks)
+	}
+
+	if policy.IsEmpty() {
+		return s, nil
+	}
+	return &retainingSnapshotter{Snapshotter: s, policy: policy}, nil
 }
 
-func gkeCheckMissing(conf map[string]string, param string) error {
-	if conf[param] == "" {
-		return fmt.Errorf("backup module gke-pvc-snapshot missing value for %s. Example: %s", param, gkeExampleConfigString)
+// ParseConfig splits a space separated list of `key=value` pairs into a map.
+func ParseConfig(config string) (map[string]string, error) {
+	conf := map[string]string{}
+	for _, field := range strings.Fields(config) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid snapshotter config entry %q, expecting key=value", field)
+		}
+
+		if _, found := conf[parts[0]]; found {
+			return nil, fmt.Errorf("snapshotter config key %q is defined more than once", parts[0])
+		}
+		conf[parts[0]] = parts[1]
+	}
+
+	return conf, nil
+}
+
+func sortSnapshotsByMostRecent(snapshots []*Snapshot) {
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+}
+
+// snapshotGroups merges the snapshots of a group into one Snapshot, named
+// after the group and listing the volumes of all its members.
+type snapshotGroups struct {
+	byName map[string]*Snapshot
+	list   []*Snapshot
+}
+
+// add adds the snapshot to its group, snapshots without a group form their
+// own group.
+func (g *snapshotGroups) add(groupName string, snap *Snapshot) {
+	if groupName == "" {
+		groupName = snap.Name
+	}
+
+	if group, found := g.byName[groupName]; found {
+		group.Volumes = append(group.Volumes, snap.Volumes...)
+		return
+	}
+
+	if g.byName == nil {
+		g.byName = map[string]*Snapshot{}
 	}
-	return nil
+	snap.Name = groupName
+	g.byName[groupName] = snap
+	g.list = append(g.list, snap)
 }
@@ -0,0 +1,48 @@
+package snapshotter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "empty", config: "", want: map[string]string{}},
+		{name: "blank", config: "  \t ", want: map[string]string{}},
+		{
+			name:   "keys",
+			config: "type=gke-pvc-snapshot tag=v1 namespace=default project=chain-data",
+			want:   map[string]string{"type": "gke-pvc-snapshot", "tag": "v1", "namespace": "default", "project": "chain-data"},
+		},
+		{name: "extra spaces", config: "  type=local-dir   tag=v1 ", want: map[string]string{"type": "local-dir", "tag": "v1"}},
+		{name: "empty value", config: "type=local-dir mode=", want: map[string]string{"type": "local-dir", "mode": ""}},
+		{name: "value with equal sign", config: "post-hook=http://localhost:8080/resume?force=true", want: map[string]string{"post-hook": "http://localhost:8080/resume?force=true"}},
+		{name: "missing value", config: "type=local-dir tag", wantErr: `invalid snapshotter config entry "tag"`},
+		{name: "missing key", config: "=v1", wantErr: `invalid snapshotter config entry "=v1"`},
+		{name: "duplicate key", config: "tag=v1 tag=v2", wantErr: `key "tag" is defined more than once`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseConfig(test.config)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("config %v, want %v", got, test.want)
+			}
+		})
+	}
+}